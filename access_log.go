@@ -0,0 +1,142 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes a request served by one of the registered
+// handlers. Its Duration is encoded in JSON as a number of nanoseconds.
+type AccessLogEntry struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Email    string        `json:"email,omitempty"`
+	Status   int           `json:"status"`
+	Encoding string        `json:"encoding,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Logger receives an entry for each request served by the registered
+// handlers.
+type Logger interface {
+	LogAccess(entry AccessLogEntry)
+}
+
+// AccessLogger, if set, receives an entry for each request served by the
+// handlers registered by RegisterHandlers.
+var AccessLogger Logger
+
+// JSONLogger is a Logger that writes each entry as a line of JSON.
+type JSONLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLogger returns a JSONLogger that writes to w.
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{
+		w: w,
+	}
+}
+
+// LogAccess implements the LogAccess method of the Logger interface.
+func (l *JSONLogger) LogAccess(entry AccessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// accessLogKey is the request context key of the *AccessLogEntry that is
+// being recorded for the request.
+type accessLogKey struct{}
+
+// accessLogWriter records the status code of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface.
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logAccess wraps a handler, sending an entry for each request to the
+// AccessLogger, if one is set.
+func logAccess(f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		logger := AccessLogger
+		if logger == nil {
+			f(rw, req)
+			return
+		}
+
+		entry := &AccessLogEntry{
+			Time:   time.Now(),
+			Method: req.Method,
+			Path:   req.URL.Path,
+		}
+		w := &accessLogWriter{
+			ResponseWriter: rw,
+		}
+		defer func() {
+			entry.Duration = time.Since(entry.Time)
+			entry.Status = w.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			entry.Encoding = rw.Header().Get("Content-Encoding")
+			logger.LogAccess(*entry)
+		}()
+
+		f(w, req.WithContext(context.WithValue(req.Context(), accessLogKey{}, entry)))
+	}
+}
+
+// logAccessEmail records the email address that the request concerns in its
+// access log entry. For batch requests, the last email address is recorded.
+// Email addresses are hashed as they are in audit logs.
+func logAccessEmail(r *http.Request, email string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*AccessLogEntry); ok {
+		entry.Email = auditEmail(email)
+	}
+}
+
+func validateAccessLog(config *Configuration, s *settings) (err error) {
+	if config.AccessLog.Enabled && AccessLogger == nil {
+		AccessLogger = NewJSONLogger(os.Stderr)
+	}
+
+	return
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+)
+
+// Audit events.
+const (
+	AuditCertificateIssued  = "certificate-issued"
+	AuditCertificateRefused = "certificate-refused"
+	AuditSessionChecked     = "session-checked"
+	AuditSessionCreated     = "session-created"
+)
+
+// AuditLogger, if set, receives a record of each certificate request, session
+// check, and session creation.
+var AuditLogger *log.Logger
+
+// audit records an event concerning the given email address, along with the
+// outcome of the event, in the provider's audit log.
+func (p *Provider) audit(event, email, outcome string) {
+	logger := p.AuditLogger
+	if logger == nil {
+		logger = AuditLogger
+	}
+	if logger == nil {
+		return
+	}
+	// Outcomes may quote the email address, so it must be hashed there too.
+	hashed := auditEmail(email)
+	if len(email) > 0 {
+		outcome = strings.Replace(outcome, email, hashed, -1)
+	}
+	logger.Printf("event=%s email=%s outcome=%q", event, hashed, outcome)
+}
+
+// auditEmail returns the given email address as it should appear in audit
+// logs. When a hashing key is configured, this is the hex encoded HMAC-SHA256
+// of the lowercased address, which still allows records to be correlated.
+func auditEmail(email string) string {
+	key := loadSettings().auditEmailKey
+	if len(key) == 0 {
+		return email
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(email)))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validateAudit(config *Configuration, s *settings) (err error) {
+	s.auditEmailKey = []byte(config.Audit.HashEmailsKey)
+	if config.Audit.Enabled && AuditLogger == nil {
+		AuditLogger = log.New(os.Stderr, "persona-audit: ", log.LstdFlags|log.LUTC)
+	}
+
+	return
+}
@@ -5,42 +5,91 @@
 package persona
 
 import (
-	"crypto/x509"
+	"bytes"
+	"compress/flate"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Error messages.
 const (
-	errEncryptedKeysNotSupported = "encrypted private keys are not currently supported."
-	errInvalidAuthenticationUrl  = "authentication URL '%s' is invalid."
-	errInvalidCertificateUrl     = "certificate URL '%s' is invalid."
-	errInvalidDelegationHost     = "delegation host '%s' is invalid."
-	errInvalidProvisioningUrl    = "provisioning URL '%s' is invalid."
-	errInvalidSessionUrl         = "session URL '%s' is invalid."
-	errKeyTypeNotSupported       = "'%s' is not a supported private key type."
-	errNoValidPemBlock           = "'%s' does not contain a valid PEM block."
-	errUnsupportedSessionStore   = "session store '%s' is not currently supported."
+	errCreateSessionSecretRequired = "the session creation URL requires a secret."
+	errCriticalHeaderNotSet        = "critical header parameter '%s' has no value in headers."
+	errDebugTokenRequired          = "the debug server requires a token."
+	errEmptyPrivateKeyEnv          = "environment variable '%s' does not contain a private key."
+	errEncryptedKeysNotSupported   = "legacy encrypted PEM private keys are not currently supported."
+	errInvalidAuthenticationUrl    = "authentication URL '%s' is invalid."
+	errInvalidBatchCertificateUrl  = "batch certificate URL '%s' is invalid."
+	errInvalidCertificateUrl       = "certificate URL '%s' is invalid."
+	errInvalidCleanupInterval      = "session cleanup interval %d is invalid."
+	errInvalidClientKeyBytes       = "maximum client key size of %d bytes is invalid."
+	errInvalidClientKeySize        = "client key size %d is invalid."
+	errInvalidCompressionLevel     = "compression level %d for '%s' is invalid."
+	errInvalidCompressionMinSize   = "minimum compressed response size %d is invalid."
+	errInvalidConnPoolLimits       = "session connection pool limits must not be negative."
+	errInvalidCreateSessionUrl     = "session creation URL '%s' is invalid."
+	errInvalidDebugAddr            = "debug address '%s' is invalid."
+	errInvalidDelegationHost       = "delegation host '%s' is invalid."
+	errInvalidDelegationRetry      = "delegation timeout and retries must not be negative."
+	errInvalidDomain               = "domain '%s' is invalid."
+	errInvalidHealthUrl            = "health URL '%s' is invalid."
+	errInvalidIssuer               = "issuer '%s' is invalid."
+	errInvalidJku                  = "jku '%s' is not a valid https URL."
+	errInvalidJwksUrl              = "JWKS URL '%s' is invalid."
+	errInvalidLogoutUrl            = "logout URL '%s' is invalid."
+	errInvalidMaxPerEmail          = "maximum sessions per email %d is invalid."
+	errInvalidNonceUrl             = "nonce URL '%s' is invalid."
+	errInvalidProvisioningUrl      = "provisioning URL '%s' is invalid."
+	errInvalidRetiredKeyLimit      = "retired key limit %d is invalid."
+	errInvalidSessionMaxDuration   = "maximum session duration %d is invalid."
+	errInvalidSessionStatusUrl     = "session status URL '%s' is invalid."
+	errInvalidSessionUrl           = "session URL '%s' is invalid."
+	errInvalidTimestampGranularity = "timestamp granularity %d is invalid."
+	errKeyFormatMismatch           = "'%s' does not contain a %s encoded private key."
+	errKeyFormatNotSupported       = "'%s' is not a supported private key format for %s keys."
+	errKeyTypeNotSupported         = "'%s' is not a supported private key type."
+	errLogoutSecretRequired        = "the logout URL requires a secret, or a trusted proxy."
+	errNonceSecretTooSmall         = "nonce secret is %d bits, should be at least %d bits."
+	errNoValidPemBlock             = "'%s' does not contain a valid PEM block."
+	errPassphraseRequired          = "'%s' contains an encrypted private key, but no passphrase is configured."
+	errPlaceholderIssuer           = "issuer '%s' is a placeholder, and is only allowed in dev mode."
+	errPrivateKeySource            = "exactly one of a private key file or environment variable must be given."
+	errRegisteredHeader            = "header parameter '%s' is registered, and can not be set or marked as critical."
+	errRSASchemeNotSupported       = "'%s' is not a supported RSA signature scheme."
+	errUnknownClientKeyAlgorithm   = "client key algorithm '%s' is unknown."
+	errUnsupportedEncoding         = "'%s' is not a supported content encoding."
+	errUnsupportedSessionStore     = "session store '%s' is not currently supported."
 )
 
 // SupportedPrivateKeyTypes is a list of the supported private key types.
 //
-// FIXME: DSA is only unsupported due to Go not having a builtin
-// Parse<x>PrivateKey function that handles DSA keys.
-//
 // FIXME: ECDSA is not well documented in the Persona specs, so support is
 // questionable.
 var SupportedPrivateKeyTypes = map[string]bool{
-	//	"DSA": true,
+	"DSA":   true,
 	"ECDSA": true,
+	"HMAC":  true,
 	"RSA":   true,
 }
 
+// SupportedPrivateKeyFormats is a format-to-key-types mapping of the supported
+// private key encodings. The "auto" format tries each encoding in turn.
+var SupportedPrivateKeyFormats = map[string][]string{
+	"auto":  {"DSA", "ECDSA", "RSA"},
+	"pkcs8": {"DSA", "ECDSA", "RSA"},
+	"pkcs1": {"RSA"},
+	"sec1":  {"ECDSA"},
+}
+
 // PrivateKeyTypeToAlgorithm is a human-to-Persona mapping of supported private
 // key type algorithms.
 //
@@ -55,8 +104,16 @@ var PrivateKeyTypeToAlgorithm = map[string]string{
 // Configuration represents the Persona IdP configuration file.
 type Configuration struct {
 	PrivateKey struct {
-		Type string `json:"type"`
-		File string `json:"file"`
+		Type          string `json:"type"`
+		File          string `json:"file"`
+		Env           string `json:"env"`
+		Format        string `json:"format"`
+		Passphrase    string `json:"passphrase"`
+		MaxRetired    int    `json:"max-retired"`
+		RetiredMaxAge int    `json:"retired-max-age"`
+		NotBefore     string `json:"not-before"`
+		NotAfter      string `json:"not-after"`
+		RSAScheme     string `json:"rsa-signature-scheme"`
 	} `json:"private-key"`
 	Authentication struct {
 		Url      string `json:"url"`
@@ -71,30 +128,126 @@ type Configuration struct {
 	Delegation struct {
 		Delegate bool   `json:"delegate"`
 		Host     string `json:"host"`
+		Verify   bool   `json:"verify"`
+		Timeout  int    `json:"timeout"`
+		Retries  int    `json:"retries"`
 	} `json:"delegation"`
 	Session struct {
-		Url     string `json:"url"`
-		Store   string `json:"store"`
-		Backing string `json:"backing"`
+		Url             string `json:"url"`
+		StatusUrl       string `json:"status-url"`
+		LogoutUrl       string `json:"logout-url"`
+		LogoutSecret    string `json:"logout-secret"`
+		CreateUrl       string `json:"create-url"`
+		CreateSecret    string `json:"create-secret"`
+		Store           string `json:"store"`
+		Backing         string `json:"backing"`
+		MaxOpenConns    int    `json:"max-open-conns"`
+		MaxIdleConns    int    `json:"max-idle-conns"`
+		ConnMaxLifetime int    `json:"conn-max-lifetime"`
+		MaxPerEmail     int    `json:"max-per-email"`
+		MaxDuration     int    `json:"max-duration"`
+		CleanupInterval int    `json:"cleanup-interval"`
 	} `json:"session"`
-	CertificateUrl string `json:"certificate-url"`
+	Issuer              string `json:"issuer"`
+	CertificateUrl      string `json:"certificate-url"`
+	BatchCertificateUrl string `json:"batch-certificate-url"`
+	Certificate         struct {
+		TrustedCallerSecret        string                 `json:"trusted-caller-secret"`
+		AllowedIssuers             []string               `json:"allowed-issuers"`
+		AllowedClientKeyAlgorithms []string               `json:"allowed-client-key-algorithms"`
+		AllowedDomains             []string               `json:"allowed-domains"`
+		MinClientKeySizeRSA        int                    `json:"min-client-key-size-rsa"`
+		MaxClientKeyBytes          int                    `json:"max-client-key-bytes"`
+		AllowOmitPublicKey         bool                   `json:"allow-omit-public-key"`
+		ClampToSession             bool                   `json:"clamp-to-session"`
+		Headers                    map[string]interface{} `json:"headers"`
+		Crit                       []string               `json:"crit"`
+		Jku                        string                 `json:"jku"`
+		TimestampGranularity       int                    `json:"timestamp-granularity"`
+		IatFuzz                    *int                   `json:"iat-fuzz"`
+	} `json:"certificate"`
+	Tenants []struct {
+		ServerName string `json:"server-name"`
+		Issuer     string `json:"issuer"`
+		PrivateKey struct {
+			Type       string `json:"type"`
+			File       string `json:"file"`
+			Env        string `json:"env"`
+			Format     string `json:"format"`
+			Passphrase string `json:"passphrase"`
+		} `json:"private-key"`
+	} `json:"tenants"`
+	JwksUrl         string `json:"jwks-url"`
+	NonceUrl        string `json:"nonce-url"`
+	NonceSecret     string `json:"nonce-secret"`
+	HealthUrl       string `json:"health-url"`
+	SupportDocument struct {
+		Extended bool `json:"extended"`
+	} `json:"support-document"`
+	Dev   bool `json:"dev"`
+	Proxy struct {
+		Trusted []string `json:"trusted"`
+		Header  string   `json:"header"`
+	} `json:"proxy"`
+	Audit struct {
+		Enabled       bool   `json:"enabled"`
+		HashEmailsKey string `json:"hash-emails-key"`
+	} `json:"audit"`
+	AccessLog struct {
+		Enabled bool `json:"enabled"`
+	} `json:"access-log"`
+	RateLimit struct {
+		Enabled bool    `json:"enabled"`
+		Rate    float64 `json:"rate"`
+		Burst   int     `json:"burst"`
+		ByEmail bool    `json:"by-email"`
+	} `json:"rate-limit"`
+	Debug struct {
+		Enabled bool   `json:"enabled"`
+		Addr    string `json:"addr"`
+		Token   string `json:"token"`
+	} `json:"debug"`
+	HTTP struct {
+		ProblemJson        bool           `json:"problem-json"`
+		Compression        *bool          `json:"compression"`
+		CompressionLevels  map[string]int `json:"compression-levels"`
+		CompressionLevel   *int           `json:"compression-level"`
+		CompressionMinSize int            `json:"compression-min-size"`
+		Encodings          []string       `json:"encodings"`
+		StrictContentType  bool           `json:"strict-content-type"`
+		WWWAuthenticate    string         `json:"www-authenticate"`
+		Root               struct {
+			Enabled  bool   `json:"enabled"`
+			Redirect string `json:"redirect"`
+		} `json:"root"`
+		Favicon bool `json:"favicon"`
+	} `json:"http"`
 }
 
 // LoadConfig loads a Configuration from the provided file.
 func LoadConfig(filePath string) (config *Configuration, err error) {
-	file, err := os.Open(filePath)
-	if err != nil {
+	if config, err = decodeConfigFile(filePath); err != nil {
 		return
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	if err = decoder.Decode(&config); err != nil {
+
+	if err = ValidateConfig(config); err != nil {
 		return
 	}
 
-	if err = ValidateConfig(config); err != nil {
+	return
+}
+
+// decodeConfigFile decodes the configuration file at filePath, without
+// validating it.
+func decodeConfigFile(filePath string) (config *Configuration, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		err = diagnose("config", err)
 		return
 	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	err = diagnose("config", decoder.Decode(&config))
 
 	return
 }
@@ -111,144 +264,641 @@ func DecodeConfig(rawJson []byte) (config *Configuration, err error) {
 	return
 }
 
-// ValidateConfig validates that provided Configuration.
+// configValidator validates a single component of a Configuration.
+type configValidator struct {
+	component string
+	validate  func(*Configuration, *settings) error
+}
+
+// ValidateConfig validates that provided Configuration, and applies it once
+// it is valid. If it is invalid, the current settings are left unchanged.
 func ValidateConfig(config *Configuration) (err error) {
-	if err = validateDelegation(config); err != nil {
+	s, err := stageConfig(config)
+	if err != nil {
 		return
 	}
+
+	settingsMutex.Lock()
+	publishSettings(s)
+	settingsMutex.Unlock()
+
+	return
+}
+
+// stageConfig validates the provided Configuration, and returns the settings
+// derived from it without applying them. If it is invalid, anything opened for
+// it is closed again.
+func stageConfig(config *Configuration) (s *settings, err error) {
+	validators := []configValidator{
+		{"delegation", validateDelegation},
+		{"http", validateHTTP},
+		{"debug", validateDebug},
+		{"audit", validateAudit},
+		{"access-log", validateAccessLog},
+		{"proxy", validateProxy},
+	}
+	if !config.Delegation.Delegate {
+		validators = append(validators,
+			configValidator{"private-key", validatePrivateKey},
+			configValidator{"authentication", validateAuthentication},
+			configValidator{"provisioning", validateProvisioning},
+			configValidator{"session", validateSession},
+			configValidator{"certificate-url", validateCertificateUrl},
+			configValidator{"issuer", validateDefaultIssuer},
+			configValidator{"certificate", validateCertificate},
+			configValidator{"rate-limit", validateRateLimit},
+			configValidator{"jwks-url", validateJwksUrl},
+			configValidator{"batch-certificate-url", validateBatchCertificateUrl},
+			configValidator{"nonce-url", validateNonceUrl},
+			configValidator{"health-url", validateHealthUrl},
+			configValidator{"tenants", validateTenants},
+		)
+	}
+
+	staged := newSettings()
+	for _, validator := range validators {
+		if err = diagnose(validator.component, validator.validate(config, staged)); err != nil {
+			discardSettings(staged)
+			return
+		}
+	}
+	s = staged
+
+	return
+}
+
+func validateDelegation(config *Configuration, s *settings) (err error) {
 	if config.Delegation.Delegate {
-		return
+		if !isValidHost(config.Delegation.Host) {
+			err = fmt.Errorf(errInvalidDelegationHost, config.Delegation.Host)
+			return
+		}
+		if config.Delegation.Timeout < 0 || config.Delegation.Retries < 0 {
+			err = fmt.Errorf(errInvalidDelegationRetry)
+			return
+		}
+		if config.Delegation.Verify {
+			timeout := DefaultDelegateTimeout
+			if config.Delegation.Timeout > 0 {
+				timeout = time.Duration(config.Delegation.Timeout) * time.Second
+			}
+			err = verifyDelegate(config.Delegation.Host, timeout, config.Delegation.Retries)
+		}
 	}
 
-	if err = validatePrivateKey(config); err != nil {
-		return
+	return
+}
+
+// isValidHost returns whether the given host is a syntactically valid DNS
+// name, optionally followed by a port.
+func isValidHost(host string) bool {
+	if strings.Contains(host, ":") {
+		var port string
+		var err error
+		if host, port, err = net.SplitHostPort(host); err != nil {
+			return false
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return false
+		}
 	}
-	if err = validateAuthentication(config); err != nil {
-		return
+	domain, err := normalizeDomain(strings.TrimSuffix(host, "."))
+	return err == nil && len(domain) <= 253 && emailDomainLabels.MatchString(domain)
+}
+
+func validateHTTP(config *Configuration, s *settings) (err error) {
+	s.problemJsonErrors = config.HTTP.ProblemJson
+	s.strictContentType = config.HTTP.StrictContentType
+	s.wwwAuthenticate = config.HTTP.WWWAuthenticate
+	s.compressionDisabled = config.HTTP.Compression != nil && !*config.HTTP.Compression
+	s.rootRedirect = config.HTTP.Root.Redirect
+	levels := make(map[string]int, len(CompressionLevels)+len(config.HTTP.CompressionLevels))
+	for mediaType, level := range CompressionLevels {
+		levels[mediaType] = level
 	}
-	if err = validateProvisioning(config); err != nil {
-		return
+	for mediaType, level := range config.HTTP.CompressionLevels {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			err = fmt.Errorf(errInvalidCompressionLevel, level, mediaType)
+			return
+		}
+		levels[strings.ToLower(mediaType)] = level
 	}
-	if err = validateSession(config); err != nil {
-		return
+	s.compressionLevels = levels
+	if level := config.HTTP.CompressionLevel; level != nil {
+		if *level < flate.HuffmanOnly || *level > flate.BestCompression {
+			err = fmt.Errorf(errInvalidCompressionLevel, *level, "*")
+			return
+		}
+		s.compressionOptions.Level = level
 	}
-	if err = validateCertificateUrl(config); err != nil {
+	if config.HTTP.CompressionMinSize < 0 {
+		err = fmt.Errorf(errInvalidCompressionMinSize, config.HTTP.CompressionMinSize)
 		return
 	}
+	s.compressionOptions.MinSize = config.HTTP.CompressionMinSize
+	if config.HTTP.Encodings != nil {
+		encodings := []string{}
+		for _, encoding := range config.HTTP.Encodings {
+			encoding = strings.ToLower(encoding)
+			if !SupportedEncodings[encoding] {
+				err = fmt.Errorf(errUnsupportedEncoding, encoding)
+				return
+			}
+			encodings = append(encodings, encoding)
+		}
+		s.compressionEncodings = encodings
+	}
 
 	return
 }
 
-func validateDelegation(config *Configuration) (err error) {
-	if config.Delegation.Delegate {
-		// TODO: Better validation.
-		if len(config.Delegation.Host) == 0 {
-			err = fmt.Errorf(errInvalidDelegationHost, config.Delegation.Host)
-			return
-		}
+func validateDebug(config *Configuration, s *settings) (err error) {
+	if !config.Debug.Enabled {
+		return
+	}
+	if _, _, err = net.SplitHostPort(config.Debug.Addr); err != nil {
+		err = fmt.Errorf(errInvalidDebugAddr, config.Debug.Addr)
+		return
+	}
+	if len(config.Debug.Token) == 0 {
+		err = fmt.Errorf(errDebugTokenRequired)
+		return
 	}
 
 	return
 }
 
-func validatePrivateKey(config *Configuration) (err error) {
+func validatePrivateKey(config *Configuration, s *settings) (err error) {
 	config.PrivateKey.Type = strings.ToUpper(config.PrivateKey.Type)
 	if _, supported := SupportedPrivateKeyTypes[config.PrivateKey.Type]; !supported {
 		err = fmt.Errorf(errKeyTypeNotSupported, config.PrivateKey.Type)
 		return
 	}
-
-	keyFileContents, err := ioutil.ReadFile(config.PrivateKey.File)
-	if err != nil {
+	config.PrivateKey.Format = strings.ToLower(config.PrivateKey.Format)
+	if len(config.PrivateKey.Format) == 0 {
+		config.PrivateKey.Format = "auto"
+	}
+	config.PrivateKey.RSAScheme = strings.ToLower(config.PrivateKey.RSAScheme)
+	if len(config.PrivateKey.RSAScheme) == 0 {
+		config.PrivateKey.RSAScheme = "pkcs1v15"
+	}
+	if !RSASignatureSchemes[config.PrivateKey.RSAScheme] {
+		err = fmt.Errorf(errRSASchemeNotSupported, config.PrivateKey.RSAScheme)
 		return
 	}
-	pemBlock, _ := pem.Decode(keyFileContents)
-	if pemBlock == nil {
-		err = fmt.Errorf(errNoValidPemBlock, config.PrivateKey.File)
+	s.rsaSignaturePSS = config.PrivateKey.RSAScheme == "pss"
+	if config.PrivateKey.MaxRetired < 0 {
+		err = fmt.Errorf(errInvalidRetiredKeyLimit, config.PrivateKey.MaxRetired)
 		return
 	}
-	if x509.IsEncryptedPEMBlock(pemBlock) {
-		err = fmt.Errorf(errEncryptedKeysNotSupported)
+	if config.PrivateKey.RetiredMaxAge < 0 {
+		err = fmt.Errorf(errInvalidRetiredKeyLimit, config.PrivateKey.RetiredMaxAge)
 		return
 	}
+	s.maxRetiredKeys = config.PrivateKey.MaxRetired
+	s.retiredKeyMaxAge = time.Duration(config.PrivateKey.RetiredMaxAge) * time.Second
 
-	// First try to parse it as a PKCS#8 private key.
-	var privKey interface{}
-	privKey, err = x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	privKey, err := readPrivateKey(config.PrivateKey.Type, config.PrivateKey.File, config.PrivateKey.Env, config.PrivateKey.Format, config.PrivateKey.Passphrase)
+	if err != nil {
+		return
+	}
+	key, err := newPrivateKey(privKey)
 	if err != nil {
-		// Not a PKCS#8 private key. Try something else.
-		switch config.PrivateKey.Type {
-		case "ECDSA":
-			privKey, err = x509.ParseECPrivateKey(pemBlock.Bytes)
-		case "RSA":
-			privKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+		return
+	}
+	key.pss = s.rsaSignaturePSS
+
+	var notBefore, notAfter time.Time
+	if len(config.PrivateKey.NotBefore) > 0 {
+		if notBefore, err = time.Parse(time.RFC3339, config.PrivateKey.NotBefore); err != nil {
+			return
 		}
-		if err != nil {
+	}
+	if len(config.PrivateKey.NotAfter) > 0 {
+		if notAfter, err = time.Parse(time.RFC3339, config.PrivateKey.NotAfter); err != nil {
 			return
 		}
 	}
-	err = SetPrivateKey(privKey)
+	s.privateKey, err = key.withValidity(notBefore, notAfter)
 
 	return
 }
 
-func validateAuthentication(config *Configuration) (err error) {
-	// TODO: Better validation
-	if len(config.Authentication.Url) == 0 {
+// readPrivateKey reads a private key of the given type and format from either
+// file or the environment variable named by env, exactly one of which must be
+// given. HMAC keys are read as raw shared secrets, while all other keys are
+// read from a PEM block, which is decrypted with the passphrase if needed.
+func readPrivateKey(keyType, file, env, format, passphrase string) (privKey interface{}, err error) {
+	contents, source, err := readPrivateKeySource(file, env)
+	if err != nil {
+		return
+	}
+	if keyType == "HMAC" {
+		privKey = hmacKey(bytes.TrimSpace(contents))
+		return
+	}
+	if !privateKeyFormatSupports(format, keyType) {
+		err = fmt.Errorf(errKeyFormatNotSupported, format, keyType)
+		return
+	}
+
+	return parsePrivateKeyPEM(contents, source, keyType, format, []byte(passphrase))
+}
+
+// readPrivateKeySource returns the contents of either file or the environment
+// variable named by env, along with a description of where they came from
+// that is suitable for use in error messages.
+func readPrivateKeySource(file, env string) (contents []byte, source string, err error) {
+	if (len(file) == 0) == (len(env) == 0) {
+		err = fmt.Errorf(errPrivateKeySource)
+		return
+	}
+	if len(env) > 0 {
+		source = "$" + env
+		value := os.Getenv(env)
+		if len(strings.TrimSpace(value)) == 0 {
+			err = fmt.Errorf(errEmptyPrivateKeyEnv, env)
+			return
+		}
+		contents = []byte(value)
+		return
+	}
+
+	source = file
+	contents, err = ioutil.ReadFile(file)
+	return
+}
+
+// privateKeyFormatSupports returns whether the given private key format can
+// encode keys of the given type.
+func privateKeyFormatSupports(format, keyType string) bool {
+	for _, t := range SupportedPrivateKeyFormats[format] {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidUrlPath returns whether the given URL is an absolute path, with no
+// scheme, host, query string, or fragment, as required of the URLs that
+// handlers are registered at.
+func isValidUrlPath(rawurl string) bool {
+	if !strings.HasPrefix(rawurl, "/") || strings.ContainsAny(rawurl, "?#") {
+		return false
+	}
+	u, err := url.Parse(rawurl)
+	return err == nil && len(u.Scheme) == 0 && len(u.Host) == 0 && strings.HasPrefix(u.Path, "/")
+}
+
+func validateAuthentication(config *Configuration, s *settings) (err error) {
+	if !isValidUrlPath(config.Authentication.Url) {
 		err = fmt.Errorf(errInvalidAuthenticationUrl, config.Authentication.Url)
 		return
 	}
-	AuthenticationTemplateParams["URL"] = config.Authentication.Url
+	s.authenticationUrl = config.Authentication.Url
 	if !config.Authentication.Disabled {
-		AuthenticationTemplate, err = template.ParseFiles(config.Authentication.Template)
+		s.authenticationTemplate, err = configuredTemplate(config.Authentication.Template, AuthenticationTemplate)
 	}
 
 	return
 }
 
-func validateProvisioning(config *Configuration) (err error) {
-	// TODO: Better validation.
-	if len(config.Provisioning.Url) == 0 {
+func validateProvisioning(config *Configuration, s *settings) (err error) {
+	if !isValidUrlPath(config.Provisioning.Url) {
 		err = fmt.Errorf(errInvalidProvisioningUrl, config.Provisioning.Url)
 		return
 	}
-	ProvisioningTemplateParams["URL"] = config.Provisioning.Url
+	s.provisioningUrl = config.Provisioning.Url
 	if !config.Provisioning.Disabled {
-		ProvisioningTemplate, err = template.ParseFiles(config.Provisioning.Template)
+		s.provisioningTemplate, err = configuredTemplate(config.Provisioning.Template, ProvisioningTemplate)
 	}
 
 	return
 }
 
-func validateSession(config *Configuration) (err error) {
-	// TODO: Better validation.
-	if len(config.Session.Url) == 0 {
+// parseTemplateFile parses the given template file, making TemplateFuncs
+// available to it.
+func parseTemplateFile(file string) (*template.Template, error) {
+	return template.New(filepath.Base(file)).Funcs(TemplateFuncs).ParseFiles(file)
+}
+
+func validateSession(config *Configuration, s *settings) (err error) {
+	if !isValidUrlPath(config.Session.Url) {
 		err = fmt.Errorf(errInvalidSessionUrl, config.Session.Url)
 		return
 	}
 
+	if len(config.Session.StatusUrl) > 0 && !isValidUrlPath(config.Session.StatusUrl) {
+		err = fmt.Errorf(errInvalidSessionStatusUrl, config.Session.StatusUrl)
+		return
+	}
+
+	if len(config.Session.LogoutUrl) > 0 {
+		if !isValidUrlPath(config.Session.LogoutUrl) {
+			err = fmt.Errorf(errInvalidLogoutUrl, config.Session.LogoutUrl)
+			return
+		}
+		if len(config.Session.LogoutSecret) == 0 && len(config.Proxy.Trusted) == 0 {
+			err = fmt.Errorf(errLogoutSecretRequired)
+			return
+		}
+	}
+	s.logoutSecret = config.Session.LogoutSecret
+
+	if len(config.Session.CreateUrl) > 0 {
+		if !isValidUrlPath(config.Session.CreateUrl) {
+			err = fmt.Errorf(errInvalidCreateSessionUrl, config.Session.CreateUrl)
+			return
+		}
+		if len(config.Session.CreateSecret) == 0 {
+			err = fmt.Errorf(errCreateSessionSecretRequired)
+			return
+		}
+	}
+	s.createSessionSecret = config.Session.CreateSecret
+
+	if config.Session.MaxOpenConns < 0 || config.Session.MaxIdleConns < 0 || config.Session.ConnMaxLifetime < 0 {
+		err = fmt.Errorf(errInvalidConnPoolLimits)
+		return
+	}
+	if config.Session.MaxDuration < 0 {
+		err = fmt.Errorf(errInvalidSessionMaxDuration, config.Session.MaxDuration)
+		return
+	}
+	s.sessionMaxDuration = SessionMaxDuration
+	if config.Session.MaxDuration > 0 {
+		s.sessionMaxDuration = config.Session.MaxDuration
+	}
+	if config.Session.MaxPerEmail < 0 {
+		err = fmt.Errorf(errInvalidMaxPerEmail, config.Session.MaxPerEmail)
+		return
+	}
+	if config.Session.CleanupInterval < 0 {
+		err = fmt.Errorf(errInvalidCleanupInterval, config.Session.CleanupInterval)
+		return
+	}
+
 	if sessionBacking == nil {
+		var backing SessionBacking
 		switch config.Session.Store {
 		case "sqlite":
-			sessionBacking = &SQLiteBacking{}
-			if err = sessionBacking.Open(config.Session.Backing); err != nil {
-				return
+			backing = &SQLiteBacking{
+				MaxOpenConns:    config.Session.MaxOpenConns,
+				MaxIdleConns:    config.Session.MaxIdleConns,
+				ConnMaxLifetime: time.Duration(config.Session.ConnMaxLifetime) * time.Second,
+				MaxPerEmail:     config.Session.MaxPerEmail,
+				CleanupInterval: time.Duration(config.Session.CleanupInterval) * time.Second,
+			}
+		case "postgres":
+			backing = &PostgresBacking{
+				MaxOpenConns:    config.Session.MaxOpenConns,
+				MaxIdleConns:    config.Session.MaxIdleConns,
+				ConnMaxLifetime: time.Duration(config.Session.ConnMaxLifetime) * time.Second,
+				MaxPerEmail:     config.Session.MaxPerEmail,
 			}
+		case "mysql":
+			backing = &MySQLBacking{
+				MaxOpenConns:    config.Session.MaxOpenConns,
+				MaxIdleConns:    config.Session.MaxIdleConns,
+				ConnMaxLifetime: time.Duration(config.Session.ConnMaxLifetime) * time.Second,
+				MaxPerEmail:     config.Session.MaxPerEmail,
+			}
+		case "memory":
+			backing = &MemoryBacking{}
 		default:
 			err = fmt.Errorf(errUnsupportedSessionStore, config.Session.Store)
 			return
 		}
+
+		// The backing is only used once it has opened successfully, and the
+		// settings are published, so that a failed load can be retried.
+		if err = backing.Open(config.Session.Backing); err != nil {
+			return
+		}
+		s.sessionBacking = backing
 	}
 
 	return
 }
 
-func validateCertificateUrl(config *Configuration) (err error) {
-	// TODO: Better validation.
-	if len(config.CertificateUrl) == 0 {
+func validateCertificateUrl(config *Configuration, s *settings) (err error) {
+	if !isValidUrlPath(config.CertificateUrl) {
 		err = fmt.Errorf(errInvalidCertificateUrl, config.CertificateUrl)
 		return
 	}
 
 	return
 }
+
+func validateDefaultIssuer(config *Configuration, s *settings) (err error) {
+	issuer := config.Issuer
+	if !isValidHost(issuer) {
+		err = fmt.Errorf(errInvalidIssuer, issuer)
+		return
+	}
+	if err = validateIssuer(config, issuer); err != nil {
+		return
+	}
+	s.defaultIssuer = strings.ToLower(issuer)
+
+	return
+}
+
+func validateCertificate(config *Configuration, s *settings) (err error) {
+	s.trustedCallerSecret = config.Certificate.TrustedCallerSecret
+	s.allowOmitPublicKey = config.Certificate.AllowOmitPublicKey
+	s.clampToSession = config.Certificate.ClampToSession
+	s.allowedIssuers = make(map[string]bool)
+	for _, issuer := range config.Certificate.AllowedIssuers {
+		if err = validateIssuer(config, issuer); err != nil {
+			return
+		}
+		s.allowedIssuers[strings.ToLower(issuer)] = true
+	}
+
+	s.allowedClientKeyAlgorithms = make(map[string]bool)
+	for _, algorithm := range config.Certificate.AllowedClientKeyAlgorithms {
+		algorithm = strings.ToUpper(algorithm)
+		if !isKnownAlgorithm(algorithm) {
+			err = fmt.Errorf(errUnknownClientKeyAlgorithm, algorithm)
+			return
+		}
+		s.allowedClientKeyAlgorithms[algorithm] = true
+	}
+
+	s.allowedDomains = make(map[string]bool)
+	for _, domain := range config.Certificate.AllowedDomains {
+		normalized, normalizeErr := normalizeDomain(domain)
+		if normalizeErr != nil {
+			err = fmt.Errorf(errInvalidDomain, domain)
+			return
+		}
+		s.allowedDomains[normalized] = true
+	}
+	if config.Certificate.MinClientKeySizeRSA < 0 {
+		err = fmt.Errorf(errInvalidClientKeySize, config.Certificate.MinClientKeySizeRSA)
+		return
+	}
+	s.minClientKeySizeRSA = config.Certificate.MinClientKeySizeRSA
+	if config.Certificate.MaxClientKeyBytes < 0 {
+		err = fmt.Errorf(errInvalidClientKeyBytes, config.Certificate.MaxClientKeyBytes)
+		return
+	}
+	s.maxClientKeyBytes = DefaultMaxClientKeyBytes
+	if config.Certificate.MaxClientKeyBytes > 0 {
+		s.maxClientKeyBytes = config.Certificate.MaxClientKeyBytes
+	}
+
+	for param := range config.Certificate.Headers {
+		if RegisteredHeaders[param] {
+			err = fmt.Errorf(errRegisteredHeader, param)
+			return
+		}
+	}
+	s.extensionHeaders = config.Certificate.Headers
+	for _, param := range config.Certificate.Crit {
+		if RegisteredHeaders[param] {
+			err = fmt.Errorf(errRegisteredHeader, param)
+			return
+		}
+		if _, ok := config.Certificate.Headers[param]; !ok {
+			err = fmt.Errorf(errCriticalHeaderNotSet, param)
+			return
+		}
+	}
+	s.criticalHeaders = config.Certificate.Crit
+
+	if len(config.Certificate.Jku) > 0 {
+		jku, parseErr := url.Parse(config.Certificate.Jku)
+		if parseErr != nil || jku.Scheme != "https" || len(jku.Host) == 0 {
+			err = fmt.Errorf(errInvalidJku, config.Certificate.Jku)
+			return
+		}
+	}
+	s.jwkSetUrl = config.Certificate.Jku
+
+	if config.Certificate.TimestampGranularity < 0 {
+		err = fmt.Errorf(errInvalidTimestampGranularity, config.Certificate.TimestampGranularity)
+		return
+	}
+	s.timestampGranularity = time.Duration(config.Certificate.TimestampGranularity) * time.Second
+
+	s.idCertIatFuzz = idCertIatFuzzDuration * time.Second
+	if config.Certificate.IatFuzz != nil {
+		s.idCertIatFuzz = time.Duration(*config.Certificate.IatFuzz) * time.Second
+	}
+
+	return
+}
+
+// PlaceholderIssuers is a list of issuer domains that are only allowed in dev
+// mode, as they indicate an IdP that has not been configured properly.
+var PlaceholderIssuers = []string{
+	"example.com",
+	"example.net",
+	"example.org",
+	"localhost",
+}
+
+// validateIssuer validates that the issuer is non-empty and, unless dev mode
+// is enabled, is not a placeholder.
+func validateIssuer(config *Configuration, issuer string) (err error) {
+	if len(issuer) == 0 {
+		err = fmt.Errorf(errInvalidIssuer, issuer)
+		return
+	}
+	if config.Dev {
+		return
+	}
+
+	host := strings.ToLower(issuer)
+	if h, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		err = fmt.Errorf(errPlaceholderIssuer, issuer)
+		return
+	}
+	for _, placeholder := range PlaceholderIssuers {
+		if host == placeholder || strings.HasSuffix(host, "."+placeholder) {
+			err = fmt.Errorf(errPlaceholderIssuer, issuer)
+			return
+		}
+	}
+
+	return
+}
+
+// isKnownAlgorithm returns whether the given Persona algorithm identifier is
+// one that is known.
+func isKnownAlgorithm(algorithm string) bool {
+	for _, known := range PrivateKeyTypeToAlgorithm {
+		if known == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+func validateJwksUrl(config *Configuration, s *settings) (err error) {
+	// The JWKS URL is optional.
+	if len(config.JwksUrl) == 0 {
+		return
+	}
+	if !isValidUrlPath(config.JwksUrl) {
+		err = fmt.Errorf(errInvalidJwksUrl, config.JwksUrl)
+		return
+	}
+
+	return
+}
+
+func validateNonceUrl(config *Configuration, s *settings) (err error) {
+	// The nonce URL is optional, and nonces are only required when it is set.
+	s.requireNonce = len(config.NonceUrl) > 0
+	if !s.requireNonce {
+		return
+	}
+	if !isValidUrlPath(config.NonceUrl) {
+		err = fmt.Errorf(errInvalidNonceUrl, config.NonceUrl)
+		return
+	}
+
+	// Without a configured secret, nonces are only accepted by the process
+	// that issued them.
+	if len(config.NonceSecret) > 0 && len(config.NonceSecret)*8 < MinKeySizeHMAC {
+		err = fmt.Errorf(errNonceSecretTooSmall, len(config.NonceSecret)*8, MinKeySizeHMAC)
+		return
+	}
+	s.nonceKey, err = newNonceKey(config.NonceSecret, loadSettings().nonceKey)
+
+	return
+}
+
+func validateHealthUrl(config *Configuration, s *settings) (err error) {
+	// The health URL is optional.
+	if len(config.HealthUrl) == 0 {
+		return
+	}
+	if !isValidUrlPath(config.HealthUrl) {
+		err = fmt.Errorf(errInvalidHealthUrl, config.HealthUrl)
+		return
+	}
+
+	return
+}
+
+func validateBatchCertificateUrl(config *Configuration, s *settings) (err error) {
+	// The batch certificate URL is optional.
+	if len(config.BatchCertificateUrl) == 0 {
+		return
+	}
+	if !isValidUrlPath(config.BatchCertificateUrl) {
+		err = fmt.Errorf(errInvalidBatchCertificateUrl, config.BatchCertificateUrl)
+		return
+	}
+
+	return
+}
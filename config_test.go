@@ -0,0 +1,403 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateDebug(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		addr    string
+		token   string
+		valid   bool
+	}{
+		{false, "", "", true},
+		{true, "127.0.0.1:6060", "secret", true},
+		{true, "127.0.0.1", "secret", false},
+		{true, "127.0.0.1:6060", "", false},
+	}
+	for _, test := range tests {
+		var config Configuration
+		config.Debug.Enabled = test.enabled
+		config.Debug.Addr = test.addr
+		config.Debug.Token = test.token
+		if err := validateDebug(&config, newSettings()); (err == nil) != test.valid {
+			t.Errorf("validateDebug(%v, %q, %q) = %v, want valid %v", test.enabled, test.addr, test.token, err, test.valid)
+		}
+	}
+}
+
+func TestDefaultServeMuxHasNoDebugHandlers(t *testing.T) {
+	r := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		t.Errorf("http.DefaultServeMux serves %q", pattern)
+	}
+}
+
+func TestIsValidHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"Example.COM.", true},
+		{"login.example.com:8443", true},
+		{"bücher.example", true},
+		{"localhost", true},
+		{"", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa_mple.com", false},
+		{"example..com", false},
+		{"example.com:0", false},
+		{"example.com:65536", false},
+		{"example.com:", false},
+		{"https://example.com", false},
+	}
+	for _, test := range tests {
+		if valid := isValidHost(test.host); valid != test.valid {
+			t.Errorf("isValidHost(%q) = %v, want %v", test.host, valid, test.valid)
+		}
+	}
+}
+
+func TestValidateDefaultIssuer(t *testing.T) {
+	tests := []struct {
+		issuer string
+		dev    bool
+		valid  bool
+	}{
+		{"Login.Example.ORG", true, true},
+		{"idp.test", false, true},
+		{"example.com", false, false},
+		{"not a host", true, false},
+		{"", true, false},
+	}
+	s := newSettings()
+	for _, test := range tests {
+		var config Configuration
+		config.Issuer = test.issuer
+		config.Dev = test.dev
+		if err := validateDefaultIssuer(&config, s); (err == nil) != test.valid {
+			t.Errorf("validateDefaultIssuer(%q, dev %v) = %v, want valid %v", test.issuer, test.dev, err, test.valid)
+		}
+	}
+	if s.defaultIssuer != "idp.test" {
+		t.Errorf("defaultIssuer = %q, want %q", s.defaultIssuer, "idp.test")
+	}
+}
+
+func TestValidateUrlPaths(t *testing.T) {
+	validators := []struct {
+		name     string
+		validate func(*Configuration, *settings) error
+		set      func(*Configuration, string)
+		message  string
+	}{
+		{"authentication", validateAuthentication, func(c *Configuration, u string) { c.Authentication.Url = u }, errInvalidAuthenticationUrl},
+		{"provisioning", validateProvisioning, func(c *Configuration, u string) { c.Provisioning.Url = u }, errInvalidProvisioningUrl},
+		{"session", validateSession, func(c *Configuration, u string) { c.Session.Url = u }, errInvalidSessionUrl},
+		{"certificate", validateCertificateUrl, func(c *Configuration, u string) { c.CertificateUrl = u }, errInvalidCertificateUrl},
+		{"jwks", validateJwksUrl, func(c *Configuration, u string) { c.JwksUrl = u }, errInvalidJwksUrl},
+		{"nonce", validateNonceUrl, func(c *Configuration, u string) { c.NonceUrl = u }, errInvalidNonceUrl},
+		{"health", validateHealthUrl, func(c *Configuration, u string) { c.HealthUrl = u }, errInvalidHealthUrl},
+		{"batch certificate", validateBatchCertificateUrl, func(c *Configuration, u string) { c.BatchCertificateUrl = u }, errInvalidBatchCertificateUrl},
+	}
+	invalid := []string{
+		"missing-leading-slash",
+		"/path?query=1",
+		"/path#fragment",
+		"https://example.com/path",
+		"//example.com/path",
+	}
+	for _, v := range validators {
+		for _, rawurl := range invalid {
+			var config Configuration
+			v.set(&config, rawurl)
+			want := fmt.Sprintf(v.message, rawurl)
+			if err := v.validate(&config, newSettings()); err == nil || err.Error() != want {
+				t.Errorf("%s URL %q: err = %v, want %q", v.name, rawurl, err, want)
+			}
+		}
+	}
+
+	for _, rawurl := range []string{"/", "/persona/auth", "/a%20b"} {
+		if !isValidUrlPath(rawurl) {
+			t.Errorf("isValidUrlPath(%q) = false, want true", rawurl)
+		}
+	}
+}
+
+func TestValidateIssuer(t *testing.T) {
+	tests := []struct {
+		issuer string
+		dev    bool
+		valid  bool
+	}{
+		{"login.example.net", false, false},
+		{"Example.ORG.", false, false},
+		{"localhost:8080", false, false},
+		{"127.0.0.1", false, false},
+		{"localhost", true, true},
+		{"examples.com", false, true},
+		{"", true, false},
+	}
+	for _, test := range tests {
+		config := Configuration{Dev: test.dev}
+		if err := validateIssuer(&config, test.issuer); (err == nil) != test.valid {
+			t.Errorf("validateIssuer(%q, dev %v) = %v, want valid %v", test.issuer, test.dev, err, test.valid)
+		}
+	}
+
+	var config Configuration
+	config.Certificate.AllowedIssuers = []string{"idp.test", "localhost"}
+	if err := validateCertificate(&config, newSettings()); err == nil {
+		t.Error("validateCertificate allowed a placeholder issuer")
+	}
+}
+
+func TestValidateSessionLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(*Configuration)
+		want   string
+	}{
+		{"max open conns", func(c *Configuration) { c.Session.MaxOpenConns = -1 }, errInvalidConnPoolLimits},
+		{"max idle conns", func(c *Configuration) { c.Session.MaxIdleConns = -1 }, errInvalidConnPoolLimits},
+		{"conn max lifetime", func(c *Configuration) { c.Session.ConnMaxLifetime = -1 }, errInvalidConnPoolLimits},
+		{"max duration", func(c *Configuration) { c.Session.MaxDuration = -1 }, fmt.Sprintf(errInvalidSessionMaxDuration, -1)},
+		{"max per email", func(c *Configuration) { c.Session.MaxPerEmail = -1 }, fmt.Sprintf(errInvalidMaxPerEmail, -1)},
+	}
+	for _, test := range tests {
+		var config Configuration
+		config.Session.Url = "/session"
+		test.update(&config)
+		if err := validateSession(&config, newSettings()); err == nil || err.Error() != test.want {
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateCertificateClientKeyBytes(t *testing.T) {
+	var config Configuration
+	config.Certificate.MaxClientKeyBytes = 64
+	s := newSettings()
+	if err := validateCertificate(&config, s); err != nil {
+		t.Fatalf("validateCertificate: %v", err)
+	}
+
+	req := testCertificateRequest()
+	req.PublicKey = map[string]string{"algorithm": "RS", "n": strings.Repeat("1", 64), "e": "65537"}
+	err := validateClientKeyBytes(s, req)
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.Code != http.StatusBadRequest {
+		t.Errorf("validateClientKeyBytes with a large key = %v, want StatusBadRequest", err)
+	}
+	req.PublicKey = map[string]string{"algorithm": "RS", "n": "1", "e": "65537"}
+	if err := validateClientKeyBytes(s, req); err != nil {
+		t.Errorf("validateClientKeyBytes with a small key = %v", err)
+	}
+
+	config.Certificate.MaxClientKeyBytes = -1
+	if err := validateCertificate(&config, newSettings()); err == nil {
+		t.Error("validateCertificate allowed a negative maximum key size")
+	}
+}
+
+func TestValidateDelegation(t *testing.T) {
+	defer func(scheme string) { delegateScheme = scheme }(delegateScheme)
+	delegateScheme = "http"
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"authentication":"/auth","provisioning":"/prov"}`))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	if err := verifyDelegate(host, time.Second, 0); err == nil {
+		t.Error("verifyDelegate without retries succeeded after a failed fetch")
+	}
+	if err := verifyDelegate(host, time.Second, 1); err != nil {
+		t.Errorf("verifyDelegate with a retry = %v", err)
+	}
+
+	malformed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer malformed.Close()
+	atomic.StoreInt32(&requests, 0)
+	want := fmt.Sprintf(errDelegateMalformed, strings.TrimPrefix(malformed.URL, "http://"))
+	if err := verifyDelegate(strings.TrimPrefix(malformed.URL, "http://"), time.Second, 3); err == nil || err.Error() != want {
+		t.Errorf("verifyDelegate with a malformed document = %v, want %q", err, want)
+	}
+	if requests != 1 {
+		t.Errorf("malformed document was fetched %d times, want once", requests)
+	}
+
+	var config Configuration
+	config.Delegation.Delegate = true
+	config.Delegation.Host = "idp.test"
+	config.Delegation.Retries = -1
+	if err := validateDelegation(&config, newSettings()); err == nil || err.Error() != errInvalidDelegationRetry {
+		t.Errorf("validateDelegation = %v, want %q", err, errInvalidDelegationRetry)
+	}
+}
+
+func TestVerifyDelegateTimeout(t *testing.T) {
+	defer func(scheme string) { delegateScheme = scheme }(delegateScheme)
+	delegateScheme = "http"
+
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	stalledBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer stalledBody.Close()
+	defer close(release)
+
+	for _, server := range []*httptest.Server{stalled, stalledBody} {
+		host := strings.TrimPrefix(server.URL, "http://")
+		want := fmt.Sprintf(errDelegateTimeout, host)
+		if err := verifyDelegate(host, 100*time.Millisecond, 0); err == nil || err.Error() != want {
+			t.Errorf("verifyDelegate with a stalled delegate = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestVerifyDelegateUnresolved(t *testing.T) {
+	// The .invalid top-level domain is guaranteed never to resolve.
+	host := "persona.invalid"
+	want := fmt.Sprintf(errDelegateUnresolved, host, "")
+	if err := verifyDelegate(host, time.Second, 0); err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("verifyDelegate with an unresolvable host = %v, want %q", err, want)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	defer func(w io.Writer) { DiagnosticsWriter = w }(DiagnosticsWriter)
+	var buf bytes.Buffer
+	DiagnosticsWriter = &buf
+
+	diagnose("private-key", nil)
+	err := errors.New("no key.")
+	if diagnose("support-document", err) != err {
+		t.Error("diagnose did not return the error unchanged")
+	}
+
+	decoder := json.NewDecoder(&buf)
+	want := []Diagnostic{
+		{Component: "private-key", Status: DiagnosticOk},
+		{Component: "support-document", Status: DiagnosticFailed, Detail: "no key."},
+	}
+	for _, w := range want {
+		var got Diagnostic
+		if err := decoder.Decode(&got); err != nil {
+			t.Fatalf("decoding diagnostic: %v", err)
+		}
+		if got != w {
+			t.Errorf("diagnostic = %+v, want %+v", got, w)
+		}
+	}
+}
+
+func TestTenantForServerName(t *testing.T) {
+	pemBytes, err := generatePrivateKeyPEM("ECDSA")
+	if err != nil {
+		t.Fatalf("generatePrivateKeyPEM: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "tenant.pem")
+	if err := ioutil.WriteFile(file, pemBytes, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var config Configuration
+	config.Tenants = make([]struct {
+		ServerName string `json:"server-name"`
+		Issuer     string `json:"issuer"`
+		PrivateKey struct {
+			Type       string `json:"type"`
+			File       string `json:"file"`
+			Env        string `json:"env"`
+			Format     string `json:"format"`
+			Passphrase string `json:"passphrase"`
+		} `json:"private-key"`
+	}, 1)
+	// The certificate of TLS test servers is valid for example.com, which
+	// is only allowed as an issuer in dev mode.
+	config.Tenants[0].ServerName = "Example.COM"
+	config.Tenants[0].Issuer = "tenant.test"
+	config.Tenants[0].PrivateKey.Type = "ecdsa"
+	config.Tenants[0].PrivateKey.File = file
+	s := newSettings()
+	if err := validateTenants(&config, s); err != nil {
+		t.Fatalf("validateTenants: %v", err)
+	}
+	withSettingsUpdate(t, func(current *settings) { current.tenants = s.tenants })
+
+	p := testProvider(t)
+	tenant := s.tenants["example.com"]
+	issuers := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, issuer := p.signer(r)
+		if issuer == "tenant.test" && key != tenant.key {
+			t.Error("the tenant's issuer was selected without its key")
+		}
+		issuers <- issuer
+		p.BrowserID(w, r)
+	}))
+	server.StartTLS()
+	defer server.Close()
+
+	for _, serverName := range []string{"example.com", ""} {
+		client := server.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.ServerName = serverName
+		resp, err := client.Get(server.URL + SupportDocumentURL)
+		if err != nil {
+			t.Fatalf("GET with server name %q: %v", serverName, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The server name is only sent when a connection is made.
+		client.CloseIdleConnections()
+
+		issuer := <-issuers
+		isTenant := string(body) == string(tenant.supportDoc.json)
+		if serverName == "example.com" && (issuer != "tenant.test" || !isTenant) {
+			t.Errorf("with the tenant's server name, issuer = %q and support document = %s; want the tenant's", issuer, body)
+		}
+		if serverName == "" && (issuer == "tenant.test" || isTenant) {
+			t.Errorf("without a server name, issuer = %q and support document = %s; want the default", issuer, body)
+		}
+	}
+
+	config.Tenants = append(config.Tenants, config.Tenants[0])
+	if err := validateTenants(&config, newSettings()); err == nil {
+		t.Error("validateTenants allowed a duplicate server name")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// CSRFCookieName is the name of the cookie that carries the CSRF token passed
+// to the authentication and provisioning templates as CSRFToken.
+const CSRFCookieName = "persona_csrf"
+
+// csrfTokenBytes is the number of random bytes in each CSRF token.
+const csrfTokenBytes = 32
+
+// csrfToken returns the CSRF token of the browser that made the request. If
+// the request does not carry a well-formed token, a new one is generated and
+// set as a cookie on the response, so that the token lasts for the browser
+// session.
+func csrfToken(w http.ResponseWriter, r *http.Request) (token string, err error) {
+	if cookie, cookieErr := r.Cookie(CSRFCookieName); cookieErr == nil && validCSRFTokenFormat(cookie.Value) {
+		token = cookie.Value
+		return
+	}
+
+	random := make([]byte, csrfTokenBytes)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(random)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return
+}
+
+// validCSRFTokenFormat returns whether the token could have been generated by
+// csrfToken.
+func validCSRFTokenFormat(token string) bool {
+	random, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(random) == csrfTokenBytes
+}
+
+// ValidCSRFToken returns whether the given token, such as one submitted by a
+// form on the authentication page, matches the CSRF token cookie of the
+// request.
+func ValidCSRFToken(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || !validCSRFTokenFormat(cookie.Value) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
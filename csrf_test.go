@@ -0,0 +1,69 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticationCSRFToken(t *testing.T) {
+	defer delete(AuthenticationTemplateParams, "CSRFToken")
+	SetAuthenticationTemplateParam("CSRFToken", "static")
+
+	tmpl := template.Must(template.New("auth").Parse(`{{.CSRFToken}}`))
+	p := &Provider{AuthenticationTemplate: tmpl}
+
+	w := httptest.NewRecorder()
+	p.Authentication(w, httptest.NewRequest("GET", "/auth", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cacheControl)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookieName {
+		t.Fatalf("cookies = %v, want a %s cookie", cookies, CSRFCookieName)
+	}
+	token := w.Body.String()
+	if token != cookies[0].Value {
+		t.Errorf("page token %q does not match the cookie %q", token, cookies[0].Value)
+	}
+
+	// The token is kept for the browser session.
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	p.Authentication(w, r)
+	if w.Body.String() != token {
+		t.Errorf("second page token = %q, want %q", w.Body.String(), token)
+	}
+	if len(w.Result().Cookies()) > 0 {
+		t.Error("the CSRF cookie was replaced")
+	}
+
+	if !ValidCSRFToken(r, token) {
+		t.Error("the page token was not valid")
+	}
+	if ValidCSRFToken(r, "static") || ValidCSRFToken(httptest.NewRequest("POST", "/", nil), token) {
+		t.Error("a token that does not match the cookie was valid")
+	}
+}
+
+func TestCSRFTokenReplacesMalformedCookie(t *testing.T) {
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: "chosen-by-attacker"})
+	w := httptest.NewRecorder()
+	token, err := csrfToken(w, r)
+	if err != nil {
+		t.Fatalf("csrfToken: %v", err)
+	}
+	if token == "chosen-by-attacker" || len(w.Result().Cookies()) != 1 {
+		t.Errorf("malformed CSRF cookie was kept as token %q", token)
+	}
+}
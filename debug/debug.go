@@ -0,0 +1,65 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package debug serves the net/http/pprof endpoints for a Persona IdP on a
+// listener of their own.
+//
+// It is kept apart from the persona package because importing net/http/pprof
+// registers its handlers with http.DefaultServeMux. Only programs that import
+// this package have the profiling endpoints registered there, and they must
+// therefore not serve http.DefaultServeMux on a public listener.
+package debug
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/timewasted/go-persona"
+)
+
+// Handler returns a handler that exposes the net/http/pprof endpoints under
+// /debug/pprof/. Every request must carry the given token as a bearer token,
+// and if the token is empty, every request is refused.
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(token) == 0 || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// StartServer starts serving Handler on the debug address from the given
+// configuration. If the debug server is not enabled, it does nothing and
+// returns a nil server.
+func StartServer(config *persona.Configuration) (server *http.Server, err error) {
+	if !config.Debug.Enabled {
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.Debug.Addr)
+	if err != nil {
+		return
+	}
+	server = &http.Server{
+		Handler: Handler(config.Debug.Token),
+	}
+	go server.Serve(listener)
+
+	return
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/timewasted/go-persona"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		token  string
+		auth   string
+		status int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/debug/pprof/", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		Handler(test.token).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("token %q, Authorization %q: status = %d, want %d", test.token, test.auth, w.Code, test.status)
+		}
+	}
+}
+
+func TestStartServer(t *testing.T) {
+	var config persona.Configuration
+	server, err := StartServer(&config)
+	if err != nil || server != nil {
+		t.Fatalf("StartServer when disabled = %v, %v; want nil, nil", server, err)
+	}
+
+	config.Debug.Enabled = true
+	config.Debug.Addr = "127.0.0.1:0"
+	config.Debug.Token = "secret"
+	server, err = StartServer(&config)
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	if server == nil {
+		t.Fatal("StartServer when enabled returned no server")
+	}
+	server.Close()
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultDelegateTimeout is the default time limit for fetching the support
+// document of the delegate.
+const DefaultDelegateTimeout = 10 * time.Second
+
+// delegateRetryBackoff is the delay before the first retry of a failed fetch.
+// The delay doubles after each subsequent attempt.
+const delegateRetryBackoff = 500 * time.Millisecond
+
+// maxDelegateSupportDocumentSize is the maximum size, in bytes, of the support
+// document served by the delegate.
+const maxDelegateSupportDocumentSize = 64 * 1024
+
+// Error messages.
+const (
+	errDelegateFetchFailed = "failed to fetch the support document of delegate '%s': %s"
+	errDelegateMalformed   = "delegate '%s' served a malformed support document."
+	errDelegateStatus      = "delegate '%s' responded with status %d."
+	errDelegateTimeout     = "timed out fetching the support document of delegate '%s'."
+	errDelegateUnresolved  = "failed to resolve delegate '%s': %s"
+)
+
+// delegateScheme is the scheme used to fetch the support document of the
+// delegate.
+var delegateScheme = "https"
+
+// malformedDelegateError is returned for support documents that are malformed,
+// which retrying will not fix.
+type malformedDelegateError struct {
+	host string
+}
+
+func (e *malformedDelegateError) Error() string {
+	return fmt.Sprintf(errDelegateMalformed, e.host)
+}
+
+// verifyDelegate fetches the support document of the delegate, retrying failed
+// fetches the given number of times, and confirms that it is a usable,
+// non-delegating support document.
+func verifyDelegate(host string, timeout time.Duration, retries int) (err error) {
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	backoff := delegateRetryBackoff
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = fetchDelegateSupportDocument(client, host); err == nil {
+			return
+		}
+		if _, malformed := err.(*malformedDelegateError); malformed {
+			return
+		}
+	}
+
+	return
+}
+
+// fetchDelegateSupportDocument fetches and checks the support document of the
+// delegate once, distinguishing between timeouts, resolution failures, and
+// malformed documents.
+func fetchDelegateSupportDocument(client *http.Client, host string) error {
+	resp, err := client.Get(delegateScheme + "://" + host + SupportDocumentURL)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf(errDelegateTimeout, host)
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return fmt.Errorf(errDelegateUnresolved, host, dnsErr)
+		}
+		return fmt.Errorf(errDelegateFetchFailed, host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf(errDelegateStatus, host, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxDelegateSupportDocumentSize))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf(errDelegateTimeout, host)
+		}
+		return &malformedDelegateError{host}
+	}
+	var document struct {
+		Authentication string `json:"authentication"`
+		Provisioning   string `json:"provisioning"`
+	}
+	if err = json.Unmarshal(body, &document); err != nil ||
+		len(document.Authentication) == 0 ||
+		len(document.Provisioning) == 0 {
+		return &malformedDelegateError{host}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Diagnostic statuses.
+const (
+	DiagnosticFailed = "failed"
+	DiagnosticOk     = "ok"
+)
+
+// Diagnostic is a machine readable report of the outcome of a startup step.
+type Diagnostic struct {
+	Component string `json:"component"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// DiagnosticsWriter, if set, receives a JSON encoded Diagnostic, one per line,
+// for each component that is loaded or validated during startup.
+var DiagnosticsWriter io.Writer
+
+// diagnose writes a Diagnostic for the given component and error to the
+// DiagnosticsWriter, if one is set, and returns the error unchanged.
+func diagnose(component string, err error) error {
+	if DiagnosticsWriter == nil {
+		return err
+	}
+
+	diagnostic := Diagnostic{
+		Component: component,
+		Status:    DiagnosticOk,
+	}
+	if err != nil {
+		diagnostic.Status = DiagnosticFailed
+		diagnostic.Detail = err.Error()
+	}
+	json.NewEncoder(DiagnosticsWriter).Encode(diagnostic)
+
+	return err
+}
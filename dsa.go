@@ -0,0 +1,111 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/dsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// Error messages.
+const (
+	errNotDSAPrivateKey = "not a DSA private key."
+)
+
+// oidPublicKeyDSA is the object identifier of DSA public keys.
+var oidPublicKeyDSA = asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1}
+
+// opensslDSAPrivateKey is the ASN.1 structure of the DSA private keys written
+// by "openssl dsa", in PEM blocks of type "DSA PRIVATE KEY".
+type opensslDSAPrivateKey struct {
+	Version int
+	P       *big.Int
+	Q       *big.Int
+	G       *big.Int
+	Y       *big.Int
+	X       *big.Int
+}
+
+// pkcs8DSAPrivateKey is the ASN.1 structure of a PKCS#8 private key.
+type pkcs8DSAPrivateKey struct {
+	Version    int
+	Algorithm  pkcs8Algorithm
+	PrivateKey []byte
+}
+
+// pkcs8Algorithm is the ASN.1 structure of the algorithm identifier of a
+// PKCS#8 DSA private key.
+type pkcs8Algorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters dsa.Parameters
+}
+
+// ParseDSAPrivateKey parses a DSA private key in the form written by
+// "openssl dsa".
+func ParseDSAPrivateKey(der []byte) (*dsa.PrivateKey, error) {
+	var k opensslDSAPrivateKey
+	rest, err := asn1.Unmarshal(der, &k)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || k.Version != 0 {
+		return nil, errors.New(errNotDSAPrivateKey)
+	}
+
+	return &dsa.PrivateKey{
+		PublicKey: dsa.PublicKey{
+			Parameters: dsa.Parameters{
+				P: k.P,
+				Q: k.Q,
+				G: k.G,
+			},
+			Y: k.Y,
+		},
+		X: k.X,
+	}, nil
+}
+
+// MarshalDSAPrivateKey returns the given DSA private key in the form written
+// by "openssl dsa".
+func MarshalDSAPrivateKey(key *dsa.PrivateKey) ([]byte, error) {
+	return asn1.Marshal(opensslDSAPrivateKey{
+		P: key.P,
+		Q: key.Q,
+		G: key.G,
+		Y: key.Y,
+		X: key.X,
+	})
+}
+
+// ParsePKCS8DSAPrivateKey parses a DSA private key from a PKCS#8 block, which
+// x509.ParsePKCS8PrivateKey does not support.
+func ParsePKCS8DSAPrivateKey(der []byte) (*dsa.PrivateKey, error) {
+	var k pkcs8DSAPrivateKey
+	rest, err := asn1.Unmarshal(der, &k)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || !k.Algorithm.Algorithm.Equal(oidPublicKeyDSA) {
+		return nil, errors.New(errNotDSAPrivateKey)
+	}
+	x := new(big.Int)
+	if rest, err = asn1.Unmarshal(k.PrivateKey, &x); err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New(errNotDSAPrivateKey)
+	}
+
+	params := k.Algorithm.Parameters
+	return &dsa.PrivateKey{
+		PublicKey: dsa.PublicKey{
+			Parameters: params,
+			Y:          new(big.Int).Exp(params.G, x, params.P),
+		},
+		X: x,
+	}, nil
+}
@@ -9,11 +9,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// unixAddrPrefix is the prefix of server addresses that refer to a Unix domain
+// socket rather than a TCP address.
+const unixAddrPrefix = "unix:"
+
+// defaultUnixSocketMode is the permissions that Unix domain sockets are
+// created with, unless the server configuration specifies otherwise.
+const defaultUnixSocketMode = "0660"
+
 type configuration struct {
 	Servers []struct {
 		Addr     string `json:"addr"`
+		Mode     string `json:"mode"`
 		KeyPairs []struct {
 			Cert string `json:"cert"`
 			Key  string `json:"key"`
@@ -52,6 +63,20 @@ func validateConfig(config *configuration) (err error) {
 			return fmt.Errorf("server address '%s' is invalid.", server.Addr)
 		}
 
+		// Unix domain sockets serve plain HTTP, so need no key pairs.
+		if strings.HasPrefix(server.Addr, unixAddrPrefix) {
+			if len(server.Addr) == len(unixAddrPrefix) {
+				return fmt.Errorf("server address '%s' is invalid.", server.Addr)
+			}
+			if len(server.Mode) == 0 {
+				config.Servers[serverIndex].Mode = defaultUnixSocketMode
+			}
+			if _, err = strconv.ParseUint(config.Servers[serverIndex].Mode, 8, 32); err != nil {
+				return fmt.Errorf("socket mode '%s' is invalid.", server.Mode)
+			}
+			continue
+		}
+
 		// Validate KeyPairs.
 		if len(server.KeyPairs) == 0 {
 			return fmt.Errorf("server '%s' must have at least one key pair defined.", server.Addr)
@@ -73,3 +98,12 @@ func validateConfig(config *configuration) (err error) {
 
 	return
 }
+
+// unixSocketPath returns the path of the Unix domain socket referred to by
+// the given server address, and whether the address refers to one at all.
+func unixSocketPath(addr string) (path string, ok bool) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddrPrefix), true
+}
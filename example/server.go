@@ -5,13 +5,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/timewasted/go-persona"
+	"github.com/timewasted/go-persona/debug"
 	"github.com/timewasted/go-server"
 )
 
@@ -20,59 +27,125 @@ var (
 	serverConfigPath  = flag.String("server-config", "./server-config.json", "Path to the web server configuration file.")
 )
 
+// shutdownTimeout is how long in-flight requests are given to complete when
+// the server is shutting down.
+const shutdownTimeout = 30 * time.Second
+
 var signalChan = make(chan os.Signal, 1)
+var reloadChan = make(chan os.Signal, 1)
 var webServer *server.Server
 
 func init() {
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 }
 
 func main() {
-	var err error
+	if err := run(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Exiting.")
+}
 
+// run starts the servers, and serves until a signal to exit is received.
+// Errors are returned rather than being fatal, so that deferred cleanup, such
+// as closing and removing Unix domain sockets, still happens.
+func run() (err error) {
 	personaConfig, err := persona.LoadConfig(*personaConfigPath)
 	if err != nil {
-		log.Fatalln("Failed to load the Persona configuration:", err)
+		return fmt.Errorf("Failed to load the Persona configuration: %s", err)
 	}
-	defer persona.CloseSessionBacking()
 	_, err = persona.GenerateSupportDocument(personaConfig)
 	if err != nil {
-		log.Fatalln("Failed to generate support document:", err)
+		return fmt.Errorf("Failed to generate support document: %s", err)
 	}
 
 	serverConfig, err := loadConfig(*serverConfigPath)
 	if err != nil {
-		log.Fatalln("Failed to load the server configuration:", err)
+		return fmt.Errorf("Failed to load the server configuration: %s", err)
+	}
+
+	if _, err = debug.StartServer(personaConfig); err != nil {
+		return fmt.Errorf("Failed to start the debug server: %s", err)
 	}
 
 	webServer = server.New()
+	unixMux := http.NewServeMux()
+	var unixListeners []net.Listener
 	for serverIndex, server := range serverConfig.Servers {
+		if path, ok := unixSocketPath(server.Addr); ok {
+			listener, err := listenUnix(path, server.Mode)
+			if err != nil {
+				return fmt.Errorf("Failed to create listener for address '%s': %s", server.Addr, err)
+			}
+			defer listener.Close()
+			unixListeners = append(unixListeners, listener)
+			continue
+		}
 		if err = webServer.Listen(server.Addr); err != nil {
-			log.Fatalf("Failed to create listener for address '%s': %s\n", server.Addr, err)
+			return fmt.Errorf("Failed to create listener for address '%s': %s", server.Addr, err)
 		}
 		for keyIndex, keyPair := range server.KeyPairs {
 			if err = webServer.AddTLSCertificate([]byte(keyPair.Cert), []byte(keyPair.Key)); err != nil {
-				log.Fatalf("Failed to add TLS certificate %d to '%s': %s\n", keyIndex, server.Addr, err)
+				return fmt.Errorf("Failed to add TLS certificate %d to '%s': %s", keyIndex, server.Addr, err)
 			}
 			serverConfig.Servers[serverIndex].KeyPairs[keyIndex].Cert = ""
 			serverConfig.Servers[serverIndex].KeyPairs[keyIndex].Key = ""
 		}
 	}
 
-	webServer.HandleFunc(persona.SupportDocumentURL, persona.CompressResponse(persona.BrowserID))
-	if !personaConfig.Authentication.Disabled {
-		webServer.HandleFunc(personaConfig.Authentication.Url, persona.CompressResponse(persona.Authentication))
-	}
-	if !personaConfig.Provisioning.Disabled {
-		webServer.HandleFunc(personaConfig.Provisioning.Url, persona.CompressResponse(persona.Provisioning))
-	}
-	webServer.HandleFunc(personaConfig.Session.Url, persona.CheckSession)
-	webServer.HandleFunc(personaConfig.CertificateUrl, persona.GenerateCertificate)
+	persona.RegisterHandlers(webServer, personaConfig)
 	webServer.Serve()
+	if len(unixListeners) > 0 {
+		persona.RegisterHandlers(unixMux, personaConfig)
+		for _, listener := range unixListeners {
+			go http.Serve(listener, unixMux)
+		}
+	}
 
 	for {
-		<-signalChan
+		select {
+		case <-reloadChan:
+			if err = persona.ReloadConfig(*personaConfigPath); err != nil {
+				log.Println("Failed to reload the Persona configuration:", err)
+				continue
+			}
+			log.Println("Reloaded the Persona configuration.")
+			continue
+		case <-signalChan:
+		}
 		break
 	}
-	log.Println("Exiting.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = persona.Shutdown(ctx); err != nil {
+		log.Println("Failed to shut down cleanly:", err)
+	}
+
+	return nil
+}
+
+// listenUnix listens on a Unix domain socket at the given path, created with
+// the given octal permissions. A stale socket left at the path is removed
+// first. The socket is removed again when the listener is closed.
+func listenUnix(path, mode string) (listener net.Listener, err error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return
+	}
+	if info, statErr := os.Stat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+
+	if listener, err = net.Listen("unix", path); err != nil {
+		return
+	}
+	if err = os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		listener = nil
+	}
+	return
 }
@@ -0,0 +1,77 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persona.sock")
+	path, ok := unixSocketPath(unixAddrPrefix + path)
+	if !ok {
+		t.Fatal("unix: address was not recognized")
+	}
+
+	// A stale socket left behind by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, "0600")
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	go http.Serve(listener, mux)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://persona/")
+	if err != nil {
+		t.Fatalf("GET over the socket: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("response = %d %q, want 200 \"ok\"", resp.StatusCode, body)
+	}
+
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after the listener was closed: %v", err)
+	}
+}
+
+func TestListenUnixInvalidMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persona.sock")
+	if _, err := listenUnix(path, "rw"); err == nil {
+		t.Error("listenUnix with an invalid mode succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket was created despite the invalid mode: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error messages.
+const (
+	errHealthBackingUnreachable = "session backing is unreachable: %s"
+)
+
+// HealthCheckTimeout is how long Health waits for the session backing to
+// respond before reporting it as unreachable.
+var HealthCheckTimeout = 2 * time.Second
+
+// SessionBackingPinger is implemented by session backings that can cheaply
+// check that they are still usable, such as by pinging their database.
+type SessionBackingPinger interface {
+	SessionBacking
+	Ping(context.Context) error
+}
+
+// Health responds with the health of the default provider.
+func Health(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.Health(w, r)
+}
+
+// Health responds with StatusOK (200) if the private key is loaded and the
+// session backing is reachable, or with StatusServiceUnavailable (503) and a
+// short diagnostic if not. Backings that do not implement
+// SessionBackingPinger are assumed to be reachable once set.
+func (p *Provider) Health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	// Health checks must never be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	if p.signingKey(settingsFor(r)) == nil {
+		httpError(w, errPrivateKeyUndefined, http.StatusServiceUnavailable)
+		return
+	}
+	backing := p.sessions()
+	if backing == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusServiceUnavailable)
+		return
+	}
+	if pinger, ok := backing.(SessionBackingPinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+		defer cancel()
+		if err := pinger.Ping(ctx); err != nil {
+			httpError(w, fmt.Sprintf(errHealthBackingUnreachable, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", ContentTypePlain)
+	writeBody(w, r, []byte("ok\n"))
+}
@@ -5,67 +5,590 @@
 package persona
 
 import (
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
 
+	"github.com/andybalholm/brotli"
 	"github.com/timewasted/go-accept-headers"
 )
 
+// Error messages.
 const (
-	ContentTypeHtml  = "text/html; charset=utf-8"
-	ContentTypeJson  = "application/json; charset=utf-8"
-	ContentTypePlain = "text/plain; charset=utf-8"
+	errEmptyRequestBody     = "request body is empty."
+	errMalformedRequestBody = "request body is malformed: %s"
 )
 
+const (
+	ContentTypeHtml        = "text/html; charset=utf-8"
+	ContentTypeJoseJson    = "application/jose+json"
+	ContentTypeJson        = "application/json; charset=utf-8"
+	ContentTypePlain       = "text/plain; charset=utf-8"
+	ContentTypeProblemJson = "application/problem+json; charset=utf-8"
+)
+
+// HTTPError is an error that should be reported to the client with a specific
+// HTTP status code.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// ProblemDocument is an RFC 7807 problem details document.
+type ProblemDocument struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checkContentType returns an HTTPError if strict Content-Type checking is
+// enabled and the request body is not JSON.
+func checkContentType(r *http.Request) error {
+	if !settingsFor(r).strictContentType {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &HTTPError{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: http.StatusText(http.StatusUnsupportedMediaType),
+		}
+	}
+	return nil
+}
+
+// unmarshalRequest decodes the JSON request body into v, returning an
+// HTTPError if the body is empty or malformed.
+func unmarshalRequest(body []byte, v interface{}) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: errEmptyRequestBody,
+		}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errMalformedRequestBody, err),
+		}
+	}
+	return nil
+}
+
+// multipartFormMaxMemory is the maximum number of bytes of a multipart form
+// that are held in memory while it is parsed.
+const multipartFormMaxMemory = 1 << 20
+
+// maxRequestBodyBytes is the maximum size of the request bodies that are read
+// in full before they are decoded, or decoded as a stream.
+const maxRequestBodyBytes = 1 << 20
+
+// limitRequestBody limits the body of the request to maxRequestBodyBytes,
+// beyond which reading it fails with an error that readError reports as
+// StatusRequestEntityTooLarge (413).
+func limitRequestBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+}
+
+// readError returns the error that occurred while reading a request body as
+// an HTTPError, if it was caused by the body being too large.
+func readError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &HTTPError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: http.StatusText(http.StatusRequestEntityTooLarge),
+		}
+	}
+	return err
+}
+
+// formJsonFields lists the form fields whose values are JSON, rather than
+// strings, in the equivalent JSON request body.
+var formJsonFields = map[string]bool{
+	"public-key":      true,
+	"omit-public-key": true,
+}
+
+// readRequest reads the request body into v. JSON bodies are decoded
+// directly, while application/x-www-form-urlencoded and multipart/form-data
+// bodies are decoded as if each form field were a member of a JSON object. A
+// missing Content-Type is treated as JSON, unless strict Content-Type
+// checking is enabled. Any other Content-Type results in an HTTPError with
+// StatusUnsupportedMediaType (415).
+func readRequest(r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case len(r.Header.Get("Content-Type")) == 0 && !settingsFor(r).strictContentType:
+	case err != nil:
+		return &HTTPError{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: http.StatusText(http.StatusUnsupportedMediaType),
+		}
+	case mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data":
+		return unmarshalForm(r, mediaType, v)
+	case mediaType != "application/json":
+		return &HTTPError{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: http.StatusText(http.StatusUnsupportedMediaType),
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return unmarshalRequest(body, v)
+}
+
+// unmarshalForm decodes the form encoded request body into v, returning an
+// HTTPError if the body is empty or malformed.
+func unmarshalForm(r *http.Request, mediaType string, v interface{}) error {
+	var err error
+	if mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(multipartFormMaxMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errMalformedRequestBody, err),
+		}
+	}
+
+	fields := make(map[string]interface{})
+	for name := range r.PostForm {
+		value := r.PostForm.Get(name)
+		if formJsonFields[name] {
+			fields[name] = json.RawMessage(value)
+		} else {
+			fields[name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: errEmptyRequestBody,
+		}
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errMalformedRequestBody, err),
+		}
+	}
+	return unmarshalRequest(body, v)
+}
+
+// acceptsMediaType returns whether the request's Accept header explicitly
+// lists the given media type with a non-zero quality.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		acceptedType, params, err := mime.ParseMediaType(accepted)
+		if err != nil || acceptedType != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// writeBody responds with StatusOK (200) and the given body, setting
+// Content-Length. HEAD requests get the same headers as GET, but no body.
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Write(body)
+}
+
+// etagMatches returns whether the given If-None-Match header value matches
+// etag. As required for If-None-Match, weak comparison is used.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// methodNotAllowed responds with StatusMethodNotAllowed (405), listing the
+// allowed methods in the Allow header.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	httpError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// unauthorized responds with StatusUnauthorized (401), including the
+// configured WWW-Authenticate challenge.
+func unauthorized(w http.ResponseWriter, message string) {
+	if challenge := loadSettings().wwwAuthenticate; len(challenge) > 0 {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	httpError(w, message, http.StatusUnauthorized)
+}
+
+// writeError responds with the given error. If the error is an HTTPError, its
+// status code is used, otherwise StatusInternalServerError (500) is used.
+func writeError(w http.ResponseWriter, err error) {
+	if httpErr, ok := err.(*HTTPError); ok {
+		if httpErr.Code == http.StatusUnauthorized {
+			unauthorized(w, httpErr.Message)
+			return
+		}
+		httpError(w, httpErr.Message, httpErr.Code)
+		return
+	}
+	httpError(w, err.Error(), http.StatusInternalServerError)
+}
+
+// httpError is a drop-in replacement for http.Error that honors the
+// configured error format.
+func httpError(w http.ResponseWriter, message string, code int) {
+	if !loadSettings().problemJsonErrors {
+		http.Error(w, message, code)
+		return
+	}
+
+	problem, err := json.Marshal(ProblemDocument{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: message,
+	})
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeProblemJson)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(problem)
+}
+
+// CompressionLevels is a media type-to-level mapping of the default
+// compression level used for compressed responses. Media types not listed here
+// are compressed using DefaultCompression. The compression levels from the
+// configuration are applied on top of these each time it is loaded, so any
+// changes must be made before then.
+var CompressionLevels = map[string]int{
+	"text/html":        flate.BestCompression,
+	"application/json": flate.BestSpeed,
+}
+
+// SupportedEncodings is a list of the content encodings that responses can be
+// compressed with.
+var SupportedEncodings = map[string]bool{
+	"br":      true,
+	"deflate": true,
+	"gzip":    true,
+}
+
+// defaultCompressionEncodings is the list of content encodings offered to
+// clients, in order of preference, unless others are configured. Every entry
+// must be in SupportedEncodings.
+var defaultCompressionEncodings = []string{"br", "gzip", "deflate"}
+
+// CompressOptions controls how CompressResponseWithOptions compresses
+// responses.
+type CompressOptions struct {
+	// Level, if not nil, is the compression level used for every response,
+	// instead of the level for the response's content type.
+	Level *int
+	// MinSize is the size, in bytes, below which responses are written
+	// uncompressed. Responses are buffered until this many bytes have been
+	// written, unless their Content-Length is already known.
+	MinSize int
+}
+
+// CompressedResponseWriter compresses the response written through it with
+// its Encoding. If Compressor is set when it is created, that compressor is
+// used for the whole response. Otherwise, a compressor is created once the
+// response headers are known, so that the compression level can be chosen
+// based on the response's content type.
 type CompressedResponseWriter struct {
 	http.ResponseWriter
 	Compressor io.WriteCloser
 	Encoding   string
+	Options    CompressOptions
+	state      *compressionState
 }
 
-func (crw CompressedResponseWriter) Write(b []byte) (int, error) {
-	ce := crw.ResponseWriter.Header().Get("Content-Encoding")
-	if crw.Compressor == nil || (ce != "" && ce != crw.Encoding) {
-		return crw.ResponseWriter.Write(b)
+// compressionState is the part of a CompressedResponseWriter that changes as
+// the response is written.
+type compressionState struct {
+	started    bool
+	buffer     []byte
+	code       int
+	compressor io.WriteCloser
+}
+
+// newCompressedResponseWriter returns a CompressedResponseWriter that creates
+// its compressor once the response headers are known.
+func newCompressedResponseWriter(rw http.ResponseWriter, encoding string, options CompressOptions) CompressedResponseWriter {
+	return CompressedResponseWriter{
+		ResponseWriter: rw,
+		Encoding:       encoding,
+		Options:        options,
+		state:          &compressionState{},
 	}
+}
 
+// setEncoding sets the response headers of a response compressed with the
+// writer's encoding.
+func (crw CompressedResponseWriter) setEncoding() {
 	crw.ResponseWriter.Header().Add("Vary", "Accept-Encoding")
 	crw.ResponseWriter.Header().Set("Content-Encoding", crw.Encoding)
-	return crw.Compressor.Write(b)
+	crw.ResponseWriter.Header().Del("Content-Length")
+}
+
+// compressor returns the compressor that the response is written with, or nil
+// if it is written uncompressed.
+func (crw CompressedResponseWriter) compressor() io.WriteCloser {
+	if crw.state == nil {
+		if crw.Compressor == nil {
+			return nil
+		}
+		if ce := crw.ResponseWriter.Header().Get("Content-Encoding"); ce == "" {
+			crw.setEncoding()
+		} else if ce != crw.Encoding {
+			return nil
+		}
+		return crw.Compressor
+	}
+	return crw.state.compressor
+}
+
+// start creates the compressor once the response headers are known, so that
+// the compression level can be chosen based on the response's content type.
+// If compress is false, the response is left uncompressed.
+func (crw CompressedResponseWriter) start(compress bool) {
+	if crw.state.started {
+		return
+	}
+	crw.state.started = true
+
+	ce := crw.ResponseWriter.Header().Get("Content-Encoding")
+	if !compress || crw.Encoding == "" || (ce != "" && ce != crw.Encoding) {
+		return
+	}
+
+	var compressor io.WriteCloser
+	var err error
+	level := compressionLevel(crw.ResponseWriter.Header().Get("Content-Type"))
+	if crw.Options.Level != nil {
+		level = *crw.Options.Level
+	}
+	switch crw.Encoding {
+	case "br":
+		compressor = brotli.NewWriterLevel(crw.ResponseWriter, brotliLevel(level))
+	case "deflate":
+		compressor, err = flate.NewWriter(crw.ResponseWriter, level)
+	case "gzip":
+		compressor, err = gzip.NewWriterLevel(crw.ResponseWriter, level)
+	}
+	if err != nil || compressor == nil {
+		return
+	}
+
+	crw.state.compressor = compressor
+	crw.setEncoding()
+}
+
+// begin decides whether the response is compressed, then sends any status
+// code and body that were held back while the size was unknown.
+func (crw CompressedResponseWriter) begin(compress bool) (err error) {
+	crw.start(compress)
+	if crw.state.code != 0 {
+		crw.ResponseWriter.WriteHeader(crw.state.code)
+		crw.state.code = 0
+	}
+	if len(crw.state.buffer) > 0 {
+		buffer := crw.state.buffer
+		crw.state.buffer = nil
+		_, err = crw.write(buffer)
+	}
+	return
+}
+
+func (crw CompressedResponseWriter) write(b []byte) (int, error) {
+	compressor := crw.compressor()
+	if compressor == nil {
+		return crw.ResponseWriter.Write(b)
+	}
+	return compressor.Write(b)
+}
+
+func (crw CompressedResponseWriter) Write(b []byte) (int, error) {
+	if crw.state != nil && !crw.state.started {
+		if len(crw.state.buffer)+len(b) < crw.Options.MinSize {
+			crw.state.buffer = append(crw.state.buffer, b...)
+			return len(b), nil
+		}
+		if err := crw.begin(true); err != nil {
+			return 0, err
+		}
+	}
+	return crw.write(b)
 }
 
 func (crw CompressedResponseWriter) WriteHeader(code int) {
-	if crw.Compressor != nil && crw.ResponseWriter.Header().Get("Content-Encoding") == "" {
-		crw.ResponseWriter.Header().Add("Vary", "Accept-Encoding")
-		crw.ResponseWriter.Header().Set("Content-Encoding", crw.Encoding)
+	if crw.state == nil {
+		crw.compressor()
+	} else if !crw.state.started {
+		compress := true
+		if crw.Options.MinSize > 0 {
+			length, err := strconv.Atoi(crw.ResponseWriter.Header().Get("Content-Length"))
+			if err != nil {
+				// The size is not known until enough of the body is
+				// written.
+				crw.state.code = code
+				return
+			}
+			compress = length >= crw.Options.MinSize
+		}
+		crw.start(compress)
 	}
 	crw.ResponseWriter.WriteHeader(code)
 }
 
-func CompressResponse(f http.HandlerFunc) http.HandlerFunc {
+// Flush flushes any buffered compressed data to the client, implementing the
+// http.Flusher interface. If the response is still smaller than the minimum
+// size, it is sent uncompressed.
+func (crw CompressedResponseWriter) Flush() {
+	if crw.state != nil {
+		crw.begin(len(crw.state.buffer) >= crw.Options.MinSize)
+	}
+	if flusher, ok := crw.compressor().(interface {
+		Flush() error
+	}); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := crw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends any response held back below the minimum size uncompressed, and
+// flushes and closes the compressor, if one is in use.
+func (crw CompressedResponseWriter) Close() error {
+	if crw.state != nil && !crw.state.started {
+		if err := crw.begin(false); err != nil {
+			return err
+		}
+	}
+	compressor := crw.compressor()
+	if compressor == nil {
+		return nil
+	}
+	return compressor.Close()
+}
+
+// compressionLevel returns the compression level to use for the given content
+// type.
+func compressionLevel(contentType string) int {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return flate.DefaultCompression
+	}
+	if level, ok := loadSettings().compressionLevels[mediaType]; ok {
+		return level
+	}
+	return flate.DefaultCompression
+}
+
+// brotliLevel returns the Brotli quality level equivalent to the given flate
+// compression level.
+func brotliLevel(level int) int {
+	switch level {
+	case flate.DefaultCompression:
+		return brotli.DefaultCompression
+	case flate.HuffmanOnly, flate.BestSpeed:
+		return brotli.BestSpeed
+	case flate.BestCompression:
+		return brotli.BestCompression
+	}
+	return level
+}
+
+// compress wraps the handler with CompressResponseWithOptions, using the
+// compression options of the settings that each request is served with. If
+// compression has been disabled, responses are left uncompressed.
+func compress(f http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		var err error
-		var crw = CompressedResponseWriter{
-			ResponseWriter: rw,
+		s := settingsFor(req)
+		if s.compressionDisabled {
+			f(rw, req)
+			return
 		}
+		CompressResponseWithOptions(f, s.compressionOptions)(rw, req)
+	}
+}
+
+// CompressResponse wraps a handler, compressing its responses with the best
+// content encoding that the client accepts.
+func CompressResponse(f http.HandlerFunc) http.HandlerFunc {
+	return CompressResponseWithOptions(f, CompressOptions{})
+}
 
+// CompressResponseWithOptions is like CompressResponse, but compresses
+// responses as controlled by the given options.
+func CompressResponseWithOptions(f http.HandlerFunc, options CompressOptions) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var encoding string
 		encodings := accept.Parse(req.Header.Get("Accept-Encoding"))
-		useEncoding, err := encodings.Negotiate("gzip", "deflate")
-		if err == nil {
-			switch useEncoding {
-			case "deflate":
-				crw.Compressor, err = flate.NewWriter(rw, flate.DefaultCompression)
-			case "gzip":
-				crw.Compressor, err = gzip.NewWriterLevel(rw, gzip.DefaultCompression)
-			}
-			if err == nil && crw.Compressor != nil {
-				defer crw.Compressor.Close()
-				crw.Encoding = useEncoding
-			}
+		useEncoding, err := encodings.Negotiate(settingsFor(req).compressionEncodings...)
+		if err == nil && SupportedEncodings[useEncoding] {
+			encoding = useEncoding
 		}
+		crw := newCompressedResponseWriter(rw, encoding, options)
+		defer crw.Close()
 
 		f(crw, req)
 	}
 }
+
+// Recover wraps a handler, logging any panic that occurs within it and
+// responding with StatusInternalServerError (500) instead of letting the panic
+// escape.
+func Recover(f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("persona: panic serving %s %s: %v\n%s", req.Method, req.URL.Path, rec, debug.Stack())
+				httpError(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+
+		f(rw, req)
+	}
+}
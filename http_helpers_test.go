@@ -0,0 +1,307 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		contentType string
+		level       int
+	}{
+		{"text/html; charset=utf-8", flate.BestCompression},
+		{"application/json", flate.BestSpeed},
+		{"text/plain", flate.DefaultCompression},
+		{"", flate.DefaultCompression},
+	}
+	for _, test := range tests {
+		if level := compressionLevel(test.contentType); level != test.level {
+			t.Errorf("compressionLevel(%q) = %d, want %d", test.contentType, level, test.level)
+		}
+	}
+}
+
+func TestValidateHTTPResetsCompressionLevels(t *testing.T) {
+	var config Configuration
+	config.HTTP.CompressionLevels = map[string]int{
+		"Text/Plain":       flate.BestSpeed,
+		"application/json": flate.NoCompression,
+	}
+	s := newSettings()
+	if err := validateHTTP(&config, s); err != nil {
+		t.Fatalf("validateHTTP: %v", err)
+	}
+	withSettingsUpdate(t, func(current *settings) { *current = *s })
+	if level := compressionLevel("text/plain"); level != flate.BestSpeed {
+		t.Errorf("configured text/plain level = %d, want %d", level, flate.BestSpeed)
+	}
+	if level := CompressionLevels["application/json"]; level != flate.BestSpeed {
+		t.Errorf("CompressionLevels was modified: application/json = %d", level)
+	}
+
+	config.HTTP.CompressionLevels = nil
+	s = newSettings()
+	if err := validateHTTP(&config, s); err != nil {
+		t.Fatalf("validateHTTP: %v", err)
+	}
+	withSettingsUpdate(t, func(current *settings) { *current = *s })
+	if level := compressionLevel("text/plain"); level != flate.DefaultCompression {
+		t.Errorf("text/plain level after reload = %d, want %d", level, flate.DefaultCompression)
+	}
+	if level := compressionLevel("application/json"); level != flate.BestSpeed {
+		t.Errorf("application/json level after reload = %d, want %d", level, flate.BestSpeed)
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("<p>persona</p>", 100)
+	handler := CompressResponseWithOptions(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeHtml)
+		w.Write([]byte(body))
+	}, CompressOptions{MinSize: 64})
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"gzip", "gzip"},
+		{"identity", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", test.acceptEncoding, encoding, test.encoding)
+			continue
+		}
+		got := w.Body.String()
+		if test.encoding == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+			decoded, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("reading gzip body: %v", err)
+			}
+			got = string(decoded)
+		}
+		if got != body {
+			t.Errorf("Accept-Encoding %q: body was not preserved", test.acceptEncoding)
+		}
+	}
+}
+
+func TestCompressResponseBelowMinSize(t *testing.T) {
+	handler := CompressResponseWithOptions(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeJson)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}, CompressOptions{MinSize: 64})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q, want none", encoding)
+	}
+	if w.Body.String() != `{}` {
+		t.Errorf("body = %q, want %q", w.Body.String(), `{}`)
+	}
+}
+
+func TestCompressedResponseWriterWithCompressor(t *testing.T) {
+	w := httptest.NewRecorder()
+	zw := gzip.NewWriter(w)
+	crw := CompressedResponseWriter{
+		ResponseWriter: w,
+		Compressor:     zw,
+		Encoding:       "gzip",
+	}
+	crw.Write([]byte("persona"))
+	crw.Close()
+
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	if decoded, _ := ioutil.ReadAll(zr); string(decoded) != "persona" {
+		t.Errorf("body = %q, want %q", decoded, "persona")
+	}
+}
+
+func TestCompressResponseEncodings(t *testing.T) {
+	var config Configuration
+	config.HTTP.Encodings = []string{"deflate"}
+	s := newSettings()
+	if err := validateHTTP(&config, s); err != nil {
+		t.Fatalf("validateHTTP: %v", err)
+	}
+	withSettingsUpdate(t, func(current *settings) { current.compressionEncodings = s.compressionEncodings })
+
+	handler := CompressResponseWithOptions(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("persona", 100)))
+	}, CompressOptions{})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate;q=0.5")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "deflate" {
+		t.Errorf("Content-Encoding = %q, want deflate", encoding)
+	}
+
+	config.HTTP.Encodings = []string{"compress"}
+	want := fmt.Sprintf(errUnsupportedEncoding, "compress")
+	if err := validateHTTP(&config, newSettings()); err == nil || err.Error() != want {
+		t.Errorf("validateHTTP = %v, want %q", err, want)
+	}
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	disabled := false
+	var config Configuration
+	config.HTTP.Compression = &disabled
+	s := newSettings()
+	if err := validateHTTP(&config, s); err != nil {
+		t.Fatalf("validateHTTP: %v", err)
+	}
+	withSettingsUpdate(t, func(current *settings) { current.compressionDisabled = s.compressionDisabled })
+
+	handler := compress(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("persona", 100)))
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q, want none", encoding)
+	}
+
+	// Handlers that were wrapped before compression was enabled pick up the
+	// new setting, as well as the options of later configurations.
+	withSettingsUpdate(t, func(current *settings) {
+		current.compressionDisabled = false
+		current.compressionOptions.MinSize = 1000
+	})
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding below the minimum size = %q, want none", encoding)
+	}
+	withSettingsUpdate(t, func(current *settings) { current.compressionOptions.MinSize = 0 })
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+}
+
+func TestProblemJsonErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	httpError(w, "bad request.", http.StatusBadRequest)
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("plain error Content-Type = %q", contentType)
+	}
+
+	withSettingsUpdate(t, func(s *settings) { s.problemJsonErrors = true })
+	w = httptest.NewRecorder()
+	httpError(w, "bad request.", http.StatusBadRequest)
+	if contentType := w.Header().Get("Content-Type"); contentType != ContentTypeProblemJson {
+		t.Errorf("Content-Type = %q, want %q", contentType, ContentTypeProblemJson)
+	}
+	var problem ProblemDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	want := ProblemDocument{Type: "about:blank", Title: "Bad Request", Status: http.StatusBadRequest, Detail: "bad request."}
+	if problem != want || w.Code != http.StatusBadRequest {
+		t.Errorf("problem = %+v with status %d, want %+v", problem, w.Code, want)
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	var v RequestCheckSession
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"email":"user@example.com"}`))
+	if err := readRequest(r, &v); err != nil || v.Email != "user@example.com" {
+		t.Errorf("readRequest without a Content-Type = %v, %q", err, v.Email)
+	}
+
+	withSettingsUpdate(t, func(s *settings) { s.strictContentType = true })
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"email":"user@example.com"}`))
+	err := readRequest(r, &v)
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("readRequest without a Content-Type = %v, want StatusUnsupportedMediaType", err)
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if err := checkContentType(r); err != nil {
+		t.Errorf("checkContentType with JSON = %v", err)
+	}
+}
+
+func TestUnauthorizedChallenge(t *testing.T) {
+	w := httptest.NewRecorder()
+	unauthorized(w, "no.")
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != "" {
+		t.Errorf("WWW-Authenticate = %q, want none", challenge)
+	}
+
+	withSettingsUpdate(t, func(s *settings) { s.wwwAuthenticate = `Bearer realm="persona"` })
+	w = httptest.NewRecorder()
+	writeError(w, &HTTPError{Code: http.StatusUnauthorized, Message: "no."})
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="persona"` {
+		t.Errorf("status = %d, WWW-Authenticate = %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRecover(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	handler := Recover(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	// http.ErrAbortHandler is left for the server to handle.
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	Recover(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
@@ -5,30 +5,98 @@
 package persona
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"crypto/elliptic"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
-)
 
-// idCertExpMaxDuration is the max duration, in seconds, for all issued ID
-// certificates.
-const idCertExpMaxDuration = SessionMaxDuration
+	"golang.org/x/net/idna"
+)
 
-// idCertIatFuzzDuration is the time, in seconds, to fuzz the issued-at time
-// for all issued ID certificates.
+// idCertIatFuzzDuration is the default time, in seconds, to fuzz the issued-at
+// time for all issued ID certificates.
 const idCertIatFuzzDuration = -10
 
 // Error messages.
 const (
-	errWriteExpectedBytes = "expected to write %d bytes, instead wrote %d."
+	errClientKeyNotAllowed = "client public key algorithm '%s' is not allowed."
+	errClientKeyTooLarge   = "client public key is %d bytes, should be at most %d bytes."
+	errClientKeyTooSmall   = "client public key is %d bits, should be at least %d bits."
+	errClientKeyUnknown    = "client public key algorithm '%s' is not supported."
+	errMissingPublicKey    = "public key parameter '%s' is missing."
+	errDomainNotAllowed    = "email domain '%s' is not allowed."
+	errInvalidEmail        = "email address '%s' is invalid."
+	errInvalidAudience     = "audience '%s' is not a valid origin."
+	errIssuerNotAllowed    = "issuer '%s' is not allowed."
+	errIssuerNotTrusted    = "caller is not trusted to override the issuer."
 )
 
+// DefaultMaxClientKeyBytes is the default maximum size, in bytes, of the JSON
+// encoded client public key.
+const DefaultMaxClientKeyBytes = 4096
+
+// UnderstoodCriticalHeaders is a list of the extension header parameters that
+// VerifyCertificate understands. Certificates that mark any other parameter as
+// critical are rejected.
+var UnderstoodCriticalHeaders = map[string]bool{}
+
+// RegisteredHeaders is a list of the header parameters registered by RFC 7515,
+// which can neither be set as extension header parameters nor be marked as
+// critical.
+var RegisteredHeaders = map[string]bool{
+	"alg":      true,
+	"crit":     true,
+	"cty":      true,
+	"jku":      true,
+	"jwk":      true,
+	"kid":      true,
+	"typ":      true,
+	"x5c":      true,
+	"x5t":      true,
+	"x5t#S256": true,
+	"x5u":      true,
+}
+
 // IdentityCertificateHeader is the header for an identity certificate.
 type IdentityCertificateHeader struct {
-	Alg string `json:"alg"`
+	Alg  string   `json:"alg"`
+	Jku  string   `json:"jku,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+
+	// Extra holds extension header parameters, which are encoded alongside
+	// the registered parameters. Extra parameters never replace registered
+	// parameters of the same name.
+	Extra map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (header IdentityCertificateHeader) MarshalJSON() ([]byte, error) {
+	type registeredHeader IdentityCertificateHeader
+	registeredJson, err := json.Marshal(registeredHeader(header))
+	if err != nil || len(header.Extra) == 0 {
+		return registeredJson, err
+	}
+
+	var registered map[string]json.RawMessage
+	if err = json.Unmarshal(registeredJson, &registered); err != nil {
+		return nil, err
+	}
+	params := make(map[string]interface{}, len(header.Extra)+len(registered))
+	for name, value := range header.Extra {
+		params[name] = value
+	}
+	for name, value := range registered {
+		params[name] = value
+	}
+	return json.Marshal(params)
 }
 
 // IdentityCertificatePrincipal is the principal element of an identity
@@ -37,79 +105,450 @@ type IdentityCertificatePrincipal struct {
 	Email string `json:"email"`
 }
 
-// IdentityCertificate represents an identity certificate.
+// IdentityCertificate represents an identity certificate. Iat and Exp are in
+// milliseconds since the Unix epoch.
 type IdentityCertificate struct {
 	Iat       int64                        `json:"iat,string"`
 	Exp       int64                        `json:"exp,string"`
 	Iss       string                       `json:"iss"`
-	PublicKey map[string]string            `json:"public-key"`
+	Aud       string                       `json:"aud,omitempty"`
+	PublicKey map[string]string            `json:"public-key,omitempty"`
 	Principal IdentityCertificatePrincipal `json:"principal"`
+
+	// Extra holds additional claims, which are encoded alongside the standard
+	// claims. Extra claims never replace standard claims of the same name.
+	Extra map[string]interface{} `json:"-"`
 }
 
-func identityCertificate(req RequestGenerateCertificate) (cert string, err error) {
-	var output bytes.Buffer
-	b64Encoder := base64.NewEncoder(base64.URLEncoding, &output)
-	defer b64Encoder.Close()
-	jsonEncoder := json.NewEncoder(b64Encoder)
+// MarshalJSON implements the json.Marshaler interface.
+func (cert IdentityCertificate) MarshalJSON() ([]byte, error) {
+	type standardCertificate IdentityCertificate
+	standardJson, err := json.Marshal(standardCertificate(cert))
+	if err != nil || len(cert.Extra) == 0 {
+		return standardJson, err
+	}
 
-	// Create the ID certificate header.
-	idCertHeader, err := privateKey.IdCertHeader()
+	var standard map[string]json.RawMessage
+	if err = json.Unmarshal(standardJson, &standard); err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{}, len(cert.Extra)+len(standard))
+	for name, value := range cert.Extra {
+		claims[name] = value
+	}
+	for name, value := range standard {
+		claims[name] = value
+	}
+	return json.Marshal(claims)
+}
+
+// CertificateHook, if set, is called with each ID certificate after it has
+// been assembled, but before it is signed. It may add Extra claims, or bring
+// the expiration time forward, but changes to any other field are discarded.
+// If it returns an error, the certificate is not issued, and the error is
+// reported to the client; an *HTTPError may be returned to control the status
+// code of the response.
+var CertificateHook func(cert *IdentityCertificate) error
+
+// applyCertificateHook runs the CertificateHook, if one is set, keeping only
+// the changes that it is allowed to make.
+func applyCertificateHook(idCert *IdentityCertificate) error {
+	if CertificateHook == nil {
+		return nil
+	}
+
+	// The public key is copied, so that changes the hook makes to it are
+	// discarded along with those to the other fields.
+	hooked := *idCert
+	if idCert.PublicKey != nil {
+		hooked.PublicKey = make(map[string]string, len(idCert.PublicKey))
+		for name, value := range idCert.PublicKey {
+			hooked.PublicKey[name] = value
+		}
+	}
+	if err := CertificateHook(&hooked); err != nil {
+		return err
+	}
+	if hooked.Exp < idCert.Exp {
+		idCert.Exp = hooked.Exp
+	}
+	idCert.Extra = hooked.Extra
+	return nil
+}
+
+// SignedIdentityCertificate is a signed identity certificate. Its JSON
+// encoding is the flattened JWS JSON serialization of the certificate.
+type SignedIdentityCertificate struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// Compact returns the JWS compact serialization of the certificate.
+func (cert SignedIdentityCertificate) Compact() string {
+	return cert.Protected + "." + cert.Payload + "." + cert.Signature
+}
+
+// identityCertificate returns the compact serialization of a certificate
+// signed with the default private key. If an error occurs, cert is always
+// empty.
+func identityCertificate(req RequestGenerateCertificate) (cert string, err error) {
+	s := loadSettings()
+	signed, err := signIdentityCertificate(s, req, s.privateKey, s.defaultIssuer)
 	if err != nil {
+		return "", err
+	}
+
+	cert = signed.Compact()
+	return
+}
+
+// signIdentityCertificate signs an identity certificate for the request with
+// the given private key and settings, naming the given issuer unless the
+// request overrides it. Every segment is encoded in full before the
+// certificate is assembled, so if an error occurs, signed is always the zero
+// value.
+func signIdentityCertificate(s *settings, req RequestGenerateCertificate, key *PrivateKey, issuer string) (signed SignedIdentityCertificate, err error) {
+	if key == nil {
+		err = fmt.Errorf(errPrivateKeyUndefined)
+		return
+	}
+
+	// Select a key that is currently valid.
+	if key, err = eligibleKey(key, time.Now()); err != nil {
 		return
 	}
-	if err = jsonEncoder.Encode(idCertHeader); err != nil {
+
+	// Create the ID certificate header.
+	idCertHeader, err := key.idCertHeader(s)
+	if err != nil {
 		return
 	}
-	if err = output.WriteByte('.'); err != nil {
+	protected, err := encodeSegment(idCertHeader)
+	if err != nil {
 		return
 	}
 
 	// Create the ID certificate.
-	if req.Duration > idCertExpMaxDuration {
-		req.Duration = idCertExpMaxDuration
+	if req.Duration <= 0 || req.Duration > s.sessionMaxDuration {
+		req.Duration = s.sessionMaxDuration
+	}
+	iat := time.Now().Add(s.idCertIatFuzz)
+	exp := time.Now().Add(time.Duration(req.Duration) * time.Second)
+	if req.sessionTTL > 0 {
+		if sessionExp := time.Now().Add(req.sessionTTL); exp.After(sessionExp) {
+			exp = sessionExp
+		}
+	}
+	if s.timestampGranularity > 0 {
+		iat = iat.Truncate(s.timestampGranularity)
+		exp = exp.Truncate(s.timestampGranularity)
 	}
 	idCert := IdentityCertificate{
-		Iat:       time.Now().Add(idCertIatFuzzDuration).Unix() * int64(time.Millisecond),
-		Exp:       time.Now().Add(idCertExpMaxDuration).Unix() * int64(time.Millisecond),
-		Iss:       "timewasted.me", // FIXME: Don't hardcode the issuer
+		Iat:       iat.UnixNano() / int64(time.Millisecond),
+		Exp:       exp.UnixNano() / int64(time.Millisecond),
+		Iss:       issuer,
+		Aud:       req.Audience,
 		PublicKey: req.PublicKey,
 		Principal: IdentityCertificatePrincipal{
 			Email: req.Email,
 		},
 	}
-	if err = jsonEncoder.Encode(idCert); err != nil {
+	if len(req.Issuer) > 0 {
+		idCert.Iss = req.Issuer
+	}
+	if req.OmitPublicKey && s.allowOmitPublicKey {
+		idCert.PublicKey = nil
+	}
+	if err = applyCertificateHook(&idCert); err != nil {
+		return
+	}
+	payload, err := encodeSegment(idCert)
+	if err != nil {
 		return
 	}
 
 	// Sign the concatenated header/certificate.
-	var n int
-	h := sha256.New()
-	n, err = h.Write(output.Bytes())
+	sig, err := key.SignMessage([]byte(protected + "." + payload))
 	if err != nil {
 		return
 	}
-	if n != output.Len() {
-		err = fmt.Errorf(errWriteExpectedBytes, output.Len(), n)
-		return
+
+	signed = SignedIdentityCertificate{
+		Protected: protected,
+		Payload:   payload,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
 	}
-	sig, err := privateKey.Sign(h.Sum(nil))
+	return
+}
+
+// encodeSegment returns the base64url encoded JSON representation of v, as
+// RFC 7515 requires: compact JSON, without a trailing newline, encoded without
+// padding. Releases before flattened JWS support emitted padded segments of
+// newline-terminated JSON, which strict JOSE verifiers reject, so certificates
+// issued since then differ in their encoding, though not in their content.
+func encodeSegment(v interface{}) (segment string, err error) {
+	rawJson, err := json.Marshal(v)
 	if err != nil {
 		return
 	}
 
-	// Append the signature to the ID certificate.
-	if err = output.WriteByte('.'); err != nil {
-		return
+	segment = base64.RawURLEncoding.EncodeToString(rawJson)
+	return
+}
+
+// validateAudience returns an HTTPError if the requested audience is not a
+// well-formed origin, i.e. a scheme and host with an optional port. Otherwise,
+// the audience is normalized to lowercase.
+func validateAudience(req *RequestGenerateCertificate) error {
+	if len(req.Audience) == 0 {
+		return nil
+	}
+
+	aud, err := url.Parse(req.Audience)
+	if err != nil || (aud.Scheme != "http" && aud.Scheme != "https") ||
+		len(aud.Hostname()) == 0 || aud.User != nil || aud.Opaque != "" ||
+		(aud.Path != "" && aud.Path != "/") || aud.RawQuery != "" || aud.ForceQuery || aud.Fragment != "" ||
+		strings.HasSuffix(aud.Host, ":") {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errInvalidAudience, req.Audience),
+		}
+	}
+	req.Audience = strings.ToLower(aud.Scheme + "://" + aud.Host)
+	return nil
+}
+
+// validateIssuerOverride returns an HTTPError if the request overrides the
+// certificate issuer without being from a trusted caller, or with an issuer
+// that is not allowed.
+func validateIssuerOverride(r *http.Request, req RequestGenerateCertificate) error {
+	if len(req.Issuer) == 0 {
+		return nil
+	}
+	if !isTrustedCaller(r) {
+		return &HTTPError{
+			Code:    http.StatusForbidden,
+			Message: errIssuerNotTrusted,
+		}
+	}
+	if !settingsFor(r).allowedIssuers[strings.ToLower(req.Issuer)] {
+		return &HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf(errIssuerNotAllowed, req.Issuer),
+		}
+	}
+	return nil
+}
+
+// isTrustedCaller returns whether the request carries the trusted caller
+// secret as a bearer token.
+func isTrustedCaller(r *http.Request) bool {
+	return hasBearerToken(r, settingsFor(r).trustedCallerSecret)
+}
+
+// hasBearerToken returns whether the request carries the given secret as a
+// bearer token. An empty secret is never matched.
+func hasBearerToken(r *http.Request, secret string) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// validateClientKeyAlgorithm returns an HTTPError if the client public key
+// uses an algorithm that is not allowed, or is an RSA key that is too small.
+func validateClientKeyAlgorithm(s *settings, req RequestGenerateCertificate) error {
+	algorithm := strings.ToUpper(req.PublicKey["algorithm"])
+	if len(s.allowedClientKeyAlgorithms) > 0 && !s.allowedClientKeyAlgorithms[algorithm] {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errClientKeyNotAllowed, algorithm),
+		}
+	}
+
+	if algorithm == PrivateKeyTypeToAlgorithm["RSA"] && s.minClientKeySizeRSA > 0 {
+		n, ok := new(big.Int).SetString(req.PublicKey["n"], 10)
+		if !ok {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf(errMalformedPublicKey, "n"),
+			}
+		}
+		if n.BitLen() < s.minClientKeySizeRSA {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf(errClientKeyTooSmall, n.BitLen(), s.minClientKeySizeRSA),
+			}
+		}
+	}
+	return nil
+}
+
+// validatePublicKey returns an HTTPError if the client public key uses an
+// unknown algorithm, or is missing a parameter required by its algorithm or
+// has one that does not parse.
+func validatePublicKey(pubKey map[string]string) error {
+	malformed := func(param string) error {
+		if len(pubKey[param]) == 0 {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf(errMissingPublicKey, param),
+			}
+		}
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errMalformedPublicKey, param),
+		}
 	}
-	n, err = b64Encoder.Write(sig)
+	decimal := func(param string) (*big.Int, error) {
+		n, ok := new(big.Int).SetString(pubKey[param], 10)
+		if !ok || n.Sign() <= 0 {
+			return nil, malformed(param)
+		}
+		return n, nil
+	}
+	hexadecimal := func(param string) (*big.Int, error) {
+		n, ok := new(big.Int).SetString(pubKey[param], 16)
+		if !ok || n.Sign() <= 0 {
+			return nil, malformed(param)
+		}
+		return n, nil
+	}
+
+	switch algorithm := pubKey["algorithm"]; algorithm {
+	case PrivateKeyTypeToAlgorithm["RSA"]:
+		for _, param := range []string{"n", "e"} {
+			if _, err := decimal(param); err != nil {
+				return err
+			}
+		}
+	case PrivateKeyTypeToAlgorithm["DSA"]:
+		for _, param := range []string{"p", "q", "g", "y"} {
+			if _, err := hexadecimal(param); err != nil {
+				return err
+			}
+		}
+	case PrivateKeyTypeToAlgorithm["ECDSA"]:
+		var curve elliptic.Curve
+		for c, label := range SupportedEllipticCurves {
+			if label == pubKey["crv"] {
+				curve = c
+				break
+			}
+		}
+		if curve == nil {
+			return malformed("crv")
+		}
+		x, err := decimal("x")
+		if err != nil {
+			return err
+		}
+		y, err := decimal("y")
+		if err != nil {
+			return err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return malformed("y")
+		}
+	case "":
+		return malformed("algorithm")
+	default:
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errClientKeyUnknown, algorithm),
+		}
+	}
+	return nil
+}
+
+// validateClientKeyBytes returns an HTTPError if the JSON encoded client
+// public key is larger than the configured maximum.
+func validateClientKeyBytes(s *settings, req RequestGenerateCertificate) error {
+	pubKeyJson, err := json.Marshal(req.PublicKey)
 	if err != nil {
-		return
+		return err
+	}
+	if len(pubKeyJson) > s.maxClientKeyBytes {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf(errClientKeyTooLarge, len(pubKeyJson), s.maxClientKeyBytes),
+		}
+	}
+	return nil
+}
+
+// validateEmailDomain returns an HTTPError if the requested email address is
+// malformed, or belongs to a domain that is not allowed.
+func validateEmailDomain(s *settings, req RequestGenerateCertificate) error {
+	if len(s.allowedDomains) == 0 {
+		return nil
+	}
+
+	domain, err := emailDomain(req.Email)
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
 	}
-	if n != len(sig) {
-		err = fmt.Errorf(errWriteExpectedBytes, len(sig), n)
+	if !s.allowedDomains[domain] {
+		return &HTTPError{
+			Code:    http.StatusForbidden,
+			Message: fmt.Sprintf(errDomainNotAllowed, domain),
+		}
+	}
+	return nil
+}
+
+// emailLocalPart matches the local part of an email address, as accepted by
+// the HTML email input type.
+var emailLocalPart = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+$")
+
+// emailDomainLabels matches the ASCII form of the domain of an email address.
+var emailDomainLabels = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// validateEmail returns an HTTPError if the given email address is empty or
+// malformed. Internationalized domains are accepted, but local parts must be
+// ASCII.
+func validateEmail(email string) error {
+	at := strings.LastIndex(email, "@")
+	if at > 0 && emailLocalPart.MatchString(email[:at]) {
+		if domain, err := normalizeDomain(email[at+1:]); err == nil && emailDomainLabels.MatchString(domain) {
+			return nil
+		}
+	}
+	return &HTTPError{
+		Code:    http.StatusBadRequest,
+		Message: fmt.Sprintf(errInvalidEmail, email),
+	}
+}
+
+// emailDomain returns the normalized domain of the given email address. The
+// address must be a bare addr-spec containing exactly one '@'.
+func emailDomain(email string) (domain string, err error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || strings.Count(email, "@") != 1 {
+		err = fmt.Errorf(errInvalidEmail, email)
 		return
 	}
 
-	cert = output.String()
+	if domain, err = normalizeDomain(email[strings.LastIndex(email, "@")+1:]); err != nil {
+		err = fmt.Errorf(errInvalidEmail, email)
+	}
 	return
 }
+
+// normalizeDomain returns the lowercased IDNA ASCII form of the given domain.
+func normalizeDomain(domain string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(ascii), nil
+}
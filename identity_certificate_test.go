@@ -0,0 +1,319 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testSigningKey returns a freshly generated P-256 private key, along with its
+// public key.
+func testSigningKey(t *testing.T) (*PrivateKey, *ecdsa.PublicKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	pk, err := newPrivateKey(key)
+	if err != nil {
+		t.Fatalf("newPrivateKey: %v", err)
+	}
+	return pk, &key.PublicKey
+}
+
+// testCertificateRequest returns a valid certificate request for
+// user@example.com.
+func testCertificateRequest() RequestGenerateCertificate {
+	return RequestGenerateCertificate{
+		Email: "user@example.com",
+		PublicKey: map[string]string{
+			"algorithm": "RS",
+			"n":         "1",
+			"e":         "65537",
+		},
+		Duration: 3600,
+	}
+}
+
+// certificatePayload returns the decoded payload of a signed certificate.
+func certificatePayload(t *testing.T, signed SignedIdentityCertificate) (payload map[string]interface{}) {
+	t.Helper()
+	payloadJson, err := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if err := json.Unmarshal(payloadJson, &payload); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return
+}
+
+func TestSignedCertificateSerializations(t *testing.T) {
+	pk, pub := testSigningKey(t)
+	signed, err := signIdentityCertificate(newSettings(), testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+
+	compact := signed.Compact()
+	if strings.Contains(compact, "=") {
+		t.Errorf("compact certificate %q is padded", compact)
+	}
+	if err := VerifyCertificate(compact, pub); err != nil {
+		t.Fatalf("compact certificate did not verify: %v", err)
+	}
+
+	// The flattened serialization must carry the same segments.
+	flattened, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal(flattened, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	reassembled := decoded["protected"] + "." + decoded["payload"] + "." + decoded["signature"]
+	if reassembled != compact {
+		t.Fatalf("flattened certificate %s does not match compact certificate %s", flattened, compact)
+	}
+	if err := VerifyCertificate(reassembled, pub); err != nil {
+		t.Fatalf("flattened certificate did not verify: %v", err)
+	}
+
+	payloadJson, err := base64.RawURLEncoding.DecodeString(decoded["payload"])
+	if err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if strings.HasSuffix(string(payloadJson), "\n") {
+		t.Error("payload JSON has a trailing newline")
+	}
+	var cert IdentityCertificate
+	if err := json.Unmarshal(payloadJson, &cert); err != nil {
+		t.Fatalf("decoding certificate: %v", err)
+	}
+	if cert.Principal.Email != "user@example.com" || cert.Iss != "example.com" {
+		t.Errorf("certificate has principal %q and issuer %q", cert.Principal.Email, cert.Iss)
+	}
+}
+
+func TestVerifyCertificateRejectsTampering(t *testing.T) {
+	pk, pub := testSigningKey(t)
+	signed, err := signIdentityCertificate(newSettings(), testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	other, _ := testSigningKey(t)
+	req := testCertificateRequest()
+	req.Email = "other@example.com"
+	forged, err := signIdentityCertificate(newSettings(), req, other, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+
+	tests := map[string]string{
+		"wrong key":     forged.Compact(),
+		"swapped body":  signed.Protected + "." + forged.Payload + "." + signed.Signature,
+		"two segments":  signed.Protected + "." + signed.Payload,
+		"padded header": signed.Protected + "==." + signed.Payload + "." + signed.Signature,
+	}
+	for name, cert := range tests {
+		if err := VerifyCertificate(cert, pub); err == nil {
+			t.Errorf("%s: certificate verified", name)
+		}
+	}
+}
+
+func TestCriticalHeaders(t *testing.T) {
+	defer delete(UnderstoodCriticalHeaders, "exp-ext")
+
+	var config Configuration
+	config.Certificate.Headers = map[string]interface{}{"exp-ext": "v1"}
+	config.Certificate.Crit = []string{"exp-ext"}
+	s := newSettings()
+	if err := validateCertificate(&config, s); err != nil {
+		t.Fatalf("validateCertificate: %v", err)
+	}
+
+	pk, pub := testSigningKey(t)
+	signed, err := signIdentityCertificate(s, testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(signed.Protected)
+	if err != nil {
+		t.Fatalf("decoding header: %v", err)
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if header["exp-ext"] != "v1" {
+		t.Errorf("header %s does not carry the extension parameter", headerJson)
+	}
+
+	if err := VerifyCertificate(signed.Compact(), pub); err == nil {
+		t.Error("certificate with an unrecognized critical parameter was accepted")
+	}
+	UnderstoodCriticalHeaders["exp-ext"] = true
+	if err := VerifyCertificate(signed.Compact(), pub); err != nil {
+		t.Errorf("certificate with a recognized critical parameter was rejected: %v", err)
+	}
+}
+
+func TestValidateCertificateCrit(t *testing.T) {
+	tests := []struct {
+		headers map[string]interface{}
+		crit    []string
+		valid   bool
+	}{
+		{nil, nil, true},
+		{map[string]interface{}{"exp-ext": 1}, nil, true},
+		{map[string]interface{}{"exp-ext": 1}, []string{"exp-ext"}, true},
+		{nil, []string{"exp-ext"}, false},
+		{map[string]interface{}{"kid": "1"}, nil, false},
+		{map[string]interface{}{"alg": "none"}, []string{"alg"}, false},
+	}
+	for _, test := range tests {
+		var config Configuration
+		config.Certificate.Headers = test.headers
+		config.Certificate.Crit = test.crit
+		if err := validateCertificate(&config, newSettings()); (err == nil) != test.valid {
+			t.Errorf("validateCertificate(%v, %v) = %v, want valid %v", test.headers, test.crit, err, test.valid)
+		}
+	}
+}
+
+func TestCertificateHookCanNotChangePublicKey(t *testing.T) {
+	defer func() { CertificateHook = nil }()
+	CertificateHook = func(cert *IdentityCertificate) error {
+		cert.PublicKey["n"] = "2"
+		cert.Principal.Email = "attacker@example.com"
+		cert.Exp -= 1000
+		cert.Extra = map[string]interface{}{"tenant": "a"}
+		return nil
+	}
+
+	req := testCertificateRequest()
+	idCert := IdentityCertificate{
+		Exp:       2000,
+		PublicKey: req.PublicKey,
+		Principal: IdentityCertificatePrincipal{Email: req.Email},
+	}
+	if err := applyCertificateHook(&idCert); err != nil {
+		t.Fatalf("applyCertificateHook: %v", err)
+	}
+	if idCert.PublicKey["n"] != "1" || req.PublicKey["n"] != "1" {
+		t.Errorf("hook changed the public key to %v", idCert.PublicKey)
+	}
+	if idCert.Principal.Email != req.Email {
+		t.Errorf("hook changed the principal to %q", idCert.Principal.Email)
+	}
+	if idCert.Exp != 1000 || idCert.Extra["tenant"] != "a" {
+		t.Errorf("hook's allowed changes were discarded: exp %d, extra %v", idCert.Exp, idCert.Extra)
+	}
+}
+
+func TestSignIdentityCertificateFailsWhole(t *testing.T) {
+	defer func() { CertificateHook = nil }()
+	CertificateHook = func(cert *IdentityCertificate) error {
+		cert.Extra = map[string]interface{}{"unencodable": make(chan int)}
+		return nil
+	}
+	pk, _ := testSigningKey(t)
+
+	signed, err := signIdentityCertificate(newSettings(), testCertificateRequest(), pk, "example.com")
+	if err == nil {
+		t.Fatal("signIdentityCertificate with an unencodable claim succeeded")
+	}
+	if signed != (SignedIdentityCertificate{}) {
+		t.Errorf("signIdentityCertificate returned a partial certificate %+v", signed)
+	}
+}
+
+func TestEmailDomain(t *testing.T) {
+	tests := []struct {
+		email, domain string
+	}{
+		{"user@example.com", "example.com"},
+		{"user@EXAMPLE.Com", "example.com"},
+		{"user@example.com.evil.org", "example.com.evil.org"},
+		{"user@bücher.example", "xn--bcher-kva.example"},
+		{"user@BÜCHER.example", "xn--bcher-kva.example"},
+		{"user@xn--bcher-kva.example", "xn--bcher-kva.example"},
+		// Malformed addresses have no domain.
+		{"", ""},
+		{"user", ""},
+		{"user@", ""},
+		{"user@evil.org@example.com", ""},
+		{`"user@evil.org"@example.com`, ""},
+		{"User <user@example.com>", ""},
+		{"user@example.com.", ""},
+		{"user@example..com", ""},
+		{"user@.example.com", ""},
+	}
+	for _, test := range tests {
+		domain, err := emailDomain(test.email)
+		if test.domain == "" {
+			if err == nil {
+				t.Errorf("emailDomain(%q) = %q, want an error", test.email, domain)
+			}
+			continue
+		}
+		if err != nil || domain != test.domain {
+			t.Errorf("emailDomain(%q) = %q, %v, want %q", test.email, domain, err, test.domain)
+		}
+	}
+}
+
+func TestValidateEmailDomain(t *testing.T) {
+	s := newSettings()
+	if err := validateEmailDomain(s, RequestGenerateCertificate{Email: "user@evil.org"}); err != nil {
+		t.Errorf("without an allowlist, validateEmailDomain = %v, want nil", err)
+	}
+
+	for _, domain := range []string{"example.com", "Bücher.example"} {
+		normalized, err := normalizeDomain(domain)
+		if err != nil {
+			t.Fatalf("normalizeDomain(%q): %v", domain, err)
+		}
+		s.allowedDomains[normalized] = true
+	}
+	tests := []struct {
+		email string
+		code  int
+	}{
+		{"user@example.com", 0},
+		{"user@Example.COM", 0},
+		{"user@bücher.example", 0},
+		{"user@xn--bcher-kva.example", 0},
+		{"user@evil.org", http.StatusForbidden},
+		{"user@sub.example.com", http.StatusForbidden},
+		{"user@example.com.evil.org", http.StatusForbidden},
+		{"user@evilexample.com", http.StatusForbidden},
+		{"user@evil.org@example.com", http.StatusBadRequest},
+		{"user@example.com@evil.org", http.StatusBadRequest},
+		{"user@example.com.", http.StatusBadRequest},
+		{"user", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		err := validateEmailDomain(s, RequestGenerateCertificate{Email: test.email})
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("validateEmailDomain(%q) = %v, want nil", test.email, err)
+			}
+			continue
+		}
+		if httpErr, ok := err.(*HTTPError); !ok || httpErr.Code != test.code {
+			t.Errorf("validateEmailDomain(%q) = %v, want status %d", test.email, err, test.code)
+		}
+	}
+}
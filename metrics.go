@@ -0,0 +1,74 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"net/http"
+	"time"
+)
+
+// Metrics receives measurements from the handlers and from certificate
+// signing, so that they can be exported to a monitoring system such as
+// Prometheus.
+type Metrics interface {
+	// ObserveRequest is called once for each request served by a handler
+	// registered by RegisterHandlers. The endpoint is the pattern that the
+	// handler was registered with.
+	ObserveRequest(endpoint string, status int, duration time.Duration)
+
+	// ObserveSessionCheck is called once for each session checked by
+	// CheckSession, with whether the user had a valid session.
+	ObserveSessionCheck(hit bool)
+
+	// ObserveSigning is called once for each signature made by a private
+	// key, with the algorithm identifier of the signature.
+	ObserveSigning(alg string, duration time.Duration)
+}
+
+// MetricsCollector, if set, receives measurements from the handlers and from
+// certificate signing. If nil, nothing is measured.
+var MetricsCollector Metrics
+
+// observeRequests wraps a handler that is registered at the given endpoint,
+// reporting each request to the MetricsCollector, if one is set.
+func observeRequests(endpoint string, f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		metrics := MetricsCollector
+		if metrics == nil {
+			f(rw, req)
+			return
+		}
+
+		start := time.Now()
+		w := &accessLogWriter{
+			ResponseWriter: rw,
+		}
+		defer func() {
+			status := w.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.ObserveRequest(endpoint, status, time.Since(start))
+		}()
+
+		f(w, req)
+	}
+}
+
+// observeSessionCheck reports the result of a session check to the
+// MetricsCollector, if one is set.
+func observeSessionCheck(hit bool) {
+	if metrics := MetricsCollector; metrics != nil {
+		metrics.ObserveSessionCheck(hit)
+	}
+}
+
+// observeSigning reports a signature that was started at the given time to
+// the MetricsCollector, if one is set.
+func observeSigning(pk *PrivateKey, start time.Time) {
+	if metrics := MetricsCollector; metrics != nil {
+		metrics.ObserveSigning(signingAlg(publicKey(pk.key), pk.pss), time.Since(start))
+	}
+}
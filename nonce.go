@@ -0,0 +1,217 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NonceMaxAge is the length of time that a nonce is valid for after it has
+// been issued.
+const NonceMaxAge = 5 * time.Minute
+
+// nonceRandomBytes is the number of random bytes included in each nonce.
+const nonceRandomBytes = 16
+
+// nonceKeyBytes is the size of the randomly generated nonce key.
+const nonceKeyBytes = 32
+
+// NonceRateLimit controls how often each client may request a nonce. Nonces
+// are requested anonymously, so the nonce endpoint is always rate limited.
+var NonceRateLimit = RateLimitOptions{
+	Rate:  1,
+	Burst: 20,
+}
+
+// Error messages.
+const (
+	errInvalidNonce   = "nonce is invalid."
+	errNonceExpired   = "nonce has expired."
+	errNonceRequired  = "a nonce is required."
+	errNonceUsed      = "nonce has already been used."
+	errNoncesDisabled = "nonces are not enabled."
+)
+
+// NonceResponse is the response to a nonce request.
+type NonceResponse struct {
+	Nonce string `json:"nonce"`
+}
+
+// usedNonces is a nonce-to-expiration time mapping of the nonces that have
+// been used, which are rejected if they are used again before they expire.
+var (
+	usedNoncesMutex     sync.Mutex
+	usedNonces          = make(map[string]int64)
+	usedNoncesLastSweep time.Time
+)
+
+// Nonce responds with a nonce issued by the default provider.
+func Nonce(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.Nonce(w, r)
+}
+
+// Nonce responds with a short-lived nonce that must be included in a
+// subsequent certificate request to the provider. Each nonce may only be used
+// once.
+func (p *Provider) Nonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	nonce, err := newNonce(p.nonceKey(settingsFor(r)), time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	nonceJson, err := json.Marshal(NonceResponse{
+		Nonce: nonce,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Nonces must never be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Type", ContentTypeJson)
+	writeBody(w, r, nonceJson)
+}
+
+// newNonce returns a nonce that expires NonceMaxAge after the given time. The
+// nonce consists of its expiration time and random data, followed by an
+// HMAC-SHA256 of both made with the given nonce key.
+func newNonce(key hmacKey, now time.Time) (nonce string, err error) {
+	if len(key) == 0 {
+		err = errors.New(errNoncesDisabled)
+		return
+	}
+	random := make([]byte, nonceRandomBytes)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+
+	payload := strconv.FormatInt(now.Add(NonceMaxAge).Unix(), 10) + "." + hex.EncodeToString(random)
+	nonce = payload + "." + base64.RawURLEncoding.EncodeToString(nonceMAC(key, payload))
+	return
+}
+
+// nonceMAC returns the HMAC-SHA256 of the nonce payload made with the given
+// nonce key.
+func nonceMAC(key hmacKey, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// validateNonce returns an HTTPError if a nonce is required and the request
+// does not include one that was signed with the provider's nonce key, is still
+// fresh, and has not been used before.
+func (p *Provider) validateNonce(s *settings, req RequestGenerateCertificate) error {
+	if !s.requireNonce {
+		return nil
+	}
+	if len(req.Nonce) == 0 {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: errNonceRequired,
+		}
+	}
+
+	return checkNonce(p.nonceKey(s), req.Nonce, time.Now())
+}
+
+// checkNonce returns an HTTPError if the nonce was not signed with the given
+// nonce key, has expired as of the given time, or has been used before.
+// Otherwise, the nonce is recorded as used.
+func checkNonce(key hmacKey, nonce string, now time.Time) error {
+	invalid := &HTTPError{
+		Code:    http.StatusBadRequest,
+		Message: errInvalidNonce,
+	}
+
+	sep := strings.LastIndex(nonce, ".")
+	if sep < 0 || len(key) == 0 {
+		return invalid
+	}
+	payload := nonce[:sep]
+	sig, err := base64.RawURLEncoding.DecodeString(nonce[sep+1:])
+	if err != nil || !hmac.Equal(sig, nonceMAC(key, payload)) {
+		return invalid
+	}
+
+	fields := strings.SplitN(payload, ".", 2)
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || len(fields) != 2 {
+		return invalid
+	}
+	if now.Unix() > expires {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: errNonceExpired,
+		}
+	}
+	if !useNonce(payload, expires, now) {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Message: errNonceUsed,
+		}
+	}
+	return nil
+}
+
+// useNonce records the nonce with the given payload as used until it expires,
+// and returns false if it had already been used.
+func useNonce(payload string, expires int64, now time.Time) bool {
+	usedNoncesMutex.Lock()
+	defer usedNoncesMutex.Unlock()
+
+	if now.Sub(usedNoncesLastSweep) >= rateLimitSweepInterval {
+		for used, usedExpires := range usedNonces {
+			if now.Unix() > usedExpires {
+				delete(usedNonces, used)
+			}
+		}
+		usedNoncesLastSweep = now
+	}
+
+	if _, used := usedNonces[payload]; used {
+		return false
+	}
+	usedNonces[payload] = expires
+	return true
+}
+
+// newNonceKey returns the key to sign nonces with, which is the given secret.
+// If it is empty, the current key is kept, or if there is none, a random key
+// is generated.
+func newNonceKey(secret string, current hmacKey) (key hmacKey, err error) {
+	if len(secret) > 0 {
+		key = hmacKey(secret)
+		return
+	}
+	if len(current) > 0 {
+		key = current
+		return
+	}
+
+	key = make([]byte, nonceKeyBytes)
+	if _, err = rand.Read(key); err != nil {
+		key = nil
+	}
+	return
+}
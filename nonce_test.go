@@ -0,0 +1,132 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNonceKey returns a fresh nonce key, and forgets the used nonces.
+func testNonceKey(t *testing.T) hmacKey {
+	t.Helper()
+	key, err := newNonceKey("", nil)
+	if err != nil {
+		t.Fatalf("newNonceKey: %v", err)
+	}
+	usedNonces = make(map[string]int64)
+	return key
+}
+
+func TestCheckNonce(t *testing.T) {
+	key := testNonceKey(t)
+	now := time.Now()
+
+	nonce, err := newNonce(key, now)
+	if err != nil {
+		t.Fatalf("newNonce: %v", err)
+	}
+	if err := checkNonce(key, nonce, now); err != nil {
+		t.Errorf("valid nonce was rejected: %v", err)
+	}
+	if err := checkNonce(key, nonce, now); err == nil {
+		t.Error("reused nonce was accepted")
+	}
+
+	expired, err := newNonce(key, now.Add(-NonceMaxAge-time.Second))
+	if err != nil {
+		t.Fatalf("newNonce: %v", err)
+	}
+	if err := checkNonce(key, expired, now); err == nil || err.(*HTTPError).Message != errNonceExpired {
+		t.Errorf("expired nonce: got %v, want %q", err, errNonceExpired)
+	}
+
+	// A nonce whose expiration time has been extended no longer matches its
+	// signature.
+	fresh, err := newNonce(key, now)
+	if err != nil {
+		t.Fatalf("newNonce: %v", err)
+	}
+	fields := strings.SplitN(fresh, ".", 2)
+	forged := "9999999999." + fields[1]
+	if err := checkNonce(key, forged, now); err == nil {
+		t.Error("nonce with a forged expiration time was accepted")
+	}
+
+	// Nonces signed with another key, such as by another process, or with
+	// the private key, are rejected.
+	if err := checkNonce(testNonceKey(t), fresh, now); err == nil {
+		t.Error("nonce signed with another key was accepted")
+	}
+	pk, _ := testSigningKey(t)
+	payload := fields[0] + "." + strings.SplitN(fields[1], ".", 2)[0]
+	sig, err := pk.SignMessage([]byte(payload))
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if err := checkNonce(key, payload+"."+base64.RawURLEncoding.EncodeToString(sig), now); err == nil {
+		t.Error("nonce signed with the private key was accepted")
+	}
+}
+
+func TestNonceHandler(t *testing.T) {
+	key := testNonceKey(t)
+	withSettingsUpdate(t, func(s *settings) { s.nonceKey = key })
+
+	w := httptest.NewRecorder()
+	Nonce(w, httptest.NewRequest("GET", "/nonce", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cacheControl)
+	}
+	var response NonceResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if err := checkNonce(key, response.Nonce, time.Now()); err != nil {
+		t.Errorf("issued nonce was rejected: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	Nonce(w, httptest.NewRequest("POST", "/nonce", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestValidateNonceSecret(t *testing.T) {
+	var config Configuration
+	config.NonceUrl = "/nonce"
+	config.NonceSecret = "short"
+	if err := validateNonceUrl(&config, newSettings()); err == nil {
+		t.Error("short nonce secret was accepted")
+	}
+
+	config.NonceSecret = strings.Repeat("s", 32)
+	s := newSettings()
+	if err := validateNonceUrl(&config, s); err != nil {
+		t.Fatalf("validateNonceUrl: %v", err)
+	}
+	nonce, err := newNonce(s.nonceKey, time.Now())
+	if err != nil {
+		t.Fatalf("newNonce: %v", err)
+	}
+
+	// Another process with the same secret accepts the nonce.
+	other := newSettings()
+	if err := validateNonceUrl(&config, other); err != nil {
+		t.Fatalf("validateNonceUrl: %v", err)
+	}
+	if err := checkNonce(other.nonceKey, nonce, time.Now()); err != nil {
+		t.Errorf("nonce signed with the configured secret was rejected: %v", err)
+	}
+}
@@ -6,10 +6,15 @@
 package persona
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Templates used to render the authentication and provisioning pages.
@@ -18,12 +23,51 @@ var (
 	ProvisioningTemplate   *template.Template
 )
 
-// Parameters passed to the authentication and provisioning templates.
+// TemplateFuncs are the functions made available to the authentication and
+// provisioning templates. It must be set before the configuration is loaded.
+var TemplateFuncs = template.FuncMap{}
+
+// Parameters passed to the authentication and provisioning templates. Each
+// request also passes the values described by templateParams. Once requests
+// are being served, the maps must only be modified with
+// SetAuthenticationTemplateParam and SetProvisioningTemplateParam.
 var (
 	AuthenticationTemplateParams = make(map[string]interface{})
 	ProvisioningTemplateParams   = make(map[string]interface{})
 )
 
+// templateParamsMutex guards AuthenticationTemplateParams and
+// ProvisioningTemplateParams, which are copied for each request.
+var templateParamsMutex sync.RWMutex
+
+// SetAuthenticationTemplateParam sets a parameter passed to the
+// authentication template. It is safe to call while requests are served.
+func SetAuthenticationTemplateParam(name string, value interface{}) {
+	templateParamsMutex.Lock()
+	defer templateParamsMutex.Unlock()
+	AuthenticationTemplateParams[name] = value
+}
+
+// SetProvisioningTemplateParam sets a parameter passed to the provisioning
+// template. It is safe to call while requests are served.
+func SetProvisioningTemplateParam(name string, value interface{}) {
+	templateParamsMutex.Lock()
+	defer templateParamsMutex.Unlock()
+	ProvisioningTemplateParams[name] = value
+}
+
+// BatchCertificateResult is an element of a GenerateCertificates response.
+// Exactly one of Certificate and Error is set.
+type BatchCertificateResult struct {
+	Email       string `json:"email,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// MaxBatchCertificates is the maximum number of certificates that a single
+// GenerateCertificates request may request.
+const MaxBatchCertificates = 100
+
 // RequestCheckSession represents the body of a CheckSession request.
 type RequestCheckSession struct {
 	Email string `json:"email"`
@@ -31,21 +75,169 @@ type RequestCheckSession struct {
 
 // RequestGenerateCertificate represents the body of a GenerateCertificate
 // request.
+//
+// Duration is the requested lifetime of the certificate, in seconds. It is
+// capped at the maximum session duration, which is also used if Duration is
+// not positive.
+//
+// Issuer may only be set by trusted callers, and overrides the issuer of the
+// generated certificate.
+//
+// Audience, if set, is the origin of the relying party that the certificate
+// is bound to, and is included in the certificate as its aud claim.
 type RequestGenerateCertificate struct {
 	Email     string            `json:"email"`
 	PublicKey map[string]string `json:"public-key"`
 	Duration  int               `json:"duration,string"`
+	Issuer    string            `json:"iss,omitempty"`
+	Nonce     string            `json:"nonce,omitempty"`
+	Audience  string            `json:"audience,omitempty"`
+
+	// OmitPublicKey requests that the public key is omitted from the
+	// certificate. It is ignored unless the configuration allows it.
+	OmitPublicKey bool `json:"omit-public-key,omitempty"`
+
+	// sessionTTL, if positive, is the remaining lifetime of the session that
+	// authorizes the request, which the certificate must not outlive.
+	sessionTTL time.Duration
+}
+
+// HandlerRegistrar is the interface used to register handlers, and is
+// satisfied by *http.ServeMux.
+type HandlerRegistrar interface {
+	HandleFunc(string, func(http.ResponseWriter, *http.Request))
+}
+
+// RegisterHandlers registers the handlers of the default provider that are
+// enabled by the given configuration with the given registrar.
+func RegisterHandlers(mux HandlerRegistrar, config *Configuration) {
+	DefaultProvider.RegisterHandlers(mux, config)
 }
 
-// BrowserID responds with the BrowserID support document.
-func BrowserID(w http.ResponseWriter, r *http.Request) {
+// RegisterHandlers registers all of the provider's handlers that are enabled
+// by the given configuration with the given registrar. Handlers that depend on
+// the private key or session backing respond with StatusServiceUnavailable
+// (503) until the provider is ready.
+func (p *Provider) RegisterHandlers(mux HandlerRegistrar, config *Configuration) {
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, observeRequests(pattern, logAccess(handler)))
+	}
+
+	handle(SupportDocumentURL, Recover(p.whenReady(compress(p.BrowserID))))
+	if config.HTTP.Root.Enabled {
+		handle("/", Recover(Root))
+	}
+	if config.HTTP.Favicon {
+		handle("/favicon.ico", Recover(Favicon))
+	}
+	if config.Delegation.Delegate {
+		return
+	}
+
+	if !config.Authentication.Disabled {
+		handle(config.Authentication.Url, Recover(p.whenReady(compress(p.Authentication))))
+	}
+	if !config.Provisioning.Disabled {
+		handle(config.Provisioning.Url, Recover(p.whenReady(compress(p.Provisioning))))
+	}
+	handle(config.Session.Url, Recover(p.whenReady(p.CheckSession)))
+	if len(config.Session.StatusUrl) > 0 {
+		handle(config.Session.StatusUrl, Recover(p.whenReady(p.SessionStatus)))
+	}
+	if len(config.Session.LogoutUrl) > 0 {
+		handle(config.Session.LogoutUrl, Recover(p.whenReady(p.Logout)))
+	}
+	if len(config.Session.CreateUrl) > 0 {
+		handle(config.Session.CreateUrl, Recover(p.whenReady(p.CreateSession)))
+	}
+	handle(config.CertificateUrl, Recover(p.whenReady(rateLimit(p.GenerateCertificate))))
+	if len(config.BatchCertificateUrl) > 0 {
+		handle(config.BatchCertificateUrl, Recover(p.whenReady(rateLimit(p.GenerateCertificates))))
+	}
+	if len(config.JwksUrl) > 0 {
+		handle(config.JwksUrl, Recover(p.whenReady(compress(p.JWKS))))
+	}
+	if len(config.NonceUrl) > 0 {
+		handle(config.NonceUrl, Recover(p.whenReady(RateLimit(p.Nonce, NonceRateLimit))))
+	}
+	if len(config.HealthUrl) > 0 {
+		handle(config.HealthUrl, Recover(p.whenReady(p.Health)))
+	}
+}
+
+// Root responds to requests for "/" with either a redirect to the configured
+// URL, or StatusOK (200) and an empty body. All other paths respond with
+// StatusNotFound (404).
+func Root(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		httpError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if r.Method != "HEAD" && r.Method != "GET" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	if redirect := settingsFor(r).rootRedirect; len(redirect) > 0 {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypePlain)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Favicon responds with StatusNoContent (204).
+func Favicon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Error messages.
+const (
+	errBatchNotArray     = "batch certificate request must be a JSON array."
+	errBatchTooLarge     = "batch certificate request must not request more than %d certificates."
+	errTemplateUndefined = "template is undefined."
+	errUserNotAuthorized = "User is not authorized."
+)
+
+// RequestCreateSession represents the body of a CreateSession request.
+type RequestCreateSession struct {
+	Email string `json:"email"`
+}
+
+// SessionStatusResponse is the response to a session status request.
+type SessionStatusResponse struct {
+	Valid     bool  `json:"valid"`
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// BrowserID responds with the BrowserID support document. Conditional requests
+// whose If-None-Match header matches the document's ETag get
+// StatusNotModified (304).
+func (p *Provider) BrowserID(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "HEAD" && r.Method != "GET" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "GET, HEAD")
 		return
 	}
 
+	doc, etag := p.currentSupportDocument()
+	if t := p.tenantFor(r); t != nil {
+		doc, etag = t.supportDoc.json, t.supportDoc.etag
+	}
 	w.Header().Set("Content-Type", ContentTypeJson)
-	w.Write(supportDocJson)
+	w.Header().Set("Cache-Control", SupportDocumentCacheControl)
+	if len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeBody(w, r, doc)
 
 	/*
 		// FIXME: Remove this debugging code.
@@ -65,94 +257,513 @@ func BrowserID(w http.ResponseWriter, r *http.Request) {
 	*/
 }
 
+// JWKS responds with the JWK Set of the default provider.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.JWKS(w, r)
+}
+
+// JWKS responds with the JWK Set of the provider's published public keys.
+func (p *Provider) JWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	jwks, err := p.GenerateJWKS()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	writeBody(w, r, jwks)
+}
+
 // Authentication responds with the authentication page template.
-func Authentication(w http.ResponseWriter, r *http.Request) {
+func (p *Provider) Authentication(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "HEAD" && r.Method != "GET" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "GET, HEAD")
 		return
 	}
 
-	w.Header().Set("Content-Type", ContentTypeHtml)
-	AuthenticationTemplate.Execute(w, AuthenticationTemplateParams)
+	renderPage(w, r, p.authenticationTemplate(settingsFor(r)), AuthenticationTemplateParams)
 }
 
 // Provisioning responds with the provisioning page template.
-func Provisioning(w http.ResponseWriter, r *http.Request) {
+func (p *Provider) Provisioning(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "HEAD" && r.Method != "GET" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "GET, HEAD")
 		return
 	}
 
+	renderPage(w, r, p.provisioningTemplate(settingsFor(r)), ProvisioningTemplateParams)
+}
+
+// renderPage responds with the given page template, executed with the
+// parameters for the request built from base. As the page carries the
+// browser's CSRF token, it is never cached.
+func renderPage(w http.ResponseWriter, r *http.Request, t *template.Template, base map[string]interface{}) {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, r, t, templateParams(r, base, token))
+}
+
+// templateParams returns the parameters to execute a page template with for
+// the request. They are a copy of base, along with the request's email and
+// origin query parameters as Email and Origin, all of its query parameters as
+// Query, and the given CSRF token as CSRFToken. The values in base take
+// precedence, other than CSRFToken.
+func templateParams(r *http.Request, base map[string]interface{}, csrfToken string) map[string]interface{} {
+	query := r.URL.Query()
+	params := map[string]interface{}{
+		"Email":  query.Get("email"),
+		"Origin": query.Get("origin"),
+		"Query":  query,
+	}
+	templateParamsMutex.RLock()
+	for name, value := range base {
+		params[name] = value
+	}
+	templateParamsMutex.RUnlock()
+	params["CSRFToken"] = csrfToken
+	return params
+}
+
+// renderTemplate responds with the given template executed with the given
+// parameters. If the template is undefined or fails to execute, it responds
+// with StatusInternalServerError (500).
+func renderTemplate(w http.ResponseWriter, r *http.Request, t *template.Template, params interface{}) {
+	if t == nil {
+		httpError(w, errTemplateUndefined, http.StatusInternalServerError)
+		return
+	}
+	var page bytes.Buffer
+	if err := t.Execute(&page, params); err != nil {
+		writeError(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", ContentTypeHtml)
-	ProvisioningTemplate.Execute(w, ProvisioningTemplateParams)
+	writeBody(w, r, page.Bytes())
 }
 
 // CheckSession responds with StatusOK (200) if the given user has a valid
-// session, or StatusUnauthorized (401) if not. On error, it responds with
+// session, or StatusUnauthorized (401) if not. If the body or email address
+// is empty or malformed, it responds with StatusBadRequest (400). The body may
+// be JSON or form encoded, and any other Content-Type gets
+// StatusUnsupportedMediaType (415). On error, it responds with
 // StatusInternalServerError (500).
-func CheckSession(w http.ResponseWriter, r *http.Request) {
+func (p *Provider) CheckSession(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "POST")
 		return
 	}
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	defer p.endRequest()
 
-	if sessionBacking == nil {
-		http.Error(w, errSessionBackingUndefined, http.StatusInternalServerError)
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
+		return
+	}
+	var sessionRequest RequestCheckSession
+	err := readRequest(r, &sessionRequest)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// TODO: Support multipart forms as well (or instead of)?
-	body, err := ioutil.ReadAll(r.Body)
+	logAccessEmail(r, sessionRequest.Email)
+	if err = validateEmail(sessionRequest.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = checkAuthenticatedUser(r, sessionRequest.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	hasSession, err := hasSession(r.Context(), p.sessions(), sessionRequest.Email)
+	if err != nil {
+		p.audit(AuditSessionChecked, sessionRequest.Email, err.Error())
+		writeError(w, err)
+		return
+	}
+	observeSessionCheck(hasSession)
+	if !hasSession {
+		p.audit(AuditSessionChecked, sessionRequest.Email, errUserNotAuthorized)
+		unauthorized(w, errUserNotAuthorized)
+		return
+	}
+	p.audit(AuditSessionChecked, sessionRequest.Email, "ok")
+	w.Header().Set("Content-Type", ContentTypePlain)
+	w.WriteHeader(http.StatusOK)
+}
+
+// CreateSession creates a session for the given user, and responds with
+// StatusOK (200). It is intended to be called by the application once its own
+// authentication of the user has succeeded, and as it mints trust, the caller
+// must present the configured session creation secret as a bearer token.
+// Callers without it get StatusUnauthorized (401). The handler should still
+// only be reachable from the application, not from the public internet.
+//
+// If the body or email address is empty or malformed, it responds with
+// StatusBadRequest (400). The body may be JSON or form encoded, and any other
+// Content-Type gets StatusUnsupportedMediaType (415). On error, it responds
+// with StatusInternalServerError (500).
+func (p *Provider) CreateSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	defer p.endRequest()
+
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
+		return
+	}
+	if !hasBearerToken(r, settingsFor(r).createSessionSecret) {
+		unauthorized(w, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	var sessionRequest RequestCreateSession
+	err := readRequest(r, &sessionRequest)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	logAccessEmail(r, sessionRequest.Email)
+	if err = validateEmail(sessionRequest.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err = newSession(r.Context(), p.sessions(), sessionRequest.Email, ""); err != nil {
+		p.audit(AuditSessionCreated, sessionRequest.Email, err.Error())
+		writeError(w, err)
+		return
+	}
+	p.audit(AuditSessionCreated, sessionRequest.Email, "ok")
+	w.Header().Set("Content-Type", ContentTypePlain)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Logout deletes the user's session, and responds with StatusOK (200), even if
+// the user had no session. The caller must either present the configured
+// logout secret as a bearer token, or be a trusted proxy that reports the
+// same user as authenticated. Other callers get StatusUnauthorized (401), and
+// trusted proxies that report a different user get StatusForbidden (403).
+//
+// If the body or email address is empty or malformed, it responds with
+// StatusBadRequest (400). The body may be JSON or form encoded, and any other
+// Content-Type gets StatusUnsupportedMediaType (415). On error, it responds
+// with StatusInternalServerError (500).
+func (p *Provider) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	defer p.endRequest()
+
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
+		return
+	}
+
 	var sessionRequest RequestCheckSession
-	if err = json.Unmarshal(body, &sessionRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := readRequest(r, &sessionRequest)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	logAccessEmail(r, sessionRequest.Email)
+	if err = validateEmail(sessionRequest.Email); err != nil {
+		writeError(w, err)
 		return
 	}
+	if !hasBearerToken(r, settingsFor(r).logoutSecret) {
+		if !isTrustedProxy(r) {
+			unauthorized(w, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		if err = checkAuthenticatedUser(r, sessionRequest.Email); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
 
-	hasSession, err := sessionBacking.HasSession(sessionRequest.Email)
-	if !hasSession {
-		http.Error(w, "User is not authorized.", http.StatusUnauthorized)
+	if err = deleteSession(r.Context(), p.sessions(), sessionRequest.Email); err != nil {
+		writeError(w, err)
 		return
 	}
 	w.Header().Set("Content-Type", ContentTypePlain)
 	w.WriteHeader(http.StatusOK)
 }
 
-// GenerateCertificate responds with a signed identity certificate on success.
-// On error, it responds with StatusInternalServerError (500).
-func GenerateCertificate(w http.ResponseWriter, r *http.Request) {
+// SessionStatus responds with whether the user has a valid session, and how
+// many seconds remain until it expires.
+func (p *Provider) SessionStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if p.rejectShuttingDown(w) {
 		return
 	}
+	defer p.endRequest()
 
-	if sessionBacking == nil {
-		http.Error(w, errSessionBackingUndefined, http.StatusInternalServerError)
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
+		return
+	}
+	if err := checkContentType(r); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// TODO: Support multipart forms as well (or instead of)?
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	var sessionRequest RequestCheckSession
+	if err = unmarshalRequest(body, &sessionRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	logAccessEmail(r, sessionRequest.Email)
+	if err = checkAuthenticatedUser(r, sessionRequest.Email); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ttl, hasSession, err := sessionTTL(r.Context(), p.sessions(), sessionRequest.Email)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := SessionStatusResponse{
+		Valid: hasSession,
+	}
+	if hasSession {
+		status.ExpiresIn = int64(ttl / time.Second)
+	}
+	statusJson, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.Write(statusJson)
+}
+
+// GenerateCertificate responds with a signed identity certificate on success.
+// The certificate is in the JWS compact serialization, unless the client
+// accepts application/jose+json, in which case the flattened JWS JSON
+// serialization is used. If the user does not have a valid session, it
+// responds with StatusUnauthorized (401). If the body or email address is
+// empty or malformed, or the client public key is invalid or not allowed, it
+// responds with StatusBadRequest (400). If the request overrides the issuer
+// without being allowed to, it responds with StatusForbidden (403). The body
+// may be JSON or form encoded, and any other Content-Type gets
+// StatusUnsupportedMediaType (415). On error, it responds with
+// StatusInternalServerError (500).
+func (p *Provider) GenerateCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	defer p.endRequest()
+
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
 		return
 	}
 	var certificateRequest RequestGenerateCertificate
-	if err = json.Unmarshal(body, &certificateRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := readRequest(r, &certificateRequest)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	idCert, err := identityCertificate(certificateRequest)
+	signedCert, err := p.issueCertificate(r, certificateRequest)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+
+	// Signed certificates must never be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if acceptsMediaType(r, "application/jose+json") {
+		var flattened []byte
+		flattened, err = json.Marshal(signedCert)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", ContentTypeJoseJson)
+		w.Write(flattened)
 		return
 	}
 
 	w.Header().Set("Content-Type", ContentTypeJson)
-	w.Write([]byte(idCert))
+	w.Write([]byte(signedCert.Compact()))
+}
+
+// GenerateCertificates responds with a JSON array of BatchCertificateResult,
+// one for each element of the JSON array of RequestGenerateCertificate in the
+// request body. Results are streamed to the client as they are signed. An
+// element that can not be issued is reported as a result with Error set, and
+// the remaining elements are still issued. Only a malformed body stops the
+// stream early, with an error result. At most MaxBatchCertificates
+// certificates are issued, and a request for more ends with an error result.
+func (p *Provider) GenerateCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	defer p.endRequest()
+
+	if p.sessions() == nil {
+		httpError(w, errSessionBackingUndefined, http.StatusInternalServerError)
+		return
+	}
+	if err := checkContentType(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	limitRequestBody(w, r)
+	decoder := json.NewDecoder(r.Body)
+	token, err := decoder.Token()
+	if delim, ok := token.(json.Delim); err != nil || !ok || delim != '[' {
+		httpError(w, errBatchNotArray, http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.Write([]byte("["))
+	for i := 0; decoder.More(); i++ {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+
+		var result BatchCertificateResult
+		var certificateRequest RequestGenerateCertificate
+		var typeErr *json.UnmarshalTypeError
+		stop := false
+		if i == MaxBatchCertificates {
+			err = fmt.Errorf(errBatchTooLarge, MaxBatchCertificates)
+			stop = true
+		} else if err = decoder.Decode(&certificateRequest); err != nil {
+			// An element of the wrong type is skipped over in full, but
+			// after a syntax error, the next element can not be found.
+			stop = !errors.As(err, &typeErr)
+		} else {
+			result.Email = certificateRequest.Email
+			var signedCert SignedIdentityCertificate
+			if signedCert, err = p.issueCertificate(r, certificateRequest); err == nil {
+				result.Certificate = signedCert.Compact()
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if encodeErr := encoder.Encode(result); encodeErr != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if stop {
+			break
+		}
+	}
+	w.Write([]byte("]"))
+}
+
+// issueCertificate validates the certificate request, and returns the signed
+// identity certificate.
+func (p *Provider) issueCertificate(r *http.Request, req RequestGenerateCertificate) (signed SignedIdentityCertificate, err error) {
+	defer func() {
+		if err != nil {
+			p.audit(AuditCertificateRefused, req.Email, err.Error())
+			return
+		}
+		p.audit(AuditCertificateIssued, req.Email, "ok")
+	}()
+
+	s := settingsFor(r)
+	logAccessEmail(r, req.Email)
+	if err = validateEmail(req.Email); err != nil {
+		return
+	}
+	if err = checkAuthenticatedUser(r, req.Email); err != nil {
+		return
+	}
+	if err = validateIssuerOverride(r, req); err != nil {
+		return
+	}
+	if err = validateClientKeyBytes(s, req); err != nil {
+		return
+	}
+	if err = validateAudience(&req); err != nil {
+		return
+	}
+	if err = validatePublicKey(req.PublicKey); err != nil {
+		return
+	}
+	if err = validateClientKeyAlgorithm(s, req); err != nil {
+		return
+	}
+	if err = validateEmailDomain(s, req); err != nil {
+		return
+	}
+	if err = p.validateNonce(s, req); err != nil {
+		return
+	}
+
+	// Certificates are only issued to users with a valid session.
+	ttl, hasSession, err := sessionTTL(r.Context(), p.sessions(), req.Email)
+	if err != nil {
+		return
+	}
+	if !hasSession {
+		err = &HTTPError{
+			Code:    http.StatusUnauthorized,
+			Message: errUserNotAuthorized,
+		}
+		return
+	}
+	if s.clampToSession {
+		req.sessionTTL = ttl
+	}
+
+	key, issuer := p.signer(r)
+	return signIdentityCertificate(s, req, key, issuer)
 }
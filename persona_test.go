@@ -0,0 +1,620 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider returns a provider that uses a fresh memory session backing.
+func testProvider(t *testing.T) *Provider {
+	t.Helper()
+	backing := &MemoryBacking{}
+	if err := backing.Open(""); err != nil {
+		t.Fatalf("MemoryBacking.Open: %v", err)
+	}
+	t.Cleanup(func() { backing.Close() })
+	return &Provider{SessionBacking: backing}
+}
+
+func TestLogout(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	withSettingsUpdate(t, func(s *settings) {
+		s.logoutSecret = "logout-secret"
+		s.trustedProxies = []*net.IPNet{loopback}
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		body       string
+		status     int
+		deleted    bool
+	}{
+		{"secret", "192.0.2.1:1234", "Authorization", "Bearer logout-secret", `{"email":"user@example.com"}`, http.StatusOK, true},
+		{"no session", "192.0.2.1:1234", "Authorization", "Bearer logout-secret", `{"email":"other@example.com"}`, http.StatusOK, false},
+		{"wrong secret", "192.0.2.1:1234", "Authorization", "Bearer wrong", `{"email":"user@example.com"}`, http.StatusUnauthorized, false},
+		{"unauthenticated", "192.0.2.1:1234", "", "", `{"email":"user@example.com"}`, http.StatusUnauthorized, false},
+		{"same user", "127.0.0.1:1234", DefaultAuthenticatedUserHeader, "User@Example.com", `{"email":"user@example.com"}`, http.StatusOK, true},
+		{"other user", "127.0.0.1:1234", DefaultAuthenticatedUserHeader, "other@example.com", `{"email":"user@example.com"}`, http.StatusForbidden, false},
+		{"invalid email", "192.0.2.1:1234", "Authorization", "Bearer logout-secret", `{"email":"user"}`, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		p := testProvider(t)
+		if err := p.sessions().NewSession("user@example.com", ""); err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+
+		r := httptest.NewRequest("POST", "/logout", strings.NewReader(test.body))
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("Content-Type", ContentTypeJson)
+		if len(test.header) > 0 {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		p.Logout(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+		has, err := p.sessions().HasSession("user@example.com")
+		if err != nil {
+			t.Fatalf("%s: HasSession: %v", test.name, err)
+		}
+		if has == test.deleted {
+			t.Errorf("%s: session exists = %v, want %v", test.name, has, !test.deleted)
+		}
+	}
+}
+
+func TestLogoutForm(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.logoutSecret = "logout-secret" })
+
+	p := testProvider(t)
+	p.sessions().NewSession("user@example.com", "")
+	r := httptest.NewRequest("POST", "/logout", strings.NewReader("email=user%40example.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer logout-secret")
+	w := httptest.NewRecorder()
+	p.Logout(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if has, _ := p.sessions().HasSession("user@example.com"); has {
+		t.Error("session was not deleted")
+	}
+}
+
+func TestValidateSessionLogoutSecret(t *testing.T) {
+	var config Configuration
+	config.Session.Url = "/session"
+	config.Session.LogoutUrl = "/logout"
+	if err := validateSession(&config, newSettings()); err == nil || err.Error() != errLogoutSecretRequired {
+		t.Errorf("validateSession without a logout secret = %v, want %q", err, errLogoutSecretRequired)
+	}
+}
+
+// failingBacking is a session backing whose every operation fails.
+type failingBacking struct{}
+
+func (failingBacking) Open(string) error               { return nil }
+func (failingBacking) Close() error                    { return nil }
+func (failingBacking) NewSession(string, string) error { return errBackingFailed }
+func (failingBacking) HasSession(string) (bool, error) { return false, errBackingFailed }
+func (failingBacking) DeleteSession(string) error      { return errBackingFailed }
+func (failingBacking) SessionTTL(string) (time.Duration, bool, error) {
+	return 0, false, errBackingFailed
+}
+
+var errBackingFailed = errors.New("backing failed")
+
+// postRequest returns a POST request with the given JSON body and headers.
+func postRequest(path, body string, headers ...string) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", ContentTypeJson)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestCheckSession(t *testing.T) {
+	p := testProvider(t)
+	if err := p.sessions().NewSession("user@example.com", ""); err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"session", "POST", ContentTypeJson, `{"email":"user@example.com"}`, http.StatusOK},
+		{"no session", "POST", ContentTypeJson, `{"email":"other@example.com"}`, http.StatusUnauthorized},
+		{"form", "POST", "application/x-www-form-urlencoded", "email=user%40example.com", http.StatusOK},
+		{"invalid email", "POST", ContentTypeJson, `{"email":"user"}`, http.StatusBadRequest},
+		{"empty body", "POST", ContentTypeJson, "", http.StatusBadRequest},
+		{"malformed body", "POST", ContentTypeJson, `{"email":`, http.StatusBadRequest},
+		{"unsupported media type", "POST", "text/plain", `{"email":"user@example.com"}`, http.StatusUnsupportedMediaType},
+		{"method", "GET", ContentTypeJson, "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/session", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		p.CheckSession(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestCheckSessionBackingError(t *testing.T) {
+	p := &Provider{SessionBacking: failingBacking{}}
+	w := httptest.NewRecorder()
+	p.CheckSession(w, postRequest("/session", `{"email":"user@example.com"}`))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	w = httptest.NewRecorder()
+	(&Provider{}).CheckSession(w, postRequest("/session", `{"email":"user@example.com"}`))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status without a backing = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestCheckSessionAuthenticatedUser(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	withSettingsUpdate(t, func(s *settings) { s.trustedProxies = []*net.IPNet{loopback} })
+	p := testProvider(t)
+	p.sessions().NewSession("user@example.com", "")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		user       string
+		status     int
+	}{
+		{"matching header", "127.0.0.1:1234", "User@Example.com", http.StatusOK},
+		{"mismatching header", "127.0.0.1:1234", "other@example.com", http.StatusForbidden},
+		{"untrusted proxy", "192.0.2.1:1234", "other@example.com", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := postRequest("/session", `{"email":"user@example.com"}`, DefaultAuthenticatedUserHeader, test.user)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		p.CheckSession(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestCreateSession(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.createSessionSecret = "create-secret" })
+	p := testProvider(t)
+
+	w := httptest.NewRecorder()
+	p.CreateSession(w, postRequest("/session/create", `{"email":"user@example.com"}`))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without the secret = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	p.CreateSession(w, postRequest("/session/create", `{"email":"user"}`, "Authorization", "Bearer create-secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status with an invalid email = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	p.CreateSession(w, postRequest("/session/create", `{"email":"user@example.com"}`, "Authorization", "Bearer create-secret"))
+	if w.Code != http.StatusOK {
+		t.Errorf("status with the secret = %d, want %d", w.Code, http.StatusOK)
+	}
+	if has, _ := p.sessions().HasSession("user@example.com"); !has {
+		t.Error("session was not created")
+	}
+
+	w = httptest.NewRecorder()
+	(&Provider{SessionBacking: failingBacking{}}).CreateSession(w, postRequest("/session/create", `{"email":"user@example.com"}`, "Authorization", "Bearer create-secret"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status with a failing backing = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+// testCertificateProvider returns a provider that signs certificates for
+// example.com, with a session for user@example.com.
+func testCertificateProvider(t *testing.T) *Provider {
+	t.Helper()
+	p := testProvider(t)
+	p.key, _ = testSigningKey(t)
+	p.Issuer = "example.com"
+	if err := p.sessions().NewSession("user@example.com", ""); err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	return p
+}
+
+const testCertificateBody = `{"email":"user@example.com","public-key":{"algorithm":"RS","n":"1","e":"65537"},"duration":"3600"}`
+
+func TestGenerateCertificate(t *testing.T) {
+	p := testCertificateProvider(t)
+
+	w := httptest.NewRecorder()
+	p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if parts := strings.Split(w.Body.String(), "."); len(parts) != 3 {
+		t.Errorf("certificate %q is not in the compact serialization", w.Body)
+	}
+	if cacheControl, pragma := w.Header().Get("Cache-Control"), w.Header().Get("Pragma"); cacheControl != "no-store" || pragma != "no-cache" {
+		t.Errorf("Cache-Control = %q and Pragma = %q, want no-store and no-cache", cacheControl, pragma)
+	}
+
+	w = httptest.NewRecorder()
+	p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody, "Accept", ContentTypeJoseJson))
+	if contentType := w.Header().Get("Content-Type"); contentType != ContentTypeJoseJson {
+		t.Errorf("Content-Type = %q, want %q", contentType, ContentTypeJoseJson)
+	}
+	var signed SignedIdentityCertificate
+	if err := json.Unmarshal(w.Body.Bytes(), &signed); err != nil || len(signed.Signature) == 0 {
+		t.Errorf("flattened certificate %s did not decode: %v", w.Body, err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no session", strings.Replace(testCertificateBody, "user@", "other@", 1), http.StatusUnauthorized},
+		{"invalid email", strings.Replace(testCertificateBody, "user@example.com", "user", 1), http.StatusBadRequest},
+		{"malformed public key", strings.Replace(testCertificateBody, `"n":"1"`, `"n":"x"`, 1), http.StatusBadRequest},
+		{"unknown algorithm", strings.Replace(testCertificateBody, `"RS"`, `"XX"`, 1), http.StatusBadRequest},
+		{"issuer override", strings.Replace(testCertificateBody, "{", `{"iss":"other.example.com",`, 1), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		p.GenerateCertificate(w, postRequest("/certificate", test.body))
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	(&Provider{SessionBacking: failingBacking{}, key: p.key, Issuer: p.Issuer}).GenerateCertificate(w, postRequest("/certificate", testCertificateBody))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status with a failing backing = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestGenerateCertificateIssuerOverride(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) {
+		s.trustedCallerSecret = "caller-secret"
+		s.allowedIssuers = map[string]bool{"other.example.com": true}
+	})
+	p := testCertificateProvider(t)
+
+	tests := []struct {
+		issuer string
+		status int
+	}{
+		{"other.example.com", http.StatusOK},
+		{"evil.example.com", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		body := strings.Replace(testCertificateBody, "{", `{"iss":"`+test.issuer+`",`, 1)
+		w := httptest.NewRecorder()
+		p.GenerateCertificate(w, postRequest("/certificate", body, "Authorization", "Bearer caller-secret", "Accept", ContentTypeJoseJson))
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.issuer, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var signed SignedIdentityCertificate
+		json.Unmarshal(w.Body.Bytes(), &signed)
+		if iss := certificatePayload(t, signed)["iss"]; iss != test.issuer {
+			t.Errorf("iss = %v, want %s", iss, test.issuer)
+		}
+	}
+}
+
+func TestGenerateCertificateClientKeyAlgorithm(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) {
+		s.allowedClientKeyAlgorithms = map[string]bool{"DS": true}
+	})
+	p := testCertificateProvider(t)
+
+	w := httptest.NewRecorder()
+	p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if want := fmt.Sprintf(errClientKeyNotAllowed, "RS"); !strings.Contains(w.Body.String(), want) {
+		t.Errorf("body = %q, want %q", w.Body, want)
+	}
+}
+
+func TestGenerateCertificateHookRejects(t *testing.T) {
+	defer func() { CertificateHook = nil }()
+	p := testCertificateProvider(t)
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&HTTPError{Code: http.StatusForbidden, Message: "user is suspended"}, http.StatusForbidden},
+		{errors.New("directory is unavailable"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		var hooked string
+		CertificateHook = func(cert *IdentityCertificate) error {
+			hooked = cert.Principal.Email
+			return test.err
+		}
+
+		w := httptest.NewRecorder()
+		p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody))
+		if hooked != "user@example.com" {
+			t.Errorf("hook was called for %q, want user@example.com", hooked)
+		}
+		if w.Code != test.status {
+			t.Errorf("status for %v = %d, want %d", test.err, w.Code, test.status)
+		}
+		if !strings.Contains(w.Body.String(), test.err.Error()) {
+			t.Errorf("body = %q, want the hook's error %q", w.Body, test.err)
+		}
+	}
+}
+
+func TestGenerateCertificateHookAnnotates(t *testing.T) {
+	defer func() { CertificateHook = nil }()
+	var exp int64
+	CertificateHook = func(cert *IdentityCertificate) error {
+		cert.Extra = map[string]interface{}{"tenant": "a"}
+		cert.Exp -= 60 * 1000
+		exp = cert.Exp
+		return nil
+	}
+	p := testCertificateProvider(t)
+
+	w := httptest.NewRecorder()
+	p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody, "Accept", ContentTypeJoseJson))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var signed SignedIdentityCertificate
+	if err := json.Unmarshal(w.Body.Bytes(), &signed); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	payload := certificatePayload(t, signed)
+	if payload["tenant"] != "a" {
+		t.Errorf("payload %v does not carry the hook's claim", payload)
+	}
+	var cert IdentityCertificate
+	payloadJson, _ := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err := json.Unmarshal(payloadJson, &cert); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if cert.Exp != exp {
+		t.Errorf("exp = %d, want the hook's earlier expiration %d", cert.Exp, exp)
+	}
+	if err := VerifyCertificate(signed.Compact(), &p.key.key.(*ecdsa.PrivateKey).PublicKey); err != nil {
+		t.Errorf("annotated certificate did not verify: %v", err)
+	}
+}
+
+func TestGenerateCertificateEncodingFails(t *testing.T) {
+	defer func() { CertificateHook = nil }()
+	// The header is encoded before the payload, which can not be encoded
+	// with a claim that has no JSON representation.
+	CertificateHook = func(cert *IdentityCertificate) error {
+		cert.Extra = map[string]interface{}{"unencodable": make(chan int)}
+		return nil
+	}
+	p := testCertificateProvider(t)
+
+	for _, accept := range []string{"", ContentTypeJoseJson} {
+		w := httptest.NewRecorder()
+		p.GenerateCertificate(w, postRequest("/certificate", testCertificateBody, "Accept", accept))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("status with Accept %q = %d, want %d", accept, w.Code, http.StatusInternalServerError)
+		}
+		// Encoded JSON objects, such as the header, begin with "eyJ".
+		if strings.Contains(w.Body.String(), "eyJ") || strings.Contains(w.Body.String(), `"protected"`) {
+			t.Errorf("body with Accept %q = %q, want no part of the certificate", accept, w.Body)
+		}
+	}
+}
+
+func TestGenerateCertificatesPerElementErrors(t *testing.T) {
+	p := testCertificateProvider(t)
+	elements := []string{
+		testCertificateBody,
+		strings.Replace(testCertificateBody, "user@", "other@", 1),
+		`"not a request"`,
+		testCertificateBody,
+	}
+	w := httptest.NewRecorder()
+	p.GenerateCertificates(w, postRequest("/certificates", "["+strings.Join(elements, ",")+"]"))
+
+	var results []BatchCertificateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("results %s did not decode: %v", w.Body, err)
+	}
+	if len(results) != len(elements) {
+		t.Fatalf("got %d results, want %d: %s", len(results), len(elements), w.Body)
+	}
+	for i, failed := range []bool{false, true, true, false} {
+		if (len(results[i].Error) > 0) != failed || (len(results[i].Certificate) == 0) != failed {
+			t.Errorf("result %d = %+v, want failed %v", i, results[i], failed)
+		}
+	}
+
+	// A syntax error ends the stream, as the next element can not be found.
+	w = httptest.NewRecorder()
+	p.GenerateCertificates(w, postRequest("/certificates", "["+testCertificateBody+`,{"email":,`+testCertificateBody+"]"))
+	results = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("results %s did not decode: %v", w.Body, err)
+	}
+	if len(results) != 2 || len(results[0].Certificate) == 0 || len(results[1].Error) == 0 {
+		t.Errorf("results = %+v, want a certificate and then an error", results)
+	}
+}
+
+func TestGenerateCertificatesStreams(t *testing.T) {
+	p := testCertificateProvider(t)
+	// HTTP/2 lets the response be read while the request is still being
+	// sent.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(p.GenerateCertificates))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go bodyWriter.Write([]byte("[" + testCertificateBody))
+	resp, err := server.Client().Post(server.URL, ContentTypeJson, body)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The first result arrives while the rest of the request is still being
+	// sent.
+	decoder := json.NewDecoder(resp.Body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		t.Fatalf("first token = %v, %v; want [", token, err)
+	}
+	var result BatchCertificateResult
+	if err := decoder.Decode(&result); err != nil || len(result.Certificate) == 0 {
+		t.Fatalf("first result = %+v, %v; want a certificate", result, err)
+	}
+
+	go func() {
+		bodyWriter.Write([]byte("," + strings.Replace(testCertificateBody, "user@", "other@", 1) + "]"))
+		bodyWriter.Close()
+	}()
+	result = BatchCertificateResult{}
+	if err := decoder.Decode(&result); err != nil || len(result.Error) == 0 {
+		t.Errorf("second result = %+v, %v; want an error", result, err)
+	}
+	if token, err := decoder.Token(); err != nil || token != json.Delim(']') {
+		t.Errorf("last token = %v, %v; want ]", token, err)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/", http.StatusOK},
+		{"HEAD", "/", http.StatusOK},
+		{"POST", "/", http.StatusMethodNotAllowed},
+		{"GET", "/missing", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		Root(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s: status = %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+	}
+
+	withSettingsUpdate(t, func(s *settings) { s.rootRedirect = "https://example.com/" })
+	w := httptest.NewRecorder()
+	Root(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/" {
+		t.Errorf("redirect: status = %d, Location = %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	Favicon(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("favicon: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestAuthenticationWithoutTemplate(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.authenticationTemplate = nil })
+	defer func(t *template.Template) { AuthenticationTemplate = t }(AuthenticationTemplate)
+	AuthenticationTemplate = nil
+
+	w := httptest.NewRecorder()
+	(&Provider{}).Authentication(w, httptest.NewRequest("GET", "/auth", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestTemplateParamsConcurrentUpdates(t *testing.T) {
+	defer delete(AuthenticationTemplateParams, "Counter")
+	tmpl := template.Must(template.New("auth").Parse(`{{.Counter}}`))
+	p := &Provider{AuthenticationTemplate: tmpl}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				SetAuthenticationTemplateParam("Counter", i*j)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				p.Authentication(w, httptest.NewRequest("GET", "/auth", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	TemplateFuncs["shout"] = strings.ToUpper
+	defer delete(TemplateFuncs, "shout")
+
+	tmpl, err := ParseTemplate("auth", `{{shout .URL}}`)
+	if err != nil {
+		t.Fatalf("ParseTemplate: %v", err)
+	}
+	var page strings.Builder
+	if err := tmpl.Execute(&page, map[string]string{"URL": "/auth"}); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if page.String() != "/AUTH" {
+		t.Errorf("page = %q, want %q", page.String(), "/AUTH")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Error messages.
+const (
+	errIncorrectPassphrase      = "incorrect passphrase, or corrupt encrypted private key."
+	errPKCS8IterationsTooHigh   = "encrypted PKCS#8 key derivation iteration count %d exceeds the maximum of %d."
+	errUnsupportedPKCS8Cipher   = "unsupported encrypted PKCS#8 cipher."
+	errUnsupportedPKCS8Function = "unsupported encrypted PKCS#8 key derivation function."
+	errUnsupportedPKCS8Scheme   = "unsupported encrypted PKCS#8 encryption scheme."
+)
+
+// Object identifiers of the algorithms used by encrypted PKCS#8 private keys.
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// maxPBKDF2Iterations is the maximum PBKDF2 iteration count of encrypted
+// PKCS#8 private keys, so that a crafted key can not stall the process.
+const maxPBKDF2Iterations = 10000000
+
+// pbkdf2Hashes is an object identifier-to-hash mapping of the pseudorandom
+// functions supported by PBKDF2.
+var pbkdf2Hashes = map[string]func() hash.Hash{
+	oidHMACWithSHA1.String():   sha1.New,
+	oidHMACWithSHA224.String(): sha256.New224,
+	oidHMACWithSHA256.String(): sha256.New,
+	oidHMACWithSHA384.String(): sha512.New384,
+	oidHMACWithSHA512.String(): sha512.New,
+}
+
+// pkcs8EncryptedPrivateKey is the ASN.1 structure of an encrypted PKCS#8
+// private key, in PEM blocks of type "ENCRYPTED PRIVATE KEY".
+type pkcs8EncryptedPrivateKey struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Parameters is the ASN.1 structure of the PBES2 encryption scheme
+// parameters.
+type pbes2Parameters struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Parameters is the ASN.1 structure of the PBKDF2 key derivation
+// function parameters. If PRF is omitted, HMAC-SHA1 is used.
+type pbkdf2Parameters struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DecryptPKCS8PrivateKey decrypts an encrypted PKCS#8 private key with the
+// given passphrase, and returns the DER encoded PKCS#8 private key within it.
+// Only the PBES2 encryption scheme is supported, with PBKDF2 and either AES
+// or Triple DES in CBC mode, as OpenSSL writes by default.
+func DecryptPKCS8PrivateKey(der, passphrase []byte) ([]byte, error) {
+	var encrypted pkcs8EncryptedPrivateKey
+	if _, err := asn1.Unmarshal(der, &encrypted); err != nil {
+		return nil, err
+	}
+	if !encrypted.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New(errUnsupportedPKCS8Scheme)
+	}
+	var params pbes2Parameters
+	if _, err := asn1.Unmarshal(encrypted.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	// Select the cipher.
+	var keyLength int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, errors.New(errUnsupportedPKCS8Cipher)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	// Derive the key.
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New(errUnsupportedPKCS8Function)
+	}
+	var kdfParams pbkdf2Parameters
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, err
+	}
+	prf := sha1.New
+	if len(kdfParams.PRF.Algorithm) > 0 {
+		var ok bool
+		if prf, ok = pbkdf2Hashes[kdfParams.PRF.Algorithm.String()]; !ok {
+			return nil, errors.New(errUnsupportedPKCS8Function)
+		}
+	}
+	if kdfParams.IterationCount < 1 || (kdfParams.KeyLength != 0 && kdfParams.KeyLength != keyLength) {
+		return nil, errors.New(errUnsupportedPKCS8Function)
+	}
+	if kdfParams.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf(errPKCS8IterationsTooHigh, kdfParams.IterationCount, maxPBKDF2Iterations)
+	}
+	key := pbkdf2.Key(passphrase, kdfParams.Salt, kdfParams.IterationCount, keyLength, prf)
+
+	// Decrypt the private key.
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := encrypted.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New(errIncorrectPassphrase)
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	// Remove the padding, which is the only check of the passphrase.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New(errIncorrectPassphrase)
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
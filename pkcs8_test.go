@@ -0,0 +1,118 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptPKCS8 encrypts the DER encoded PKCS#8 private key with the
+// passphrase, using PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func encryptPKCS8(t *testing.T, der, passphrase []byte, iterations int) []byte {
+	t.Helper()
+	salt := make([]byte, 8)
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	rand.Read(iv)
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New))
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plaintext := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plaintext)
+
+	marshal := func(v interface{}) asn1.RawValue {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatalf("asn1.Marshal: %v", err)
+		}
+		return asn1.RawValue{FullBytes: b}
+	}
+	params := pbes2Parameters{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm: oidPBKDF2,
+			Parameters: marshal(pbkdf2Parameters{
+				Salt:           salt,
+				IterationCount: iterations,
+				PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+			}),
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: marshal(iv),
+		},
+	}
+	out, err := asn1.Marshal(pkcs8EncryptedPrivateKey{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: marshal(params)},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+	return out
+}
+
+func TestDecryptPKCS8PrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+	}
+	encrypted := encryptPKCS8(t, der, []byte("passphrase"), 2048)
+
+	decrypted, err := DecryptPKCS8PrivateKey(encrypted, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("DecryptPKCS8PrivateKey: %v", err)
+	}
+	if !bytes.Equal(decrypted, der) {
+		t.Error("decrypted key does not match the original")
+	}
+	// The padding check can pass by chance, but never with the key.
+	if decrypted, err := DecryptPKCS8PrivateKey(encrypted, []byte("wrong")); err == nil && bytes.Equal(decrypted, der) {
+		t.Error("wrong passphrase decrypted the key")
+	}
+}
+
+func TestDecryptPKCS8PrivateKeyIterationLimit(t *testing.T) {
+	encrypted := encryptPKCS8(t, []byte("key"), []byte("passphrase"), 1)
+
+	// Raise the iteration count without paying for the derivation.
+	var outer pkcs8EncryptedPrivateKey
+	asn1.Unmarshal(encrypted, &outer)
+	var params pbes2Parameters
+	asn1.Unmarshal(outer.Algorithm.Parameters.FullBytes, &params)
+	var kdfParams pbkdf2Parameters
+	asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams)
+	kdfParams.IterationCount = maxPBKDF2Iterations + 1
+	kdf, _ := asn1.Marshal(kdfParams)
+	params.KeyDerivationFunc.Parameters = asn1.RawValue{FullBytes: kdf}
+	pbes2, _ := asn1.Marshal(params)
+	outer.Algorithm.Parameters = asn1.RawValue{FullBytes: pbes2}
+	encrypted, _ = asn1.Marshal(outer)
+
+	want := fmt.Sprintf(errPKCS8IterationsTooHigh, maxPBKDF2Iterations+1, maxPBKDF2Iterations)
+	if _, err := DecryptPKCS8PrivateKey(encrypted, []byte("passphrase")); err == nil || err.Error() != want {
+		t.Errorf("DecryptPKCS8PrivateKey = %v, want %q", err, want)
+	}
+}
@@ -5,30 +5,57 @@
 package persona
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Minimum supported key sizes.
 const (
-	MinKeySizeDSA = 2048
-	MinKeySizeRSA = 2048
+	MinKeySizeDSA  = 2048
+	MinKeySizeHMAC = 256
+	MinKeySizeRSA  = 2048
 )
 
 // Error messages.
 const (
+	errDigestSigningNotSupported = "HMAC keys can only sign with SignMessage."
+	errJWKNotSupported           = "%s public keys can not be represented as a JWK."
+	errInvalidKeyValidity        = "private key validity period is invalid."
+	errMalformedPublicKey        = "public key parameter '%s' is malformed."
+	errNoEligiblePrivateKey      = "no private key is valid at %s."
 	errPrivateKeyTooSmall        = "private key is %d bits, should be at least %d bits."
 	errPrivateKeyUndefined       = "private key is undefined."
+	errUnsupportedDSAParameters  = "DSA parameters of %d and %d bits are not supported."
 	errUnsupportedEllipticCurve  = "unsupported elliptic curve."
 	errUnsupportedPrivateKeyType = "unsupported private key type."
 )
 
+// DSAParameterHashes is a mapping of the supported DSA parameter sizes, as the
+// bit lengths of P and Q, to the hash used to create the digest that is
+// signed. DSA algorithms are named after the size of P, so each size of P is
+// paired with the one size of Q whose hash the algorithm name implies to
+// verifiers: DS256 signs SHA-256 digests.
+var DSAParameterHashes = map[[2]int]crypto.Hash{
+	{2048, 256}: crypto.SHA256,
+}
+
 // SupportedEllipticCurves is a curve-to-label mapping of the supported
 // elliptic curves.
 var SupportedEllipticCurves = map[elliptic.Curve]string{
@@ -38,11 +65,38 @@ var SupportedEllipticCurves = map[elliptic.Curve]string{
 	elliptic.P521(): "P-521",
 }
 
+// EllipticCurveHashes is a curve-to-hash mapping of the hash used to create
+// the digest that is signed when using each of the supported elliptic curves.
+var EllipticCurveHashes = map[elliptic.Curve]crypto.Hash{
+	elliptic.P224(): crypto.SHA224,
+	elliptic.P256(): crypto.SHA256,
+	elliptic.P384(): crypto.SHA384,
+	elliptic.P521(): crypto.SHA512,
+}
+
 // PrivateKey represents the private key that is used for all of Persona's
 // cryptographic operations.
 type PrivateKey struct {
 	key        interface{}
-	supportDoc interface{}
+	supportDoc PublicKeyDoc
+	retiredAt  time.Time
+	notBefore  time.Time
+	notAfter   time.Time
+
+	// pss is whether an RSA key signs with RSASSA-PSS, as configured when
+	// the key was loaded.
+	pss bool
+}
+
+// hmacKey is a shared secret used to sign certificates with HMAC-SHA256.
+type hmacKey []byte
+
+// PublicKeyDoc is the public-key component of the support document.
+type PublicKeyDoc interface {
+	// KeyAlgorithm returns the Persona algorithm identifier of the key.
+	KeyAlgorithm() string
+	// MarshalJWK returns the key encoded as a JSON Web Key.
+	MarshalJWK() ([]byte, error)
 }
 
 // PublicKeyDSA represents a DSA public key.
@@ -54,6 +108,18 @@ type PublicKeyDSA struct {
 	Y         string `json:"y"`
 }
 
+// KeyAlgorithm implements the KeyAlgorithm method of the PublicKeyDoc
+// interface.
+func (pub PublicKeyDSA) KeyAlgorithm() string {
+	return pub.Algorithm
+}
+
+// MarshalJWK implements the MarshalJWK method of the PublicKeyDoc interface.
+// DSA keys have no JWK representation, so this always returns an error.
+func (pub PublicKeyDSA) MarshalJWK() ([]byte, error) {
+	return nil, fmt.Errorf(errJWKNotSupported, "DSA")
+}
+
 // PublicKeyECDSA represents an ECDSA public key.
 // FIXME: I'm not 100% certain that the parameters here are correct.
 type PublicKeyECDSA struct {
@@ -63,6 +129,41 @@ type PublicKeyECDSA struct {
 	Y         string `json:"y"`
 }
 
+// KeyAlgorithm implements the KeyAlgorithm method of the PublicKeyDoc
+// interface.
+func (pub PublicKeyECDSA) KeyAlgorithm() string {
+	return pub.Algorithm
+}
+
+// MarshalJWK implements the MarshalJWK method of the PublicKeyDoc interface.
+func (pub PublicKeyECDSA) MarshalJWK() ([]byte, error) {
+	var size int
+	for curve, label := range SupportedEllipticCurves {
+		if label == pub.Curve {
+			size = (curve.Params().BitSize + 7) / 8
+			break
+		}
+	}
+	if size == 0 {
+		return nil, fmt.Errorf(errUnsupportedEllipticCurve)
+	}
+	x, err := decimalToBase64(pub.X, size, "x")
+	if err != nil {
+		return nil, err
+	}
+	y, err := decimalToBase64(pub.Y, size, "y")
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{
+		"kty": "EC",
+		"crv": pub.Curve,
+		"x":   x,
+		"y":   y,
+	})
+}
+
 // PublicKeyRSA represents an RSA public key.
 type PublicKeyRSA struct {
 	Algorithm string `json:"algorithm"`
@@ -70,18 +171,173 @@ type PublicKeyRSA struct {
 	E         string `json:"e"`
 }
 
-var privateKey *PrivateKey
+// KeyAlgorithm implements the KeyAlgorithm method of the PublicKeyDoc
+// interface.
+func (pub PublicKeyRSA) KeyAlgorithm() string {
+	return pub.Algorithm
+}
+
+// MarshalJWK implements the MarshalJWK method of the PublicKeyDoc interface.
+func (pub PublicKeyRSA) MarshalJWK() ([]byte, error) {
+	n, err := decimalToBase64(pub.N, 0, "n")
+	if err != nil {
+		return nil, err
+	}
+	e, err := decimalToBase64(pub.E, 0, "e")
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{
+		"kty": "RSA",
+		"n":   n,
+		"e":   e,
+	})
+}
+
+// decimalToBase64 converts a base 10 encoded integer to its unpadded base64url
+// encoded big-endian representation, left-padded with zeros to size bytes.
+func decimalToBase64(value string, size int, param string) (string, error) {
+	i, ok := new(big.Int).SetString(value, 10)
+	if !ok || i.Sign() < 0 {
+		return "", fmt.Errorf(errMalformedPublicKey, param)
+	}
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// retiredKeys is a list of the keys that have been replaced by
+// RotatePrivateKey, ordered from most to least recently retired. It is only
+// changed while retiredKeysMutex is held for writing, when a key is retired or
+// the configuration is reloaded.
+var (
+	retiredKeysMutex sync.RWMutex
+	retiredKeys      []*PrivateKey
+)
+
+// LoadPrivateKeyPEM parses a PEM encoded private key of the given type, which
+// is one of SupportedPrivateKeyTypes other than HMAC. The key may be encoded
+// in any of the formats that the configuration file's "auto" format accepts.
+// The result can be passed to SetPrivateKey.
+func LoadPrivateKeyPEM(pemBytes []byte, keyType string) (interface{}, error) {
+	keyType = strings.ToUpper(keyType)
+	if _, supported := SupportedPrivateKeyTypes[keyType]; !supported {
+		return nil, fmt.Errorf(errKeyTypeNotSupported, keyType)
+	}
+	if !privateKeyFormatSupports("auto", keyType) {
+		return nil, fmt.Errorf(errKeyFormatNotSupported, "pem", keyType)
+	}
+	return parsePrivateKeyPEM(pemBytes, "PEM data", keyType, "auto", nil)
+}
+
+// parsePrivateKeyPEM parses a private key of the given type and format from
+// the PEM encoded contents, which came from source. Encrypted PKCS#8 private
+// keys are decrypted with the passphrase.
+func parsePrivateKeyPEM(contents []byte, source, keyType, format string, passphrase []byte) (privKey interface{}, err error) {
+	// OpenSSL may write an EC PARAMETERS block ahead of the private key, so
+	// skip over any such blocks.
+	pemBlock, rest := pem.Decode(contents)
+	for pemBlock != nil && pemBlock.Type == "EC PARAMETERS" {
+		pemBlock, rest = pem.Decode(rest)
+	}
+	if pemBlock == nil {
+		err = fmt.Errorf(errNoValidPemBlock, source)
+		return
+	}
+	if x509.IsEncryptedPEMBlock(pemBlock) {
+		err = fmt.Errorf(errEncryptedKeysNotSupported)
+		return
+	}
+	if pemBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		if format != "auto" && format != "pkcs8" {
+			err = fmt.Errorf(errKeyFormatMismatch, source, strings.ToUpper(format))
+			return
+		}
+		if len(passphrase) == 0 {
+			err = fmt.Errorf(errPassphraseRequired, source)
+			return
+		}
+		if pemBlock.Bytes, err = DecryptPKCS8PrivateKey(pemBlock.Bytes, passphrase); err != nil {
+			return
+		}
+		format = "pkcs8"
+	}
+
+	switch format {
+	case "auto":
+		// First try to parse it as a PKCS#8 private key.
+		privKey, err = x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		if err != nil {
+			// Not a PKCS#8 private key. Try something else.
+			switch keyType {
+			case "DSA":
+				if privKey, err = ParsePKCS8DSAPrivateKey(pemBlock.Bytes); err != nil {
+					privKey, err = ParseDSAPrivateKey(pemBlock.Bytes)
+				}
+			case "ECDSA":
+				privKey, err = x509.ParseECPrivateKey(pemBlock.Bytes)
+			case "RSA":
+				privKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+			}
+		}
+	case "pkcs8":
+		if keyType == "DSA" {
+			privKey, err = ParsePKCS8DSAPrivateKey(pemBlock.Bytes)
+		} else {
+			privKey, err = x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		}
+	case "pkcs1":
+		privKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	case "sec1":
+		privKey, err = x509.ParseECPrivateKey(pemBlock.Bytes)
+	}
+	if err != nil && format != "auto" {
+		err = fmt.Errorf(errKeyFormatMismatch, source, strings.ToUpper(format))
+	}
+
+	return
+}
 
 // SetPrivateKey uses the supplied private key.
 func SetPrivateKey(key interface{}) error {
+	_, err := replacePrivateKey(key)
+	return err
+}
+
+// replacePrivateKey uses the supplied private key, and returns the private key
+// that it replaced.
+func replacePrivateKey(key interface{}) (previous *PrivateKey, err error) {
+	privKey, err := newPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	err = updateSettings(func(s *settings) error {
+		previous = s.privateKey
+		privKey.pss = s.rsaSignaturePSS
+		s.privateKey = privKey
+		return nil
+	})
+	return
+}
+
+// newPrivateKey validates the given key, and returns it as a PrivateKey along
+// with its support document representation.
+func newPrivateKey(key interface{}) (*PrivateKey, error) {
 	privKey := &PrivateKey{
 		key: key,
 	}
 
 	switch k := key.(type) {
 	case *dsa.PrivateKey:
-		if k.PublicKey.Q.BitLen() < MinKeySizeDSA {
-			return fmt.Errorf(errPrivateKeyTooSmall, k.PublicKey.Q.BitLen(), MinKeySizeDSA)
+		if k.PublicKey.P.BitLen() < MinKeySizeDSA {
+			return nil, fmt.Errorf(errPrivateKeyTooSmall, k.PublicKey.P.BitLen(), MinKeySizeDSA)
+		}
+		if _, ok := DSAParameterHashes[[2]int{k.PublicKey.P.BitLen(), k.PublicKey.Q.BitLen()}]; !ok {
+			return nil, fmt.Errorf(errUnsupportedDSAParameters, k.PublicKey.P.BitLen(), k.PublicKey.Q.BitLen())
 		}
 
 		privKey.supportDoc = PublicKeyDSA{
@@ -94,7 +350,7 @@ func SetPrivateKey(key interface{}) error {
 	case *ecdsa.PrivateKey:
 		curve, supported := SupportedEllipticCurves[k.PublicKey.Curve]
 		if !supported {
-			return fmt.Errorf(errUnsupportedEllipticCurve)
+			return nil, fmt.Errorf(errUnsupportedEllipticCurve)
 		}
 
 		privKey.supportDoc = PublicKeyECDSA{
@@ -103,9 +359,13 @@ func SetPrivateKey(key interface{}) error {
 			X:         k.PublicKey.X.String(),
 			Y:         k.PublicKey.Y.String(),
 		}
+	case hmacKey:
+		if len(k)*8 < MinKeySizeHMAC {
+			return nil, fmt.Errorf(errPrivateKeyTooSmall, len(k)*8, MinKeySizeHMAC)
+		}
 	case *rsa.PrivateKey:
 		if k.PublicKey.N.BitLen() < MinKeySizeRSA {
-			return fmt.Errorf(errPrivateKeyTooSmall, k.PublicKey.N.BitLen(), MinKeySizeRSA)
+			return nil, fmt.Errorf(errPrivateKeyTooSmall, k.PublicKey.N.BitLen(), MinKeySizeRSA)
 		}
 
 		privKey.supportDoc = PublicKeyRSA{
@@ -115,16 +375,150 @@ func SetPrivateKey(key interface{}) error {
 		}
 		k.Precompute()
 	default:
-		return fmt.Errorf(errUnsupportedPrivateKeyType)
+		return nil, fmt.Errorf(errUnsupportedPrivateKeyType)
+	}
+
+	return privKey, nil
+}
+
+// SetHMACKey uses the supplied shared secret to sign certificates with
+// HMAC-SHA256 (HS256). As the secret must never be published, the support
+// document contains no public key while an HMAC key is in use.
+func SetHMACKey(secret []byte) error {
+	return SetPrivateKey(hmacKey(secret))
+}
+
+// SetPrivateKeyValidity limits the period during which the current private key
+// may be used to sign certificates. A zero time leaves that end of the period
+// unbounded.
+func SetPrivateKeyValidity(notBefore, notAfter time.Time) error {
+	return updateSettings(func(s *settings) (err error) {
+		s.privateKey, err = s.privateKey.withValidity(notBefore, notAfter)
+		return
+	})
+}
+
+// withValidity returns a copy of the key that may only be used to sign
+// certificates during the given period.
+func (pk *PrivateKey) withValidity(notBefore, notAfter time.Time) (*PrivateKey, error) {
+	if pk == nil {
+		return nil, fmt.Errorf(errPrivateKeyUndefined)
+	}
+	if !notBefore.IsZero() && !notAfter.IsZero() && !notBefore.Before(notAfter) {
+		return nil, fmt.Errorf(errInvalidKeyValidity)
+	}
+
+	key := *pk
+	key.notBefore = notBefore
+	key.notAfter = notAfter
+	return &key, nil
+}
+
+// validAt returns whether the key may be used to sign certificates at the
+// given time.
+func (pk *PrivateKey) validAt(t time.Time) bool {
+	if !pk.notBefore.IsZero() && t.Before(pk.notBefore) {
+		return false
+	}
+	if !pk.notAfter.IsZero() && !t.Before(pk.notAfter) {
+		return false
+	}
+	return true
+}
+
+// eligibleKey returns the given key if it is valid at the given time.
+// Retired keys are never used instead, as they may no longer be published, so
+// certificates are refused until a valid key is in use.
+func eligibleKey(key *PrivateKey, t time.Time) (*PrivateKey, error) {
+	if key != nil && key.validAt(t) {
+		return key, nil
+	}
+	return nil, fmt.Errorf(errNoEligiblePrivateKey, t.UTC().Format(time.RFC3339))
+}
+
+// RotatePrivateKey uses the supplied private key, and retires the current
+// private key. Retired keys are no longer used for signing, but continue to be
+// published until they are pruned.
+func RotatePrivateKey(key interface{}) error {
+	oldKey, err := replacePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if oldKey != nil {
+		retirePrivateKey(oldKey)
 	}
 
-	privateKey = privKey
 	return nil
 }
 
+// retirePrivateKey adds the given key to the retired keys, and prunes any
+// retired keys that are no longer needed.
+func retirePrivateKey(key *PrivateKey) {
+	now := time.Now()
+	retired := *key
+	retired.retiredAt = now
+
+	retiredKeysMutex.Lock()
+	defer retiredKeysMutex.Unlock()
+	retiredKeys = retainedKeys(append([]*PrivateKey{&retired}, retiredKeys...), now)
+}
+
+// pruneRetiredKeys removes the retired keys that are no longer needed.
+func pruneRetiredKeys(now time.Time) {
+	retiredKeysMutex.Lock()
+	defer retiredKeysMutex.Unlock()
+	retiredKeys = retainedKeys(retiredKeys, now)
+}
+
+// retainedKeys returns the retired keys that are not older than the configured
+// maximum age, and do not exceed the configured maximum number of retired
+// keys. Keys that could still have signed a valid certificate are always
+// retained. The given list is left unchanged.
+func retainedKeys(keys []*PrivateKey, now time.Time) (keep []*PrivateKey) {
+	s := loadSettings()
+	minAge := time.Duration(s.sessionMaxDuration) * time.Second
+	maxAge := s.retiredKeyMaxAge
+	if maxAge < minAge {
+		maxAge = minAge
+	}
+
+	for _, key := range keys {
+		age := now.Sub(key.retiredAt)
+		if age >= maxAge {
+			continue
+		}
+		if s.maxRetiredKeys > 0 && len(keep) >= s.maxRetiredKeys && age >= minAge {
+			continue
+		}
+		keep = append(keep, key)
+	}
+	return
+}
+
+// publishedKeys returns the public keys that should be published: the current
+// key, followed by any retired keys that are still retained. Retired keys that
+// have outlived the limits since they were last pruned are left out, but are
+// not removed.
+func publishedKeys() (keys []PublicKeyDoc) {
+	if current := loadSettings().privateKey; current != nil && current.supportDoc != nil {
+		keys = append(keys, current.supportDoc)
+	}
+
+	retiredKeysMutex.RLock()
+	retained := retainedKeys(retiredKeys, time.Now())
+	retiredKeysMutex.RUnlock()
+	for _, key := range retained {
+		if key.supportDoc != nil {
+			keys = append(keys, key.supportDoc)
+		}
+	}
+
+	return
+}
+
 // SupportDoc returns the public-key component of the support document.
-func (pk *PrivateKey) SupportDoc() (interface{}, error) {
-	if pk.key == nil {
+func (pk *PrivateKey) SupportDoc() (PublicKeyDoc, error) {
+	if pk == nil || pk.key == nil {
 		return nil, fmt.Errorf(errPrivateKeyUndefined)
 	}
 
@@ -133,58 +527,200 @@ func (pk *PrivateKey) SupportDoc() (interface{}, error) {
 
 // IdCertHeader returns the header for an ID certificate.
 func (pk *PrivateKey) IdCertHeader() (header IdentityCertificateHeader, err error) {
-	if pk.key == nil {
+	return pk.idCertHeader(loadSettings())
+}
+
+// idCertHeader returns the header for an ID certificate issued with the given
+// settings.
+func (pk *PrivateKey) idCertHeader(s *settings) (header IdentityCertificateHeader, err error) {
+	if pk == nil || pk.key == nil {
 		err = fmt.Errorf(errPrivateKeyUndefined)
 		return
 	}
 
-	switch key := pk.key.(type) {
-	case *dsa.PrivateKey:
-		header = IdentityCertificateHeader{
-			Alg: fmt.Sprintf("%s%d", PrivateKeyTypeToAlgorithm["DSA"], key.PublicKey.Q.BitLen()/8),
-		}
-	case *ecdsa.PrivateKey:
-		header = IdentityCertificateHeader{
-			Alg: fmt.Sprintf("%s%d", PrivateKeyTypeToAlgorithm["ECDSA"], key.PublicKey.X.BitLen()),
-		}
-	case *rsa.PrivateKey:
-		header = IdentityCertificateHeader{
-			Alg: fmt.Sprintf("%s%d", PrivateKeyTypeToAlgorithm["RSA"], key.PublicKey.N.BitLen()/8),
-		}
-	default:
-		// This should not be reachable.
-		panic(errUnsupportedPrivateKeyType)
+	alg := signingAlg(publicKey(pk.key), pk.pss)
+	if len(alg) == 0 {
+		err = fmt.Errorf(errUnsupportedPrivateKeyType)
+		return
+	}
+	header = IdentityCertificateHeader{
+		Alg:   alg,
+		Jku:   s.jwkSetUrl,
+		Crit:  s.criticalHeaders,
+		Extra: s.extensionHeaders,
 	}
 
 	return
 }
 
-// Sign signs the provided data.
-func (pk *PrivateKey) Sign(data []byte) (signature []byte, err error) {
-	if pk.key == nil {
+// SupportedSigningAlgs returns the algorithm identifiers that the current
+// private key signs certificates with.
+func SupportedSigningAlgs() []string {
+	s := loadSettings()
+	if s.privateKey == nil {
+		return nil
+	}
+	header, err := s.privateKey.idCertHeader(s)
+	if err != nil {
+		return nil
+	}
+
+	return []string{header.Alg}
+}
+
+// Sign signs the provided digest. RSA digests are assumed to be made with
+// SHA-256, unless their length matches that of another supported hash. HMAC
+// keys sign messages rather than digests, so they can only be used with
+// SignMessage.
+func (pk *PrivateKey) Sign(digest []byte) (signature []byte, err error) {
+	if pk == nil || pk.key == nil {
+		err = fmt.Errorf(errPrivateKeyUndefined)
+		return
+	}
+	defer observeSigning(pk, time.Now())
+
+	hash := crypto.SHA256
+	for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA224, crypto.SHA384, crypto.SHA512} {
+		if len(digest) == h.Size() {
+			hash = h
+		}
+	}
+	return pk.signDigest(hash, digest)
+}
+
+// SignMessage signs the provided data. For all key types other than HMAC, the
+// data is first hashed with the hash that the key's signature algorithm names.
+func (pk *PrivateKey) SignMessage(data []byte) (signature []byte, err error) {
+	if pk == nil || pk.key == nil {
 		err = fmt.Errorf(errPrivateKeyUndefined)
 		return
 	}
+	defer observeSigning(pk, time.Now())
 
+	switch key := pk.key.(type) {
+	case hmacKey:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		signature = mac.Sum(nil)
+		return
+	}
+
+	hash := signingHash(publicKey(pk.key))
+	h := hash.New()
+	h.Write(data)
+	return pk.signDigest(hash, h.Sum(nil))
+}
+
+// signDigest signs a digest that was made with the given hash.
+func (pk *PrivateKey) signDigest(hash crypto.Hash, digest []byte) (signature []byte, err error) {
 	switch key := pk.key.(type) {
 	case *dsa.PrivateKey:
-		signature, err = signDSA(key, data)
+		signature, err = signDSA(key, digest)
 	case *ecdsa.PrivateKey:
-		signature, err = signECDSA(key, data)
+		signature, err = signECDSA(key, digest)
 	case *rsa.PrivateKey:
-		signature, err = signRSA(key, data)
+		signature, err = signRSA(key, hash, digest, pk.pss)
+	case hmacKey:
+		err = fmt.Errorf(errDigestSigningNotSupported)
 	default:
-		// This should not be reachable.
-		panic(errUnsupportedPrivateKeyType)
+		err = fmt.Errorf(errUnsupportedPrivateKeyType)
 	}
 
 	return
 }
 
+// publicKey returns the key that verifies signatures made with the given
+// private key. For HMAC keys, this is the shared secret itself.
+func publicKey(key interface{}) crypto.PublicKey {
+	switch k := key.(type) {
+	case *dsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	case hmacKey:
+		return k
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	}
+	return nil
+}
+
+// RSASignatureSchemes is a list of the supported signature schemes for RSA
+// keys. PKCS #1 v1.5 is used unless PSS is configured.
+var RSASignatureSchemes = map[string]bool{
+	"pkcs1v15": true,
+	"pss":      true,
+}
+
+// rsaPSSOptions are the options used to create and verify RSASSA-PSS
+// signatures. As JWS requires, the salt is the same length as the hash.
+var rsaPSSOptions = &rsa.PSSOptions{
+	SaltLength: rsa.PSSSaltLengthEqualsHash,
+}
+
+// signingAlg returns the algorithm identifier of signatures that are verified
+// by the given key, or an empty string if the key type is not supported. RSA
+// keys are identified as signing with RSASSA-PSS if pss is set.
+func signingAlg(pub crypto.PublicKey, pss bool) string {
+	switch key := pub.(type) {
+	case *dsa.PublicKey:
+		return fmt.Sprintf("%s%d", PrivateKeyTypeToAlgorithm["DSA"], key.P.BitLen()/8)
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ES%d", signingHash(key).Size()*8)
+	case hmacKey:
+		return "HS256"
+	case *rsa.PublicKey:
+		if pss {
+			return fmt.Sprintf("PS%d", key.N.BitLen()/8)
+		}
+		return fmt.Sprintf("%s%d", PrivateKeyTypeToAlgorithm["RSA"], key.N.BitLen()/8)
+	}
+	return ""
+}
+
+// signingHash returns the hash used to create the digest that is signed for
+// the given key. The hash is the one that the DSA parameter sizes or elliptic
+// curve are paired with, so that the advertised algorithm is consistent with
+// the signature.
+//
+// RSA keys use SHA-256, as BrowserID does, except for 3072 and 4096 bit keys.
+// Their BrowserID algorithms, RS384 and RS512, name SHA-384 and SHA-512 to JWT
+// verifiers, so those hashes are used to keep both readings consistent.
+func signingHash(pub crypto.PublicKey) crypto.Hash {
+	switch key := pub.(type) {
+	case *dsa.PublicKey:
+		if hash, ok := DSAParameterHashes[[2]int{key.P.BitLen(), key.Q.BitLen()}]; ok {
+			return hash
+		}
+	case *ecdsa.PublicKey:
+		if hash, ok := EllipticCurveHashes[key.Curve]; ok {
+			return hash
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() / 8 {
+		case 384:
+			return crypto.SHA384
+		case 512:
+			return crypto.SHA512
+		}
+	}
+	return crypto.SHA256
+}
+
 func signDSA(key *dsa.PrivateKey, data []byte) (sig []byte, err error) {
+	// FIPS 186-3 requires the digest to be truncated to the bit length of Q,
+	// which dsa.Sign leaves to the caller.
+	size := (key.Q.BitLen() + 7) / 8
+	if len(data) > size {
+		data = data[:size]
+	}
 	r, s, err := dsa.Sign(rand.Reader, key, data)
 	if err == nil {
-		sig = bytes.Join([][]byte{r.Bytes(), s.Bytes()}, []byte(""))
+		// R and S are zero padded to the size of Q, so that the signature
+		// can be split in half.
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
 	}
 	return
 }
@@ -192,11 +728,18 @@ func signDSA(key *dsa.PrivateKey, data []byte) (sig []byte, err error) {
 func signECDSA(key *ecdsa.PrivateKey, data []byte) (sig []byte, err error) {
 	r, s, err := ecdsa.Sign(rand.Reader, key, data)
 	if err == nil {
-		sig = bytes.Join([][]byte{r.Bytes(), s.Bytes()}, []byte(""))
+		// R and S are zero padded to the size of the curve, as JWS requires.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
 	}
 	return
 }
 
-func signRSA(key *rsa.PrivateKey, data []byte) (sig []byte, err error) {
-	return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, data)
+func signRSA(key *rsa.PrivateKey, hash crypto.Hash, data []byte, pss bool) (sig []byte, err error) {
+	if pss {
+		return rsa.SignPSS(rand.Reader, key, hash, data, rsaPSSOptions)
+	}
+	return rsa.SignPKCS1v15(rand.Reader, key, hash, data)
 }
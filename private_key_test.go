@@ -0,0 +1,420 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys returns a freshly generated key of each type that can sign
+// certificates, other than DSA, whose keys are slow to generate.
+func testKeys(t *testing.T) map[string]interface{} {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	return map[string]interface{}{
+		"RSA":   rsaKey,
+		"ECDSA": ecdsaKey,
+	}
+}
+
+func TestPublicKeyDoc(t *testing.T) {
+	for keyType, key := range testKeys(t) {
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: newPrivateKey: %v", keyType, err)
+		}
+
+		var kty string
+		switch doc := pk.supportDoc.(type) {
+		case PublicKeyRSA:
+			kty = "RSA"
+			if keyType != "RSA" {
+				t.Errorf("%s: support document is %T", keyType, doc)
+			}
+		case PublicKeyECDSA:
+			kty = "EC"
+			if keyType != "ECDSA" || doc.Curve != "P-256" {
+				t.Errorf("%s: support document is %T with curve %q", keyType, doc, doc.Curve)
+			}
+		default:
+			t.Fatalf("%s: unexpected support document type %T", keyType, doc)
+		}
+		if alg := pk.supportDoc.KeyAlgorithm(); alg != PrivateKeyTypeToAlgorithm[keyType] {
+			t.Errorf("%s: KeyAlgorithm() = %q, want %q", keyType, alg, PrivateKeyTypeToAlgorithm[keyType])
+		}
+
+		raw, err := pk.supportDoc.MarshalJWK()
+		if err != nil {
+			t.Fatalf("%s: MarshalJWK: %v", keyType, err)
+		}
+		var jwk map[string]string
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			t.Fatalf("%s: MarshalJWK returned invalid JSON: %v", keyType, err)
+		}
+		if jwk["kty"] != kty {
+			t.Errorf("%s: kty = %q, want %q", keyType, jwk["kty"], kty)
+		}
+	}
+}
+
+func TestPublicKeyDSAHasNoJWK(t *testing.T) {
+	if _, err := (PublicKeyDSA{}).MarshalJWK(); err == nil {
+		t.Error("MarshalJWK of a DSA key succeeded")
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	data := []byte("header.payload")
+	for keyType, key := range testKeys(t) {
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: newPrivateKey: %v", keyType, err)
+		}
+		sig, err := pk.SignMessage(data)
+		if err != nil {
+			t.Fatalf("%s: SignMessage: %v", keyType, err)
+		}
+		pub := publicKey(pk.key)
+		if !verifySignature(pub, data, sig, false) {
+			t.Errorf("%s: signature did not verify", keyType)
+		}
+		if verifySignature(pub, []byte("header.tampered"), sig, false) {
+			t.Errorf("%s: signature verified for different data", keyType)
+		}
+	}
+}
+
+func TestSignDigest(t *testing.T) {
+	digest := sha256.Sum256([]byte("data"))
+	for keyType, key := range testKeys(t) {
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: newPrivateKey: %v", keyType, err)
+		}
+		sig, err := pk.Sign(digest[:])
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if err != nil {
+				t.Fatalf("%s: Sign: %v", keyType, err)
+			}
+			if err := rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+				t.Errorf("%s: signature of digest did not verify: %v", keyType, err)
+			}
+		case *ecdsa.PrivateKey:
+			if err != nil {
+				t.Fatalf("%s: Sign: %v", keyType, err)
+			}
+			r, s, _ := splitSignature(sig)
+			if !ecdsa.Verify(&k.PublicKey, digest[:], r, s) {
+				t.Errorf("%s: signature of digest did not verify", keyType)
+			}
+		}
+	}
+}
+
+func TestSignWithoutKey(t *testing.T) {
+	var pk *PrivateKey
+	if _, err := pk.Sign(make([]byte, 32)); err == nil {
+		t.Error("Sign with no key succeeded")
+	}
+	if _, err := pk.SignMessage([]byte("data")); err == nil {
+		t.Error("SignMessage with no key succeeded")
+	}
+}
+
+func TestEligibleKey(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		eligible  bool
+	}{
+		{"unbounded", time.Time{}, time.Time{}, true},
+		{"within period", now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"not yet valid", now.Add(time.Hour), time.Time{}, false},
+		{"expired", time.Time{}, now.Add(-time.Hour), false},
+	}
+	for _, test := range tests {
+		pk, _ := testSigningKey(t)
+		pk.notBefore, pk.notAfter = test.notBefore, test.notAfter
+		key, err := eligibleKey(pk, now)
+		if test.eligible && (err != nil || key != pk) {
+			t.Errorf("%s: eligibleKey = %v, %v; want the key", test.name, key, err)
+		}
+		if !test.eligible && (err == nil || key != nil) {
+			t.Errorf("%s: eligibleKey = %v, %v; want an error", test.name, key, err)
+		}
+	}
+}
+
+func TestEligibleKeyIgnoresRetiredKeys(t *testing.T) {
+	defer func(retired []*PrivateKey) { retiredKeys = retired }(retiredKeys)
+
+	retired, _ := testSigningKey(t)
+	current, _ := testSigningKey(t)
+	current.notAfter = time.Now().Add(-time.Hour)
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = current })
+	retiredKeys = []*PrivateKey{retired}
+
+	if key, err := eligibleKey(current, time.Now()); err == nil {
+		t.Errorf("eligibleKey of an expired key = %v, want an error", key)
+	}
+	if _, err := signIdentityCertificate(loadSettings(), testCertificateRequest(), current, "example.com"); err == nil {
+		t.Error("certificate was signed with an expired key")
+	}
+}
+
+func TestPublishedKeysDoesNotPrune(t *testing.T) {
+	defer func(retired []*PrivateKey) { retiredKeys = retired }(retiredKeys)
+
+	current, _ := testSigningKey(t)
+	recent, _ := testSigningKey(t)
+	expired, _ := testSigningKey(t)
+	recent.retiredAt = time.Now()
+	expired.retiredAt = time.Now().Add(-2 * time.Duration(loadSettings().sessionMaxDuration) * time.Second)
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = current })
+	retiredKeys = []*PrivateKey{recent, expired}
+
+	if keys := publishedKeys(); len(keys) != 2 {
+		t.Errorf("published %d keys, want the current and recently retired keys", len(keys))
+	}
+	if len(retiredKeys) != 2 {
+		t.Errorf("publishedKeys pruned the retired keys to %d", len(retiredKeys))
+	}
+
+	pruneRetiredKeys(time.Now())
+	if len(retiredKeys) != 1 || retiredKeys[0] != recent {
+		t.Errorf("pruneRetiredKeys kept %d keys, want the recently retired key", len(retiredKeys))
+	}
+}
+
+func TestPublishedKeysWhileRetiring(t *testing.T) {
+	defer func(retired []*PrivateKey) { retiredKeys = retired }(retiredKeys)
+
+	current, _ := testSigningKey(t)
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = current })
+	retiredKeys = nil
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			publishedKeys()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		retirePrivateKey(current)
+	}
+	<-done
+
+	if !current.retiredAt.IsZero() {
+		t.Error("retirePrivateKey changed the key that was retired")
+	}
+}
+
+// testDSAKey returns a freshly generated DSA key of the minimum supported
+// size.
+func testDSAKey(t *testing.T) *dsa.PrivateKey {
+	t.Helper()
+	key := &dsa.PrivateKey{}
+	if err := dsa.GenerateParameters(&key.Parameters, rand.Reader, dsa.L2048N256); err != nil {
+		t.Fatalf("dsa.GenerateParameters: %v", err)
+	}
+	if err := dsa.GenerateKey(key, rand.Reader); err != nil {
+		t.Fatalf("dsa.GenerateKey: %v", err)
+	}
+	return key
+}
+
+func TestParsePrivateKeyPEMFormats(t *testing.T) {
+	keys := testKeys(t)
+	pkcs1 := x509.MarshalPKCS1PrivateKey(keys["RSA"].(*rsa.PrivateKey))
+	sec1, err := x509.MarshalECPrivateKey(keys["ECDSA"].(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	ecParams := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+
+	tests := []struct {
+		keyType string
+		format  string
+		pem     []byte
+	}{
+		{"RSA", "pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: pkcs1})},
+		{"ECDSA", "sec1", append(ecParams, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})...)},
+	}
+	for keyType, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: x509.MarshalPKCS8PrivateKey: %v", keyType, err)
+		}
+		tests = append(tests, struct {
+			keyType string
+			format  string
+			pem     []byte
+		}{keyType, "pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})})
+	}
+
+	for _, test := range tests {
+		for _, format := range []string{"auto", test.format} {
+			privKey, err := parsePrivateKeyPEM(test.pem, "test", test.keyType, format, nil)
+			if err != nil {
+				t.Errorf("%s %s as %s: %v", test.keyType, test.format, format, err)
+				continue
+			}
+			if _, err := newPrivateKey(privKey); err != nil {
+				t.Errorf("%s %s as %s: newPrivateKey: %v", test.keyType, test.format, format, err)
+			}
+		}
+
+		// Keys in any other format than the configured one are rejected.
+		for format, keyTypes := range SupportedPrivateKeyFormats {
+			if format == "auto" || format == test.format || !privateKeyFormatSupports(format, test.keyType) {
+				continue
+			}
+			want := fmt.Sprintf(errKeyFormatMismatch, "test", strings.ToUpper(format))
+			if _, err := parsePrivateKeyPEM(test.pem, "test", test.keyType, format, nil); err == nil || err.Error() != want {
+				t.Errorf("%s %s as %s (%v): err = %v, want %q", test.keyType, test.format, format, keyTypes, err, want)
+			}
+		}
+	}
+
+	t.Setenv("PERSONA_TEST_KEY", string(tests[0].pem))
+	if _, err := readPrivateKey("RSA", "", "PERSONA_TEST_KEY", "sec1", ""); err == nil || err.Error() != fmt.Sprintf(errKeyFormatNotSupported, "sec1", "RSA") {
+		t.Errorf("readPrivateKey of an RSA key as SEC1 = %v", err)
+	}
+}
+
+func TestDSAPrivateKey(t *testing.T) {
+	key := testDSAKey(t)
+	openssl, err := MarshalDSAPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalDSAPrivateKey: %v", err)
+	}
+	x, _ := asn1.Marshal(key.X)
+	pkcs8, err := asn1.Marshal(pkcs8DSAPrivateKey{
+		Algorithm:  pkcs8Algorithm{Algorithm: oidPublicKeyDSA, Parameters: key.Parameters},
+		PrivateKey: x,
+	})
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+
+	var config Configuration
+	config.Authentication.Url = "/auth"
+	config.Provisioning.Url = "/prov"
+	blocks := map[string]*pem.Block{
+		"openssl": {Type: "DSA PRIVATE KEY", Bytes: openssl},
+		"pkcs8":   {Type: "PRIVATE KEY", Bytes: pkcs8},
+	}
+	for name, block := range blocks {
+		privKey, err := LoadPrivateKeyPEM(pem.EncodeToMemory(block), "dsa")
+		if err != nil {
+			t.Fatalf("%s: LoadPrivateKeyPEM: %v", name, err)
+		}
+		loaded := privKey.(*dsa.PrivateKey)
+		if loaded.X.Cmp(key.X) != 0 || loaded.Y.Cmp(key.Y) != 0 {
+			t.Errorf("%s: loaded key does not match the original", name)
+		}
+
+		pk, err := newPrivateKey(loaded)
+		if err != nil {
+			t.Fatalf("%s: newPrivateKey: %v", name, err)
+		}
+		doc, err := (&Provider{}).buildSupportDocument(&config, pk)
+		if err != nil {
+			t.Fatalf("%s: buildSupportDocument: %v", name, err)
+		}
+		if !strings.Contains(string(doc), `"algorithm":"DS"`) {
+			t.Errorf("%s: support document %s does not carry a DSA key", name, doc)
+		}
+
+		data := []byte("header.payload")
+		sig, err := pk.SignMessage(data)
+		if err != nil {
+			t.Fatalf("%s: SignMessage: %v", name, err)
+		}
+		if !verifySignature(&key.PublicKey, data, sig, false) {
+			t.Errorf("%s: signature did not verify", name)
+		}
+	}
+}
+
+func TestSigningAlgMatchesHash(t *testing.T) {
+	keys := []interface{}{testDSAKey(t)}
+	for curve := range SupportedEllipticCurves {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	// The number in each algorithm names the hash, other than for DSA, where
+	// it is the size of P in bytes.
+	digestBits := map[string]int{"DS256": 256}
+
+	for _, key := range keys {
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("newPrivateKey: %v", err)
+		}
+		pub := publicKey(key)
+		alg := signingAlg(pub, false)
+		want, ok := digestBits[alg]
+		if !ok && strings.HasPrefix(alg, "ES") {
+			fmt.Sscanf(alg, "ES%d", &want)
+		}
+		if got := signingHash(pub).Size() * 8; got != want {
+			t.Errorf("%s: digest is %d bits, want %d", alg, got, want)
+		}
+
+		data := []byte("header.payload")
+		sig, err := pk.SignMessage(data)
+		if err != nil {
+			t.Fatalf("%s: SignMessage: %v", alg, err)
+		}
+		if !verifySignature(pub, data, sig, false) {
+			t.Errorf("%s: signature did not verify", alg)
+		}
+	}
+}
+
+func TestUnsupportedDSAParameters(t *testing.T) {
+	// Only the bit lengths of the parameters are checked, so they need not
+	// form a usable key.
+	sizes := [][2]int{{2048, 224}, {3072, 256}, {2048, 160}}
+	for _, size := range sizes {
+		key := &dsa.PrivateKey{}
+		key.P = new(big.Int).Lsh(big.NewInt(1), uint(size[0]-1))
+		key.Q = new(big.Int).Lsh(big.NewInt(1), uint(size[1]-1))
+		want := fmt.Sprintf(errUnsupportedDSAParameters, size[0], size[1])
+		if _, err := newPrivateKey(key); err == nil || err.Error() != want {
+			t.Errorf("newPrivateKey with %v = %v, want %q", size, err, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Provider is a Persona IdP. Its handlers use the provider's own private key,
+// issuer, templates, session backing, nonce secret, audit log, readiness, and
+// support document, so that several IdPs can be served from one process.
+//
+// Fields that are left unset fall back to the package-level state that is
+// configured by LoadConfig, SetPrivateKey, and SetSessionBacking. Tenants, and
+// the retired keys published by JWKS, only apply to providers that use the
+// package-level private key and issuer. The remaining configuration, such as
+// the HTTP, compression, rate limit, proxy, and certificate settings, as well
+// as the record of used nonces, is shared by every provider in the process.
+type Provider struct {
+	Issuer                 string
+	AuthenticationTemplate *template.Template
+	ProvisioningTemplate   *template.Template
+	SessionBacking         SessionBacking
+
+	// AuditLogger, if set, receives the provider's audit records in place of
+	// the package-level AuditLogger.
+	AuditLogger *log.Logger
+
+	// keyMutex guards key, which SetPrivateKey may replace while requests
+	// are being served.
+	keyMutex    sync.RWMutex
+	key         *PrivateKey
+	nonceSecret hmacKey
+
+	// ready is non-zero once the provider is ready to serve requests.
+	ready int32
+
+	// supportDocJson holds the *servedDocument of the support document that
+	// is currently being served. It is only replaced once a new document has
+	// been generated successfully, so a failed regeneration leaves the
+	// previous document intact.
+	supportDocJson atomic.Value
+
+	// shutdownMutex guards shuttingDown, which is set once Shutdown has been
+	// called. inFlight counts the requests that are using the session
+	// backing, so that Shutdown can wait for them.
+	shutdownMutex sync.Mutex
+	shuttingDown  bool
+	inFlight      sync.WaitGroup
+}
+
+// DefaultProvider is the provider used by the package-level handlers. It uses
+// the package-level state throughout.
+var DefaultProvider = &Provider{}
+
+// SetPrivateKey uses the supplied private key for certificates issued by the
+// provider. Whether an RSA key signs with RSASSA-PSS follows the settings that
+// each request is served with.
+func (p *Provider) SetPrivateKey(key interface{}) error {
+	privKey, err := newPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	p.keyMutex.Lock()
+	p.key = privKey
+	p.keyMutex.Unlock()
+	return nil
+}
+
+// ownKey returns the private key that was set with SetPrivateKey, if any.
+func (p *Provider) ownKey() *PrivateKey {
+	p.keyMutex.RLock()
+	defer p.keyMutex.RUnlock()
+	return p.key
+}
+
+// SetNonceSecret uses the supplied shared secret to sign the nonces issued by
+// the provider, in place of the configured nonce secret.
+func (p *Provider) SetNonceSecret(secret []byte) error {
+	if len(secret)*8 < MinKeySizeHMAC {
+		return fmt.Errorf(errNonceSecretTooSmall, len(secret)*8, MinKeySizeHMAC)
+	}
+
+	p.nonceSecret = hmacKey(secret)
+	return nil
+}
+
+// nonceKey returns the key that the provider signs nonces with, given the
+// settings.
+func (p *Provider) nonceKey(s *settings) hmacKey {
+	if len(p.nonceSecret) > 0 {
+		return p.nonceSecret
+	}
+	return s.nonceKey
+}
+
+// tenantFor returns the tenant selected by the request, if the provider uses
+// the package-level private key and issuer, which tenants take the place of.
+func (p *Provider) tenantFor(r *http.Request) *tenant {
+	if p.ownKey() != nil || len(p.Issuer) > 0 {
+		return nil
+	}
+	return tenantFor(r)
+}
+
+// signingKey returns the private key used by the provider with the given
+// settings.
+func (p *Provider) signingKey(s *settings) *PrivateKey {
+	key := p.ownKey()
+	if key == nil {
+		return s.privateKey
+	}
+	if key.pss != s.rsaSignaturePSS {
+		withPSS := *key
+		withPSS.pss = s.rsaSignaturePSS
+		return &withPSS
+	}
+	return key
+}
+
+// issuer returns the issuer of certificates issued by the provider with the
+// given settings.
+func (p *Provider) issuer(s *settings) string {
+	if len(p.Issuer) > 0 {
+		return p.Issuer
+	}
+	return s.defaultIssuer
+}
+
+// sessions returns the session backing used by the provider.
+func (p *Provider) sessions() SessionBacking {
+	if p.SessionBacking != nil {
+		return p.SessionBacking
+	}
+	return sessionBacking
+}
+
+// authenticationTemplate returns the authentication page template used by the
+// provider with the given settings.
+func (p *Provider) authenticationTemplate(s *settings) *template.Template {
+	if p.AuthenticationTemplate != nil {
+		return p.AuthenticationTemplate
+	}
+	if s.authenticationTemplate != nil {
+		return s.authenticationTemplate
+	}
+	return AuthenticationTemplate
+}
+
+// provisioningTemplate returns the provisioning page template used by the
+// provider with the given settings.
+func (p *Provider) provisioningTemplate(s *settings) *template.Template {
+	if p.ProvisioningTemplate != nil {
+		return p.ProvisioningTemplate
+	}
+	if s.provisioningTemplate != nil {
+		return s.provisioningTemplate
+	}
+	return ProvisioningTemplate
+}
+
+// signer returns the private key and issuer to use for certificates issued in
+// response to the request. The tenant selected by the request, if any, takes
+// precedence over the provider's own key and issuer.
+func (p *Provider) signer(r *http.Request) (key *PrivateKey, issuer string) {
+	if t := p.tenantFor(r); t != nil {
+		return t.key, t.issuer
+	}
+	s := settingsFor(r)
+	return p.signingKey(s), p.issuer(s)
+}
+
+// BrowserID responds with the BrowserID support document of the default
+// provider.
+func BrowserID(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.BrowserID(w, r)
+}
+
+// Authentication responds with the authentication page template of the
+// default provider.
+func Authentication(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.Authentication(w, r)
+}
+
+// Provisioning responds with the provisioning page template of the default
+// provider.
+func Provisioning(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.Provisioning(w, r)
+}
+
+// CheckSession checks the session of the user with the default provider.
+func CheckSession(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.CheckSession(w, r)
+}
+
+// CreateSession creates a session for the user with the default provider.
+func CreateSession(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.CreateSession(w, r)
+}
+
+// Logout deletes the user's session with the default provider.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.Logout(w, r)
+}
+
+// SessionStatus responds with the status of the user's session with the
+// default provider.
+func SessionStatus(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.SessionStatus(w, r)
+}
+
+// GenerateCertificate responds with an identity certificate issued by the
+// default provider.
+func GenerateCertificate(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.GenerateCertificate(w, r)
+}
+
+// GenerateCertificates responds with a batch of identity certificates issued
+// by the default provider.
+func GenerateCertificates(w http.ResponseWriter, r *http.Request) {
+	DefaultProvider.GenerateCertificates(w, r)
+}
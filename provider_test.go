@@ -0,0 +1,184 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProviderReadiness(t *testing.T) {
+	defer SetReady(IsReady())
+	SetReady(false)
+
+	p := &Provider{}
+	handler := p.whenReady(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status before the support document was set = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	p.SetSupportDocument([]byte(`{}`))
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status after the support document was set = %d, want %d", w.Code, http.StatusOK)
+	}
+	if IsReady() {
+		t.Error("setting a provider's support document made the default provider ready")
+	}
+}
+
+func TestProviderJWKS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	p := &Provider{}
+	if err := p.SetPrivateKey(key); err != nil {
+		t.Fatalf("SetPrivateKey: %v", err)
+	}
+	current, _ := testSigningKey(t)
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = current })
+
+	doc, err := p.GenerateJWKS()
+	if err != nil {
+		t.Fatalf("GenerateJWKS: %v", err)
+	}
+	var jwks JSONWebKeySet
+	if err := json.Unmarshal(doc, &jwks); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	own, _ := p.key.supportDoc.MarshalJWK()
+	if len(jwks.Keys) != 1 || !bytes.Equal(jwks.Keys[0], own) {
+		t.Errorf("JWK Set = %s, want only the provider's key", doc)
+	}
+}
+
+func TestProviderNonceSecret(t *testing.T) {
+	a, b := &Provider{}, &Provider{}
+	if err := a.SetNonceSecret([]byte("short")); err == nil {
+		t.Error("short nonce secret was accepted")
+	}
+	if err := a.SetNonceSecret([]byte(strings.Repeat("a", 32))); err != nil {
+		t.Fatalf("SetNonceSecret: %v", err)
+	}
+	if err := b.SetNonceSecret([]byte(strings.Repeat("b", 32))); err != nil {
+		t.Fatalf("SetNonceSecret: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	a.Nonce(w, httptest.NewRequest("GET", "/nonce", nil))
+	var response NonceResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	s := newSettings()
+	s.requireNonce = true
+	req := testCertificateRequest()
+	req.Nonce = response.Nonce
+	if err := b.validateNonce(s, req); err == nil {
+		t.Error("nonce issued by another provider was accepted")
+	}
+	if err := a.validateNonce(s, req); err != nil {
+		t.Errorf("nonce issued by the provider was rejected: %v", err)
+	}
+}
+
+func TestProviderAuditLogger(t *testing.T) {
+	var own, shared bytes.Buffer
+	defer func(logger *log.Logger) { AuditLogger = logger }(AuditLogger)
+	AuditLogger = log.New(&shared, "", 0)
+
+	p := &Provider{AuditLogger: log.New(&own, "", 0)}
+	p.audit(AuditSessionChecked, "user@example.com", "ok")
+	if !strings.Contains(own.String(), "event="+AuditSessionChecked) {
+		t.Errorf("provider audit log = %q, want the event", own.String())
+	}
+	if shared.Len() > 0 {
+		t.Errorf("package audit log = %q, want nothing", shared.String())
+	}
+}
+
+func TestAuditHashesEmails(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.auditEmailKey = []byte("audit-key") })
+	var buf bytes.Buffer
+	p := &Provider{AuditLogger: log.New(&buf, "", 0)}
+
+	p.audit(AuditCertificateRefused, "User@example.com", "refused User@example.com.")
+	if strings.Contains(strings.ToLower(buf.String()), "user@example.com") {
+		t.Errorf("audit log %q contains the email address", buf.String())
+	}
+	hashed := auditEmail("user@EXAMPLE.com")
+	if !strings.HasPrefix(hashed, "hmac-sha256:") || strings.Count(buf.String(), hashed) != 2 {
+		t.Errorf("audit log %q does not carry the hashed address %s", buf.String(), hashed)
+	}
+}
+
+func TestProviderPrivateKeyFollowsRequestSettings(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	p := &Provider{Issuer: "example.com"}
+	if err := p.SetPrivateKey(key); err != nil {
+		t.Fatalf("SetPrivateKey: %v", err)
+	}
+
+	for _, pss := range []bool{false, true} {
+		withSettingsUpdate(t, func(s *settings) { s.rsaSignaturePSS = pss })
+		pk, _ := p.signer(withSettings(httptest.NewRequest("POST", "/certificate", nil)))
+		header, err := pk.IdCertHeader()
+		if err != nil {
+			t.Fatalf("IdCertHeader: %v", err)
+		}
+		if want := map[bool]string{false: "RS256", true: "PS256"}[pss]; header.Alg != want {
+			t.Errorf("alg with PSS %v = %s, want %s", pss, header.Alg, want)
+		}
+	}
+}
+
+func TestProviderSetPrivateKeyWhileSigning(t *testing.T) {
+	p := &Provider{Issuer: "example.com"}
+	first, _ := testSigningKey(t)
+	p.key = first
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Errorf("ecdsa.GenerateKey: %v", err)
+				return
+			}
+			p.SetPrivateKey(key)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			pk, issuer := p.signer(httptest.NewRequest("POST", "/certificate", nil))
+			if _, err := signIdentityCertificate(loadSettings(), testCertificateRequest(), pk, issuer); err != nil {
+				t.Errorf("signIdentityCertificate: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
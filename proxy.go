@@ -0,0 +1,102 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultAuthenticatedUserHeader is the default header that trusted proxies
+// use to report the authenticated user.
+const DefaultAuthenticatedUserHeader = "X-Authenticated-User"
+
+// Error messages.
+const (
+	errAuthenticatedUserMismatch = "email does not match the authenticated user."
+)
+
+// remoteHost returns the host part of the remote address of the request.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client that made the request. For
+// requests made by a trusted proxy, this is the last address that the proxy
+// added to the X-Forwarded-For header.
+func clientIP(r *http.Request) string {
+	if isTrustedProxy(r) {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); len(ip) > 0 {
+			return ip
+		}
+	}
+	return remoteHost(r)
+}
+
+// isTrustedProxy returns whether the request was made by a trusted proxy.
+func isTrustedProxy(r *http.Request) bool {
+	ip := net.ParseIP(remoteHost(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range settingsFor(r).trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthenticatedUser returns an HTTPError if the request was made by a
+// trusted proxy, and the given email does not match the authenticated user
+// that the proxy reported. Requests from other clients are not checked.
+func checkAuthenticatedUser(r *http.Request, email string) error {
+	if !isTrustedProxy(r) {
+		return nil
+	}
+
+	if !isAuthenticatedUser(r, email) {
+		return &HTTPError{
+			Code:    http.StatusForbidden,
+			Message: errAuthenticatedUserMismatch,
+		}
+	}
+	return nil
+}
+
+// isAuthenticatedUser returns whether the request was made by a trusted proxy
+// that reported the given email as the authenticated user.
+func isAuthenticatedUser(r *http.Request, email string) bool {
+	if !isTrustedProxy(r) {
+		return false
+	}
+	user := strings.TrimSpace(r.Header.Get(settingsFor(r).authenticatedUserHeader))
+	return len(user) > 0 && strings.EqualFold(user, email)
+}
+
+func validateProxy(config *Configuration, s *settings) (err error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range config.Proxy.Trusted {
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(cidr); err != nil {
+			return
+		}
+		networks = append(networks, network)
+	}
+	s.trustedProxies = networks
+
+	s.authenticatedUserHeader = DefaultAuthenticatedUserHeader
+	if len(config.Proxy.Header) > 0 {
+		s.authenticatedUserHeader = config.Proxy.Header
+	}
+
+	return
+}
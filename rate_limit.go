@@ -0,0 +1,190 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error messages.
+const (
+	errInvalidRateLimit = "rate limit of %v requests per second with a burst of %d is invalid."
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled completely
+// are discarded, so that the number of tracked clients does not grow without
+// bound.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitOptions controls how RateLimit limits requests.
+//
+// Each client IP address has a token bucket that holds up to Burst tokens,
+// and is refilled at Rate tokens per second. Each request takes one token,
+// except for batch certificate requests, which take one token for each
+// certificate requested. If ByEmail is true, the email of each requested
+// certificate is also given a bucket of its own, and requests must have
+// tokens available in all of them.
+type RateLimitOptions struct {
+	Rate    float64
+	Burst   int
+	ByEmail bool
+}
+
+// tokenBucket is a token bucket for a single client IP address or email.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter holds the token buckets of a rate limited handler.
+type rateLimiter struct {
+	options   RateLimitOptions
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// take takes n tokens from the bucket for key. If the bucket holds fewer than
+// n tokens, it returns false, along with how long it will be until they are
+// available.
+func (l *rateLimiter) take(key string, n int, now time.Time) (ok bool, retryAfter time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	burst := float64(l.options.Burst)
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for k, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.options.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.options.Rate)
+	bucket.updated = now
+
+	if bucket.tokens < float64(n) {
+		return false, time.Duration((float64(n) - bucket.tokens) / l.options.Rate * float64(time.Second))
+	}
+	bucket.tokens -= float64(n)
+	return true, 0
+}
+
+// requestEmails returns the email of each certificate requested by a
+// certificate request, restoring the request body so that the handler can
+// still read it. A batch request has an entry for each element of its JSON
+// array, and any other request has a single entry. Entries are empty if no
+// email could be read.
+func requestEmails(w http.ResponseWriter, r *http.Request) (emails []string, err error) {
+	limitRequestBody(w, r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = readError(err)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	type request struct {
+		Email string `json:"email"`
+	}
+	var batch []request
+	if json.Unmarshal(body, &batch) != nil || len(batch) == 0 {
+		var req request
+		json.Unmarshal(body, &req)
+		batch = []request{req}
+	}
+	for _, req := range batch {
+		emails = append(emails, CanonicalizeEmail(req.Email))
+	}
+	return
+}
+
+// RateLimit wraps a handler, limiting how often each client may call it as
+// controlled by the given options. Requests over the limit get
+// StatusTooManyRequests (429), with a Retry-After header giving the number of
+// seconds until the client may try again.
+func RateLimit(f http.HandlerFunc, options RateLimitOptions) http.HandlerFunc {
+	limiter := &rateLimiter{
+		options: options,
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		emails, err := requestEmails(rw, req)
+		if err != nil {
+			writeError(rw, err)
+			return
+		}
+
+		keys := []string{"ip:" + clientIP(req)}
+		tokens := map[string]int{keys[0]: len(emails)}
+		if options.ByEmail {
+			for _, email := range emails {
+				if len(email) == 0 {
+					continue
+				}
+				key := "email:" + email
+				if tokens[key] == 0 {
+					keys = append(keys, key)
+				}
+				tokens[key]++
+			}
+		}
+
+		for _, key := range keys {
+			if ok, retryAfter := limiter.take(key, tokens[key], now); !ok {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+				httpError(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		f(rw, req)
+	}
+}
+
+// rateLimit wraps the handler with RateLimit, unless rate limiting has not
+// been enabled.
+func rateLimit(f http.HandlerFunc) http.HandlerFunc {
+	s := loadSettings()
+	if !s.rateLimitEnabled {
+		return f
+	}
+	return RateLimit(f, s.rateLimitOptions)
+}
+
+func validateRateLimit(config *Configuration, s *settings) (err error) {
+	s.rateLimitEnabled = config.RateLimit.Enabled
+	if !s.rateLimitEnabled {
+		return
+	}
+	if config.RateLimit.Rate <= 0 || config.RateLimit.Burst < 1 {
+		err = fmt.Errorf(errInvalidRateLimit, config.RateLimit.Rate, config.RateLimit.Burst)
+		return
+	}
+	s.rateLimitOptions = RateLimitOptions{
+		Rate:    config.RateLimit.Rate,
+		Burst:   config.RateLimit.Burst,
+		ByEmail: config.RateLimit.ByEmail,
+	}
+
+	return
+}
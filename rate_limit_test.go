@@ -0,0 +1,112 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rateLimitStatus returns the status of a POST request with the given body to
+// the rate limited handler.
+func rateLimitStatus(handler http.HandlerFunc, body string) int {
+	r := httptest.NewRequest("POST", "/certificate", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestRateLimitBatchTakesTokenPerCertificate(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	options := RateLimitOptions{Rate: 0.001, Burst: 3}
+
+	handler := RateLimit(ok, options)
+	if status := rateLimitStatus(handler, `[{"email":"a@example.com"},{"email":"b@example.com"},{"email":"c@example.com"}]`); status != http.StatusOK {
+		t.Fatalf("batch within the burst: status = %d, want %d", status, http.StatusOK)
+	}
+	if status := rateLimitStatus(handler, `{"email":"a@example.com"}`); status != http.StatusTooManyRequests {
+		t.Errorf("request after the batch: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	handler = RateLimit(ok, options)
+	if status := rateLimitStatus(handler, `[{},{},{},{}]`); status != http.StatusTooManyRequests {
+		t.Errorf("batch over the burst: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if status := rateLimitStatus(handler, `{}`); status != http.StatusOK {
+		t.Errorf("request after a refused batch: status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestRateLimitBatchByEmail(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	handler := RateLimit(ok, RateLimitOptions{Rate: 0.001, Burst: 2, ByEmail: true})
+
+	r := httptest.NewRequest("POST", "/certificate", strings.NewReader(`[{"email":"a@example.com"},{"email":"A@example.com"},{"email":"a@example.com"}]`))
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("batch repeating an email: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitBodyTooLarge(t *testing.T) {
+	called := false
+	handler := RateLimit(func(w http.ResponseWriter, r *http.Request) { called = true }, RateLimitOptions{Rate: 1, Burst: 1})
+	body := `{"email":"` + strings.Repeat("a", maxRequestBodyBytes) + `"}`
+	if status := rateLimitStatus(handler, body); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if called {
+		t.Error("handler was called with a body that was too large")
+	}
+}
+
+func TestRateLimiterTakeTokens(t *testing.T) {
+	now := time.Now()
+	limiter := &rateLimiter{
+		options: RateLimitOptions{Rate: 1, Burst: 5},
+		buckets: make(map[string]*tokenBucket),
+	}
+	if ok, _ := limiter.take("ip:a", 5, now); !ok {
+		t.Fatal("could not take a full burst of tokens")
+	}
+	ok, retryAfter := limiter.take("ip:a", 2, now)
+	if ok || retryAfter != 2*time.Second {
+		t.Errorf("take from an empty bucket = %v, %v; want false, 2s", ok, retryAfter)
+	}
+}
+
+func TestGenerateCertificatesBatchLimit(t *testing.T) {
+	p := testProvider(t)
+	key, _ := testSigningKey(t)
+	p.key = key
+	p.Issuer = "example.com"
+	if err := p.sessions().NewSession("user@example.com", ""); err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	item := `{"email":"user@example.com","public-key":{"algorithm":"RS","n":"1","e":"65537"},"duration":"3600"}`
+	items := make([]string, MaxBatchCertificates+1)
+	for i := range items {
+		items[i] = item
+	}
+	r := httptest.NewRequest("POST", "/certificates", strings.NewReader("["+strings.Join(items, ",")+"]"))
+	r.Header.Set("Content-Type", ContentTypeJson)
+	w := httptest.NewRecorder()
+	p.GenerateCertificates(w, r)
+
+	results := strings.Count(w.Body.String(), `"certificate":`)
+	if results != MaxBatchCertificates {
+		t.Errorf("issued %d certificates, want %d", results, MaxBatchCertificates)
+	}
+	if !strings.Contains(w.Body.String(), "must not request more than") {
+		t.Error("the request for too many certificates was not reported")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// readyRetryAfter is the number of seconds that clients are asked to wait
+// before retrying a request that was made before the IdP was ready.
+const readyRetryAfter = "1"
+
+// SetReady sets whether the default provider is ready to serve requests.
+func SetReady(isReady bool) {
+	DefaultProvider.SetReady(isReady)
+}
+
+// IsReady returns whether the default provider is ready to serve requests.
+func IsReady() bool {
+	return DefaultProvider.IsReady()
+}
+
+// SetReady sets whether the provider is ready to serve requests. It is called
+// automatically once a support document has been set, but may also be called
+// directly, e.g. to stop serving requests during shutdown.
+func (p *Provider) SetReady(isReady bool) {
+	if isReady {
+		atomic.StoreInt32(&p.ready, 1)
+	} else {
+		atomic.StoreInt32(&p.ready, 0)
+	}
+}
+
+// IsReady returns whether the provider is ready to serve requests.
+func (p *Provider) IsReady() bool {
+	return atomic.LoadInt32(&p.ready) != 0
+}
+
+// whenReady wraps a handler, responding with StatusServiceUnavailable (503)
+// until the provider is ready to serve requests. Once ready, the handler is
+// run with the settings that are current when the request starts, which it
+// keeps even if ReloadConfig replaces them while it runs.
+func (p *Provider) whenReady(f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !p.IsReady() {
+			rw.Header().Set("Retry-After", readyRetryAfter)
+			httpError(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		f(rw, withSettings(req))
+	}
+}
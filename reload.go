@@ -0,0 +1,58 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"reflect"
+	"time"
+)
+
+// ReloadConfig loads the configuration at filePath, and replaces the running
+// configuration with it. Requests that are already being served finish with
+// the previous configuration, and later requests use the new one.
+//
+// The new configuration is validated, and its support document generated,
+// before anything is replaced, so requests are never blocked by a reload and
+// never see a partially reloaded configuration. If the new configuration is
+// invalid, an error is returned and the running configuration is kept.
+//
+// The private key, templates, issuer, certificate, session duration, HTTP
+// error, compression, audit, proxy, and tenant settings are reloaded, and the
+// support document is regenerated. The session backing, the debug server,
+// delegation, and the URLs that handlers are registered at are only read on
+// startup, so changing them requires a restart.
+//
+// If the new private key differs from the current one, the current one is
+// retired, as with RotatePrivateKey.
+func ReloadConfig(filePath string) (err error) {
+	config, err := decodeConfigFile(filePath)
+	if err != nil {
+		return
+	}
+	s, err := stageConfig(config)
+	if err != nil {
+		return
+	}
+	doc, err := DefaultProvider.buildSupportDocument(config, DefaultProvider.signingKey(s))
+	if err != nil {
+		discardSettings(s)
+		return
+	}
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	previousKey := loadSettings().privateKey
+	publishSettings(s)
+	if previousKey != nil && s.privateKey != nil && !reflect.DeepEqual(previousKey.key, s.privateKey.key) {
+		retirePrivateKey(previousKey)
+	} else {
+		// The retired key limits may have changed.
+		pruneRetiredKeys(time.Now())
+	}
+	DefaultProvider.SetSupportDocument(doc)
+
+	return
+}
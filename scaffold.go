@@ -0,0 +1,189 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files created by Scaffold.
+const (
+	ScaffoldConfigFile         = "persona-config.json"
+	ScaffoldPrivateKeyFile     = "persona.key"
+	ScaffoldAuthenticationFile = "authentication.html"
+	ScaffoldProvisioningFile   = "provisioning.html"
+	ScaffoldSessionFile        = "accounts.db"
+)
+
+// Error messages.
+const (
+	errScaffoldFileExists = "'%s' already exists."
+)
+
+// Templates created by Scaffold.
+const (
+	scaffoldAuthenticationTemplate = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>Persona authentication</title>
+		<script src="https://login.persona.org/authentication_api.js"></script>
+		<script>
+			navigator.id.beginAuthentication(function(email) {
+				// TODO: Authenticate the user, then call
+				// navigator.id.completeAuthentication().
+				navigator.id.raiseAuthenticationFailure('not implemented');
+			});
+		</script>
+	</head>
+	<body>
+	</body>
+</html>
+`
+	scaffoldProvisioningTemplate = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>Persona provisioning</title>
+		<script src="https://login.persona.org/provisioning_api.js"></script>
+		<script>
+			navigator.id.beginProvisioning(function(email, certDuration) {
+				// TODO: Confirm that the user has a session, then generate
+				// and register a certificate.
+				navigator.id.raiseProvisioningFailure('not implemented');
+			});
+		</script>
+	</head>
+	<body>
+	</body>
+</html>
+`
+)
+
+// Scaffold creates a starter configuration in the given directory, consisting
+// of a newly generated private key of the given type, minimal authentication
+// and provisioning templates, and a configuration file that refers to them.
+// The configuration uses localhost as the issuer, and so enables dev mode.
+// Existing files are never overwritten.
+func Scaffold(dir string, keyType string) (err error) {
+	keyType = strings.ToUpper(keyType)
+	if _, supported := SupportedPrivateKeyTypes[keyType]; !supported {
+		return fmt.Errorf(errKeyTypeNotSupported, keyType)
+	}
+
+	paths := map[string]string{}
+	for _, file := range []string{
+		ScaffoldConfigFile,
+		ScaffoldPrivateKeyFile,
+		ScaffoldAuthenticationFile,
+		ScaffoldProvisioningFile,
+	} {
+		paths[file] = filepath.Join(dir, file)
+		if _, err = os.Stat(paths[file]); err == nil {
+			return fmt.Errorf(errScaffoldFileExists, paths[file])
+		}
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	keyPem, err := generatePrivateKeyPEM(keyType)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(paths[ScaffoldPrivateKeyFile], keyPem, 0600); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(paths[ScaffoldAuthenticationFile], []byte(scaffoldAuthenticationTemplate), 0644); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(paths[ScaffoldProvisioningFile], []byte(scaffoldProvisioningTemplate), 0644); err != nil {
+		return
+	}
+
+	config := map[string]interface{}{
+		"private-key": map[string]interface{}{
+			"type": keyType,
+			"file": paths[ScaffoldPrivateKeyFile],
+		},
+		"authentication": map[string]interface{}{
+			"url":      "/persona/authentication",
+			"template": paths[ScaffoldAuthenticationFile],
+			"disabled": false,
+		},
+		"provisioning": map[string]interface{}{
+			"url":      "/persona/provisioning",
+			"template": paths[ScaffoldProvisioningFile],
+			"disabled": false,
+		},
+		"session": map[string]interface{}{
+			"url":     "/persona/session",
+			"store":   "sqlite",
+			"backing": filepath.Join(dir, ScaffoldSessionFile),
+		},
+		"issuer":          "localhost",
+		"certificate-url": "/persona/certificate",
+		"dev":             true,
+	}
+	configJson, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(paths[ScaffoldConfigFile], append(configJson, '\n'), 0644)
+
+	return
+}
+
+// generatePrivateKeyPEM generates a new private key of the given type, and
+// returns it PEM encoded.
+func generatePrivateKeyPEM(keyType string) (keyPem []byte, err error) {
+	var block *pem.Block
+	switch keyType {
+	case "DSA":
+		key := new(dsa.PrivateKey)
+		if err = dsa.GenerateParameters(&key.Parameters, rand.Reader, dsa.L2048N256); err != nil {
+			return
+		}
+		if err = dsa.GenerateKey(key, rand.Reader); err != nil {
+			return
+		}
+		block = &pem.Block{Type: "DSA PRIVATE KEY"}
+		block.Bytes, err = MarshalDSAPrivateKey(key)
+	case "ECDSA":
+		var key *ecdsa.PrivateKey
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY"}
+		block.Bytes, err = x509.MarshalECPrivateKey(key)
+	case "RSA":
+		var key *rsa.PrivateKey
+		if key, err = rsa.GenerateKey(rand.Reader, MinKeySizeRSA); err != nil {
+			return
+		}
+		block = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+	default:
+		err = fmt.Errorf(errKeyTypeNotSupported, keyType)
+	}
+	if err != nil {
+		return
+	}
+
+	keyPem = pem.EncodeToMemory(block)
+	return
+}
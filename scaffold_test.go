@@ -0,0 +1,53 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaffoldLoads(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) {})
+	defer func(backing SessionBacking) { sessionBacking = backing }(sessionBacking)
+	defer SetAuthenticationTemplateParam("URL", AuthenticationTemplateParams["URL"])
+	defer SetProvisioningTemplateParam("URL", ProvisioningTemplateParams["URL"])
+
+	for _, keyType := range []string{"ECDSA", "RSA"} {
+		dir := t.TempDir()
+		if err := Scaffold(dir, keyType); err != nil {
+			t.Fatalf("%s: Scaffold: %v", keyType, err)
+		}
+
+		sessionBacking = nil
+		configFile := filepath.Join(dir, ScaffoldConfigFile)
+		if _, err := LoadConfig(configFile); err != nil {
+			t.Fatalf("%s: the generated configuration did not load: %v", keyType, err)
+		}
+		backing, ok := sessionBacking.(*SQLiteBacking)
+		if !ok {
+			t.Fatalf("%s: session backing is %T, want *SQLiteBacking", keyType, sessionBacking)
+		}
+		backing.Close()
+
+		s := loadSettings()
+		if alg := s.privateKey.supportDoc.KeyAlgorithm(); alg != PrivateKeyTypeToAlgorithm[keyType] {
+			t.Errorf("%s: key algorithm = %q, want %q", keyType, alg, PrivateKeyTypeToAlgorithm[keyType])
+		}
+		if s.defaultIssuer != "localhost" {
+			t.Errorf("%s: issuer = %q, want localhost", keyType, s.defaultIssuer)
+		}
+
+		want := fmt.Sprintf(errScaffoldFileExists, configFile)
+		if err := Scaffold(dir, keyType); err == nil || err.Error() != want {
+			t.Errorf("%s: Scaffold over an existing configuration = %v, want %q", keyType, err, want)
+		}
+	}
+
+	if err := Scaffold(t.TempDir(), "unknown"); err == nil {
+		t.Error("Scaffold with an unsupported key type succeeded")
+	}
+}
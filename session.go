@@ -4,35 +4,154 @@
 
 package persona
 
-// SessionMaxDuration is the maximum duration, in seconds, that a session can
-// be valid for.
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SessionMaxDuration is the default maximum duration, in seconds, that a
+// session can be valid for.
 const SessionMaxDuration = 86400
 
+// SessionDurationFor, if set, returns the duration, in seconds, of new
+// sessions for the given email address, so that session lengths can vary by
+// user. Durations are still capped at the maximum session duration, which is
+// also used for durations that are not positive.
+var SessionDurationFor func(email string) (duration int)
+
+// sessionsToKeep returns how many of the existing sessions for an email are
+// kept when a new session is created for it. A maximum of zero sessions per
+// email allows a single session, which each new session replaces.
+func sessionsToKeep(maxPerEmail int) int {
+	if maxPerEmail > 0 {
+		return maxPerEmail - 1
+	}
+	return 0
+}
+
+// newSessionDuration returns the duration, in seconds, of a new session for
+// the given email address.
+func newSessionDuration(email string) int {
+	maxDuration := loadSettings().sessionMaxDuration
+	if SessionDurationFor != nil {
+		if duration := SessionDurationFor(email); duration > 0 && duration < maxDuration {
+			return duration
+		}
+	}
+	return maxDuration
+}
+
 // Error messages.
 const (
-	errSessionBackingNotOpened  = "session backing has not been opened."
-	errSessionBackingUndefined  = "session backing is undefined."
-	errNewSessionNoRowsAffected = "failed to create a new session: no rows affected"
+	errSessionBackingNotOpened   = "session backing has not been opened."
+	errSessionBackingNotWritable = "session backing '%s' is not writable: %s"
+	errSessionBackingUndefined   = "session backing is undefined."
+	errNewSessionEmptyEmail      = "failed to create a new session: email is empty."
+	errNewSessionNoRowsAffected  = "failed to create a new session: no rows affected"
 )
 
 // SessionBacking is the interface used by all session backings.
+//
+// NewSession is given the email address as entered by the user, and an ID for
+// the session. Sessions are looked up by email address, which backings should
+// compare in the form returned by CanonicalizeEmail.
 type SessionBacking interface {
 	Open(string) error
 	Close() error
 	NewSession(string, string) error
 	HasSession(string) (bool, error)
+	SessionTTL(string) (time.Duration, bool, error)
+	DeleteSession(string) error
+}
+
+// SessionBackingContext is implemented by session backings that can abandon
+// their work once a context is done, such as when the client of the request
+// being served disconnects. The handlers use these methods when they are
+// available.
+type SessionBackingContext interface {
+	SessionBacking
+	NewSessionContext(context.Context, string, string) error
+	HasSessionContext(context.Context, string) (bool, error)
+	SessionTTLContext(context.Context, string) (time.Duration, bool, error)
+	DeleteSessionContext(context.Context, string) error
+}
+
+// newSession calls the NewSessionContext method of the backing if it has one,
+// or its NewSession method if not.
+func newSession(ctx context.Context, backing SessionBacking, email, id string) error {
+	if b, ok := backing.(SessionBackingContext); ok {
+		return b.NewSessionContext(ctx, email, id)
+	}
+	return backing.NewSession(email, id)
+}
+
+// hasSession calls the HasSessionContext method of the backing if it has one,
+// or its HasSession method if not.
+func hasSession(ctx context.Context, backing SessionBacking, email string) (bool, error) {
+	if b, ok := backing.(SessionBackingContext); ok {
+		return b.HasSessionContext(ctx, email)
+	}
+	return backing.HasSession(email)
+}
+
+// sessionTTL calls the SessionTTLContext method of the backing if it has one,
+// or its SessionTTL method if not.
+func sessionTTL(ctx context.Context, backing SessionBacking, email string) (time.Duration, bool, error) {
+	if b, ok := backing.(SessionBackingContext); ok {
+		return b.SessionTTLContext(ctx, email)
+	}
+	return backing.SessionTTL(email)
+}
+
+// deleteSession calls the DeleteSessionContext method of the backing if it
+// has one, or its DeleteSession method if not.
+func deleteSession(ctx context.Context, backing SessionBacking, email string) error {
+	if b, ok := backing.(SessionBackingContext); ok {
+		return b.DeleteSessionContext(ctx, email)
+	}
+	return backing.DeleteSession(email)
 }
 
 var sessionBacking SessionBacking
 
+// CanonicalizeEmail returns the canonical form of the given email address, so
+// that addresses differing only in case refer to the same session. Both the
+// local part and the domain are lowercased, as is the case for the vast
+// majority of mail providers.
+func CanonicalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return strings.ToLower(email)
+	}
+	return strings.ToLower(email[:at]) + "@" + strings.ToLower(email[at+1:])
+}
+
 // SetSessionBacking uses the supplied session backing.
 func SetSessionBacking(backing SessionBacking) {
 	sessionBacking = backing
 }
 
 // CloseSessionBacking closes the session backing.
-func CloseSessionBacking() {
+func CloseSessionBacking() error {
 	if sessionBacking != nil {
-		sessionBacking.Close()
+		return sessionBacking.Close()
+	}
+	return nil
+}
+
+// setConnPoolLimits applies the given connection pool limits to db. Zero
+// values leave the corresponding default in place.
+func setConnPoolLimits(db *sql.DB, maxOpen, maxIdle int, maxLifetime time.Duration) {
+	if maxOpen > 0 {
+		db.SetMaxOpenConns(maxOpen)
+	}
+	if maxIdle > 0 {
+		db.SetMaxIdleConns(maxIdle)
+	}
+	if maxLifetime > 0 {
+		db.SetConnMaxLifetime(maxLifetime)
 	}
 }
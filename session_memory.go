@@ -0,0 +1,156 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Error messages.
+const (
+	errInvalidJanitorInterval = "janitor interval '%s' is invalid."
+)
+
+// MemoryBacking implements the SessionBacking interface, and keeps sessions in
+// memory, keyed by canonical email address. Sessions do not survive a
+// restart, and are not shared between processes, so it is best suited to
+// testing and small deployments.
+type MemoryBacking struct {
+	mutex    sync.RWMutex
+	sessions map[string]time.Time
+	stop     chan struct{}
+}
+
+// Open implements the Open method of the SessionBacking interface. The
+// location is optional, and if given is the interval, such as "10m", at which
+// expired sessions are removed. Expired sessions are otherwise only removed
+// when they are replaced or deleted.
+func (b *MemoryBacking) Open(location string) (err error) {
+	var interval time.Duration
+	if len(location) > 0 {
+		if interval, err = time.ParseDuration(location); err != nil || interval <= 0 {
+			err = fmt.Errorf(errInvalidJanitorInterval, location)
+			return
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sessions == nil {
+		b.sessions = make(map[string]time.Time)
+	}
+	if interval > 0 && b.stop == nil {
+		b.stop = make(chan struct{})
+		go b.janitor(interval, b.stop)
+	}
+
+	return
+}
+
+// Close implements the Close method of the SessionBacking interface.
+func (b *MemoryBacking) Close() (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	b.sessions = nil
+
+	return
+}
+
+// Ping implements the Ping method of the SessionBackingPinger interface.
+func (b *MemoryBacking) Ping(ctx context.Context) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.sessions == nil {
+		return errors.New(errSessionBackingNotOpened)
+	}
+	return nil
+}
+
+// NewSession implements the NewSession method of the SessionBacking interface.
+// The session ID is not stored.
+func (b *MemoryBacking) NewSession(email, id string) (err error) {
+	if len(CanonicalizeEmail(email)) == 0 {
+		err = errors.New(errNewSessionEmptyEmail)
+		return
+	}
+	duration := newSessionDuration(email)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sessions == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	b.sessions[CanonicalizeEmail(email)] = time.Now().Add(time.Duration(duration) * time.Second)
+
+	return
+}
+
+// HasSession implements the HasSession method of the SessionBacking interface.
+func (b *MemoryBacking) HasSession(email string) (hasSession bool, err error) {
+	_, hasSession, err = b.SessionTTL(email)
+	return
+}
+
+// SessionTTL implements the SessionTTL method of the SessionBacking interface.
+func (b *MemoryBacking) SessionTTL(email string) (ttl time.Duration, hasSession bool, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.sessions == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if expiry, exists := b.sessions[CanonicalizeEmail(email)]; exists {
+		if ttl = expiry.Sub(time.Now()); ttl > 0 {
+			hasSession = true
+		} else {
+			ttl = 0
+		}
+	}
+
+	return
+}
+
+// DeleteSession implements the DeleteSession method of the SessionBacking
+// interface. Deleting a session that does not exist is not an error.
+func (b *MemoryBacking) DeleteSession(email string) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.sessions == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	delete(b.sessions, CanonicalizeEmail(email))
+
+	return
+}
+
+// janitor removes expired sessions every interval, until stop is closed.
+func (b *MemoryBacking) janitor(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			b.mutex.Lock()
+			for email, expiry := range b.sessions {
+				if !expiry.After(now) {
+					delete(b.sessions, email)
+				}
+			}
+			b.mutex.Unlock()
+		}
+	}
+}
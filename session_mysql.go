@@ -0,0 +1,384 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+//
+//	sessions table schema:
+//
+//	id              BIGINT       NOT NULL PRIMARY KEY AUTO_INCREMENT
+//	email           VARCHAR(254) NOT NULL
+//	email_canonical VARCHAR(254) NOT NULL
+//	duration        INT          NOT NULL
+//	created_at      TIMESTAMP    NOT NULL             DEFAULT CURRENT_TIMESTAMP
+//
+//	INDEX sessions_email_canonical_created_at (email_canonical, created_at)
+//
+
+// Queries used by the MySQL session backing.
+const (
+	mysqlCreateSessionsTableQuery = `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id              BIGINT       NOT NULL PRIMARY KEY AUTO_INCREMENT,
+			email           VARCHAR(254) NOT NULL,
+			email_canonical VARCHAR(254) NOT NULL,
+			duration        INT          NOT NULL,
+			created_at      TIMESTAMP    NOT NULL             DEFAULT CURRENT_TIMESTAMP,
+			INDEX sessions_email_canonical_created_at (email_canonical, created_at)
+		)
+	`
+	mysqlUniqueEmailIndexesQuery = `
+		SELECT DISTINCT index_name
+		FROM information_schema.statistics
+		WHERE table_schema=DATABASE()
+		AND table_name='sessions'
+		AND column_name='email_canonical'
+		AND non_unique=0
+	`
+	mysqlHasSessionsIndexQuery = `
+		SELECT count(*)
+		FROM information_schema.statistics
+		WHERE table_schema=DATABASE()
+		AND table_name='sessions'
+		AND index_name='sessions_email_canonical_created_at'
+	`
+	mysqlCreateSessionsIndexQuery = `
+		CREATE INDEX sessions_email_canonical_created_at
+		ON sessions (email_canonical, created_at)
+	`
+	mysqlWriteProbeQuery = `
+		DELETE FROM sessions
+		WHERE 0
+	`
+	mysqlNewSessionQuery = `
+		INSERT INTO sessions
+		(email, email_canonical, duration)
+		VALUES
+		(?, ?, ?)
+	`
+	mysqlEvictSessionsQuery = `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT id FROM (
+				SELECT id
+				FROM sessions
+				WHERE email_canonical=?
+				ORDER BY created_at DESC, id DESC
+				LIMIT 18446744073709551615 OFFSET ?
+			) AS evicted
+		)
+	`
+	mysqlHasSessionQuery = `
+		SELECT id
+		FROM sessions
+		WHERE email_canonical=?
+		AND created_at + INTERVAL duration SECOND > NOW()
+	`
+	mysqlDeleteSessionQuery = `
+		DELETE FROM sessions
+		WHERE email_canonical=?
+	`
+	mysqlSessionTTLQuery = `
+		SELECT MAX(TIMESTAMPDIFF(SECOND, NOW(), created_at + INTERVAL duration SECOND))
+		FROM sessions
+		WHERE email_canonical=?
+	`
+)
+
+// MySQLBacking implements the SessionBacking interface, and allows for
+// manipulating sessions stored in a MySQL or MariaDB database.
+//
+// MaxOpenConns, MaxIdleConns, ConnMaxLifetime, and MaxPerEmail behave as they
+// do for SQLiteBacking.
+type MySQLBacking struct {
+	DB                *sql.DB
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnMaxLifetime   time.Duration
+	MaxPerEmail       int
+	newSessionStmt    *sql.Stmt
+	evictSessionsStmt *sql.Stmt
+	hasSessionStmt    *sql.Stmt
+	sessionTTLStmt    *sql.Stmt
+	deleteSessionStmt *sql.Stmt
+}
+
+// Open implements the Open method of the SessionBacking interface. The
+// location is a go-sql-driver/mysql data source name. The sessions table and
+// its index are created if they do not already exist, a table that only allows
+// a single session per email is migrated, and the database is checked to be
+// writable.
+func (b *MySQLBacking) Open(location string) (err error) {
+	db, err := sql.Open("mysql", location)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+	setConnPoolLimits(db, b.MaxOpenConns, b.MaxIdleConns, b.ConnMaxLifetime)
+	if err = db.Ping(); err != nil {
+		return
+	}
+	// The data source name may contain a password, so it is left out of
+	// any errors.
+	if _, err = db.Exec(mysqlCreateSessionsTableQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "mysql", err)
+	}
+	if err = migrateMySQLSessions(db); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "mysql", err)
+	}
+
+	// Confirm that writes succeed, without actually changing anything.
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(mysqlWriteProbeQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "mysql", err)
+	}
+
+	// The database is only kept once it is known to be usable.
+	b.DB = db
+
+	return
+}
+
+// migrateMySQLSessions migrates a sessions table that was created when each
+// email could only have a single session, by dropping its UNIQUE index on
+// email_canonical and creating the non-unique index in its place.
+func migrateMySQLSessions(db *sql.DB) (err error) {
+	rows, err := db.Query(mysqlUniqueEmailIndexesQuery)
+	if err != nil {
+		return
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err = rows.Scan(&index); err != nil {
+			rows.Close()
+			return
+		}
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, index := range indexes {
+		if index == "PRIMARY" {
+			continue
+		}
+		quoted := "`" + strings.Replace(index, "`", "``", -1) + "`"
+		if _, err = db.Exec("ALTER TABLE sessions DROP INDEX " + quoted); err != nil {
+			return
+		}
+	}
+
+	var hasIndex int
+	if err = db.QueryRow(mysqlHasSessionsIndexQuery).Scan(&hasIndex); err != nil || hasIndex > 0 {
+		return
+	}
+	_, err = db.Exec(mysqlCreateSessionsIndexQuery)
+	return
+}
+
+// Close implements the Close method of the SessionBacking interface.
+func (b *MySQLBacking) Close() (err error) {
+	if b.DB != nil {
+		err = b.DB.Close()
+		b.DB = nil
+	}
+	if b.newSessionStmt != nil {
+		err = b.newSessionStmt.Close()
+		b.newSessionStmt = nil
+	}
+	if b.evictSessionsStmt != nil {
+		err = b.evictSessionsStmt.Close()
+		b.evictSessionsStmt = nil
+	}
+	if b.hasSessionStmt != nil {
+		err = b.hasSessionStmt.Close()
+		b.hasSessionStmt = nil
+	}
+	if b.sessionTTLStmt != nil {
+		err = b.sessionTTLStmt.Close()
+		b.sessionTTLStmt = nil
+	}
+	if b.deleteSessionStmt != nil {
+		err = b.deleteSessionStmt.Close()
+		b.deleteSessionStmt = nil
+	}
+
+	return
+}
+
+// Ping implements the Ping method of the SessionBackingPinger interface.
+func (b *MySQLBacking) Ping(ctx context.Context) error {
+	if b.DB == nil {
+		return errors.New(errSessionBackingNotOpened)
+	}
+	return b.DB.PingContext(ctx)
+}
+
+// NewSession implements the NewSession method of the SessionBacking interface.
+// The email is stored alongside its canonical form, and the session ID is not
+// stored.
+func (b *MySQLBacking) NewSession(email, id string) error {
+	return b.NewSessionContext(context.Background(), email, id)
+}
+
+// NewSessionContext implements the NewSessionContext method of the
+// SessionBackingContext interface.
+func (b *MySQLBacking) NewSessionContext(ctx context.Context, email, id string) (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if len(CanonicalizeEmail(email)) == 0 {
+		err = errors.New(errNewSessionEmptyEmail)
+		return
+	}
+	if b.newSessionStmt == nil {
+		b.newSessionStmt, err = b.DB.PrepareContext(ctx, mysqlNewSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.evictSessionsStmt == nil {
+		b.evictSessionsStmt, err = b.DB.PrepareContext(ctx, mysqlEvictSessionsQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// Make room for the new session by evicting the oldest sessions.
+	canonical := CanonicalizeEmail(email)
+	if _, err = tx.Stmt(b.evictSessionsStmt).ExecContext(ctx, canonical, sessionsToKeep(b.MaxPerEmail)); err != nil {
+		return
+	}
+
+	result, err := tx.Stmt(b.newSessionStmt).ExecContext(ctx, email, canonical, newSessionDuration(email))
+	if err != nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		err = errors.New(errNewSessionNoRowsAffected)
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// HasSession implements the HasSession method of the SessionBacking interface.
+func (b *MySQLBacking) HasSession(email string) (bool, error) {
+	return b.HasSessionContext(context.Background(), email)
+}
+
+// HasSessionContext implements the HasSessionContext method of the
+// SessionBackingContext interface.
+func (b *MySQLBacking) HasSessionContext(ctx context.Context, email string) (hasSession bool, err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.hasSessionStmt == nil {
+		b.hasSessionStmt, err = b.DB.PrepareContext(ctx, mysqlHasSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	var id int64
+	err = b.hasSessionStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&id)
+	switch err {
+	case nil:
+		hasSession = true
+	case sql.ErrNoRows:
+		err = nil
+	}
+	return
+}
+
+// SessionTTL implements the SessionTTL method of the SessionBacking interface.
+// The remaining lifetime is that of the longest lived session for the email.
+func (b *MySQLBacking) SessionTTL(email string) (time.Duration, bool, error) {
+	return b.SessionTTLContext(context.Background(), email)
+}
+
+// SessionTTLContext implements the SessionTTLContext method of the
+// SessionBackingContext interface.
+func (b *MySQLBacking) SessionTTLContext(ctx context.Context, email string) (ttl time.Duration, hasSession bool, err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.sessionTTLStmt == nil {
+		b.sessionTTLStmt, err = b.DB.PrepareContext(ctx, mysqlSessionTTLQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	var remaining sql.NullInt64
+	if err = b.sessionTTLStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&remaining); err != nil {
+		return
+	}
+	if remaining.Valid && remaining.Int64 > 0 {
+		ttl = time.Duration(remaining.Int64) * time.Second
+		hasSession = true
+	}
+	return
+}
+
+// DeleteSession implements the DeleteSession method of the SessionBacking
+// interface. Deleting a session that does not exist is not an error.
+func (b *MySQLBacking) DeleteSession(email string) error {
+	return b.DeleteSessionContext(context.Background(), email)
+}
+
+// DeleteSessionContext implements the DeleteSessionContext method of the
+// SessionBackingContext interface.
+func (b *MySQLBacking) DeleteSessionContext(ctx context.Context, email string) (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.deleteSessionStmt == nil {
+		b.deleteSessionStmt, err = b.DB.PrepareContext(ctx, mysqlDeleteSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = b.deleteSessionStmt.ExecContext(ctx, CanonicalizeEmail(email))
+	return
+}
@@ -0,0 +1,337 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+//
+//	sessions table schema:
+//
+//	id              BIGSERIAL   NOT NULL PRIMARY KEY
+//	email           TEXT        NOT NULL
+//	email_canonical TEXT        NOT NULL
+//	duration        INTEGER     NOT NULL
+//	created_at      TIMESTAMPTZ NOT NULL             DEFAULT now()
+//
+//	INDEX sessions_email_canonical_created_at (email_canonical, created_at)
+//
+
+// Queries used by the PostgreSQL session backing.
+const (
+	postgresCreateSessionsTableQuery = `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id              BIGSERIAL   NOT NULL PRIMARY KEY,
+			email           TEXT        NOT NULL,
+			email_canonical TEXT        NOT NULL,
+			duration        INTEGER     NOT NULL,
+			created_at      TIMESTAMPTZ NOT NULL             DEFAULT now()
+		)
+	`
+	postgresDropUniqueEmailQuery = `
+		ALTER TABLE sessions
+		DROP CONSTRAINT IF EXISTS sessions_email_canonical_key
+	`
+	postgresCreateSessionsIndexQuery = `
+		CREATE INDEX IF NOT EXISTS sessions_email_canonical_created_at
+		ON sessions (email_canonical, created_at)
+	`
+	postgresWriteProbeQuery = `
+		DELETE FROM sessions
+		WHERE false
+	`
+	postgresNewSessionQuery = `
+		INSERT INTO sessions
+		(email, email_canonical, duration)
+		VALUES
+		($1, $2, $3)
+	`
+	postgresEvictSessionsQuery = `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT id
+			FROM sessions
+			WHERE email_canonical=$1
+			ORDER BY created_at DESC, id DESC
+			OFFSET $2
+		)
+	`
+	postgresHasSessionQuery = `
+		SELECT id
+		FROM sessions
+		WHERE email_canonical=$1
+		AND created_at + duration * INTERVAL '1 second' > now()
+	`
+	postgresDeleteSessionQuery = `
+		DELETE FROM sessions
+		WHERE email_canonical=$1
+	`
+	postgresSessionTTLQuery = `
+		SELECT floor(max(extract(EPOCH FROM
+			created_at + duration * INTERVAL '1 second' - now()
+		)))::bigint
+		FROM sessions
+		WHERE email_canonical=$1
+	`
+)
+
+// PostgresBacking implements the SessionBacking interface, and allows for
+// manipulating sessions stored in a PostgreSQL database.
+//
+// MaxOpenConns, MaxIdleConns, ConnMaxLifetime, and MaxPerEmail behave as they
+// do for SQLiteBacking.
+type PostgresBacking struct {
+	DB                *sql.DB
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnMaxLifetime   time.Duration
+	MaxPerEmail       int
+	newSessionStmt    *sql.Stmt
+	evictSessionsStmt *sql.Stmt
+	hasSessionStmt    *sql.Stmt
+	sessionTTLStmt    *sql.Stmt
+	deleteSessionStmt *sql.Stmt
+}
+
+// Open implements the Open method of the SessionBacking interface. The
+// location is a lib/pq connection string. The sessions table and its index are
+// created if they do not already exist, a table that only allows a single
+// session per email is migrated, and the database is checked to be writable.
+func (b *PostgresBacking) Open(location string) (err error) {
+	db, err := sql.Open("postgres", location)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+	setConnPoolLimits(db, b.MaxOpenConns, b.MaxIdleConns, b.ConnMaxLifetime)
+	if err = db.Ping(); err != nil {
+		return
+	}
+	// The connection string may contain a password, so it is left out of
+	// any errors.
+	if _, err = db.Exec(postgresCreateSessionsTableQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "postgres", err)
+	}
+
+	// Tables created when each email could only have a single session have
+	// a UNIQUE constraint, which is dropped in favor of the index.
+	if _, err = db.Exec(postgresDropUniqueEmailQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "postgres", err)
+	}
+	if _, err = db.Exec(postgresCreateSessionsIndexQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "postgres", err)
+	}
+
+	// Confirm that writes succeed, without actually changing anything.
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(postgresWriteProbeQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, "postgres", err)
+	}
+
+	// The database is only kept once it is known to be usable.
+	b.DB = db
+
+	return
+}
+
+// Close implements the Close method of the SessionBacking interface.
+func (b *PostgresBacking) Close() (err error) {
+	if b.DB != nil {
+		err = b.DB.Close()
+		b.DB = nil
+	}
+	if b.newSessionStmt != nil {
+		err = b.newSessionStmt.Close()
+		b.newSessionStmt = nil
+	}
+	if b.evictSessionsStmt != nil {
+		err = b.evictSessionsStmt.Close()
+		b.evictSessionsStmt = nil
+	}
+	if b.hasSessionStmt != nil {
+		err = b.hasSessionStmt.Close()
+		b.hasSessionStmt = nil
+	}
+	if b.sessionTTLStmt != nil {
+		err = b.sessionTTLStmt.Close()
+		b.sessionTTLStmt = nil
+	}
+	if b.deleteSessionStmt != nil {
+		err = b.deleteSessionStmt.Close()
+		b.deleteSessionStmt = nil
+	}
+
+	return
+}
+
+// Ping implements the Ping method of the SessionBackingPinger interface.
+func (b *PostgresBacking) Ping(ctx context.Context) error {
+	if b.DB == nil {
+		return errors.New(errSessionBackingNotOpened)
+	}
+	return b.DB.PingContext(ctx)
+}
+
+// NewSession implements the NewSession method of the SessionBacking interface.
+// The email is stored alongside its canonical form, and the session ID is not
+// stored.
+func (b *PostgresBacking) NewSession(email, id string) error {
+	return b.NewSessionContext(context.Background(), email, id)
+}
+
+// NewSessionContext implements the NewSessionContext method of the
+// SessionBackingContext interface.
+func (b *PostgresBacking) NewSessionContext(ctx context.Context, email, id string) (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if len(CanonicalizeEmail(email)) == 0 {
+		err = errors.New(errNewSessionEmptyEmail)
+		return
+	}
+	if b.newSessionStmt == nil {
+		b.newSessionStmt, err = b.DB.PrepareContext(ctx, postgresNewSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.evictSessionsStmt == nil {
+		b.evictSessionsStmt, err = b.DB.PrepareContext(ctx, postgresEvictSessionsQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// Make room for the new session by evicting the oldest sessions.
+	canonical := CanonicalizeEmail(email)
+	if _, err = tx.Stmt(b.evictSessionsStmt).ExecContext(ctx, canonical, sessionsToKeep(b.MaxPerEmail)); err != nil {
+		return
+	}
+
+	result, err := tx.Stmt(b.newSessionStmt).ExecContext(ctx, email, canonical, newSessionDuration(email))
+	if err != nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		err = errors.New(errNewSessionNoRowsAffected)
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// HasSession implements the HasSession method of the SessionBacking interface.
+func (b *PostgresBacking) HasSession(email string) (bool, error) {
+	return b.HasSessionContext(context.Background(), email)
+}
+
+// HasSessionContext implements the HasSessionContext method of the
+// SessionBackingContext interface.
+func (b *PostgresBacking) HasSessionContext(ctx context.Context, email string) (hasSession bool, err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.hasSessionStmt == nil {
+		b.hasSessionStmt, err = b.DB.PrepareContext(ctx, postgresHasSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	var id int64
+	err = b.hasSessionStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&id)
+	switch err {
+	case nil:
+		hasSession = true
+	case sql.ErrNoRows:
+		err = nil
+	}
+	return
+}
+
+// SessionTTL implements the SessionTTL method of the SessionBacking interface.
+// The remaining lifetime is that of the longest lived session for the email.
+func (b *PostgresBacking) SessionTTL(email string) (time.Duration, bool, error) {
+	return b.SessionTTLContext(context.Background(), email)
+}
+
+// SessionTTLContext implements the SessionTTLContext method of the
+// SessionBackingContext interface.
+func (b *PostgresBacking) SessionTTLContext(ctx context.Context, email string) (ttl time.Duration, hasSession bool, err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.sessionTTLStmt == nil {
+		b.sessionTTLStmt, err = b.DB.PrepareContext(ctx, postgresSessionTTLQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	var remaining sql.NullInt64
+	if err = b.sessionTTLStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&remaining); err != nil {
+		return
+	}
+	if remaining.Valid && remaining.Int64 > 0 {
+		ttl = time.Duration(remaining.Int64) * time.Second
+		hasSession = true
+	}
+	return
+}
+
+// DeleteSession implements the DeleteSession method of the SessionBacking
+// interface. Deleting a session that does not exist is not an error.
+func (b *PostgresBacking) DeleteSession(email string) error {
+	return b.DeleteSessionContext(context.Background(), email)
+}
+
+// DeleteSessionContext implements the DeleteSessionContext method of the
+// SessionBackingContext interface.
+func (b *PostgresBacking) DeleteSessionContext(ctx context.Context, email string) (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.deleteSessionStmt == nil {
+		b.deleteSessionStmt, err = b.DB.PrepareContext(ctx, postgresDeleteSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = b.deleteSessionStmt.ExecContext(ctx, CanonicalizeEmail(email))
+	return
+}
@@ -5,8 +5,12 @@
 package persona
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,48 +20,220 @@ import (
 //
 //	id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT
 //	email           TEXT    NOT NULL
-//	email_canonical TEXT    NOT NULL UNIQUE
+//	email_canonical TEXT    NOT NULL
 //	duration        INTEGER NOT NULL
 //	created_at      INTEGER NOT NULL             DEFAULT CURRENT_TIMESTAMP
 //
+//	INDEX sessions_email_canonical_created_at (email_canonical, created_at)
+//
 
 // Queries used by the SQLite session backing.
 const (
+	createSessionsTableQuery = `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			email           TEXT    NOT NULL,
+			email_canonical TEXT    NOT NULL,
+			duration        INTEGER NOT NULL,
+			created_at      INTEGER NOT NULL             DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	uniqueEmailIndexQuery = `
+		SELECT count(*)
+		FROM sqlite_master
+		WHERE type='index'
+		AND tbl_name='sessions'
+		AND name LIKE 'sqlite_autoindex_sessions_%'
+	`
+	renameSessionsTableQuery = `
+		ALTER TABLE sessions RENAME TO sessions_unique_email
+	`
+	copySessionsQuery = `
+		INSERT INTO sessions
+		(id, email, email_canonical, duration, created_at)
+		SELECT id, email, email_canonical, coalesce(duration, 0),
+			coalesce(created_at, '1970-01-01 00:00:00')
+		FROM sessions_unique_email
+	`
+	dropUniqueSessionsTableQuery = `
+		DROP TABLE sessions_unique_email
+	`
+	createSessionsIndexQuery = `
+		CREATE INDEX IF NOT EXISTS sessions_email_canonical_created_at
+		ON sessions (email_canonical, created_at)
+	`
+	backfillCreatedAtQuery = `
+		UPDATE sessions
+		SET created_at = '1970-01-01 00:00:00'
+		WHERE created_at IS NULL
+		OR strftime('%s', created_at) IS NULL
+	`
+	writeProbeQuery = `
+		DELETE FROM sessions
+		WHERE 0
+	`
 	newSessionQuery = `
 		INSERT INTO sessions
 		(email, email_canonical, duration)
 		VALUES
-		(?, ?, min(?, ?))
+		(?, ?, ?)
+	`
+	evictSessionsQuery = `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT id
+			FROM sessions
+			WHERE email_canonical=?
+			ORDER BY created_at DESC, id DESC
+			LIMIT -1 OFFSET ?
+		)
 	`
 	hasSessionQuery = `
 		SELECT id
 		FROM sessions
 		WHERE email_canonical=?
+		AND strftime('%s', created_at) IS NOT NULL
+		AND duration IS NOT NULL
 		AND datetime(
 			strftime('%s', created_at) + duration, 'unixepoch'
 		) > datetime('now')
 	`
+	deleteSessionQuery = `
+		DELETE FROM sessions
+		WHERE email_canonical=?
+	`
+	cleanupSessionsQuery = `
+		DELETE FROM sessions
+		WHERE datetime(
+			strftime('%s', created_at) + duration, 'unixepoch'
+		) <= datetime('now')
+	`
+	sessionTTLQuery = `
+		SELECT max(strftime('%s', created_at) + duration - strftime('%s', 'now'))
+		FROM sessions
+		WHERE email_canonical=?
+		AND strftime('%s', created_at) IS NOT NULL
+		AND duration IS NOT NULL
+	`
 )
 
 // SQLiteBacking implements that SessionBacking interface, and allows for
 // manipulating sessions stored in an SQLite3 database.
+//
+// MaxOpenConns, MaxIdleConns, and ConnMaxLifetime limit the connection pool of
+// the underlying sql.DB, and are applied by Open. Zero values leave the
+// sql.DB defaults in place.
+//
+// NewSession evicts the oldest sessions for an email so that it never has more
+// than MaxPerEmail sessions. If MaxPerEmail is zero, each email has a single
+// session, which each new session replaces.
+//
+// If CleanupInterval is greater than zero, Open starts a goroutine that calls
+// Cleanup at that interval, until the backing is closed.
 type SQLiteBacking struct {
-	DB             *sql.DB
-	newSessionStmt *sql.Stmt
-	hasSessionStmt *sql.Stmt
+	DB                *sql.DB
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnMaxLifetime   time.Duration
+	MaxPerEmail       int
+	CleanupInterval   time.Duration
+	stopCleanup       chan struct{}
+	newSessionStmt    *sql.Stmt
+	evictSessionsStmt *sql.Stmt
+	hasSessionStmt    *sql.Stmt
+	sessionTTLStmt    *sql.Stmt
+	deleteSessionStmt *sql.Stmt
 }
 
-// Open implements the Open method of the SessionBacking interface.
+// Open implements the Open method of the SessionBacking interface. The
+// sessions table and its index are created if they do not already exist, a
+// table that only allows a single session per email is migrated, and the
+// database is checked to be writable.
 func (b *SQLiteBacking) Open(location string) (err error) {
-	b.DB, err = sql.Open("sqlite3", location)
+	db, err := sql.Open("sqlite3", location)
 	if err != nil {
 		return err
 	}
-	return b.DB.Ping()
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+	setConnPoolLimits(db, b.MaxOpenConns, b.MaxIdleConns, b.ConnMaxLifetime)
+	if err = db.Ping(); err != nil {
+		return
+	}
+	if _, err = db.Exec(createSessionsTableQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, location, err)
+	}
+	if err = migrateSQLiteSessions(db); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, location, err)
+	}
+	if _, err = db.Exec(createSessionsIndexQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, location, err)
+	}
+
+	// Sessions written without a usable creation time can never be shown to
+	// be unexpired, so mark them as created at the epoch.
+	if _, err = db.Exec(backfillCreatedAtQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, location, err)
+	}
+
+	// Confirm that writes succeed, without actually changing anything.
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(writeProbeQuery); err != nil {
+		return fmt.Errorf(errSessionBackingNotWritable, location, err)
+	}
+
+	// The database is only kept once it is known to be usable.
+	b.DB = db
+	if b.CleanupInterval > 0 && b.stopCleanup == nil {
+		b.stopCleanup = make(chan struct{})
+		go cleanupSQLiteSessions(b.DB, b.CleanupInterval, b.stopCleanup)
+	}
+
+	return
+}
+
+// migrateSQLiteSessions migrates a sessions table that was created when each
+// email could only have a single session. SQLite can not drop a UNIQUE
+// constraint, so the table is recreated without it.
+func migrateSQLiteSessions(db *sql.DB) (err error) {
+	var unique int
+	if err = db.QueryRow(uniqueEmailIndexQuery).Scan(&unique); err != nil || unique == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		renameSessionsTableQuery,
+		createSessionsTableQuery,
+		copySessionsQuery,
+		dropUniqueSessionsTableQuery,
+	} {
+		if _, err = tx.Exec(query); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
 }
 
 // Close implements the Close method of the SessionBacking interface.
 func (b *SQLiteBacking) Close() (err error) {
+	if b.stopCleanup != nil {
+		close(b.stopCleanup)
+		b.stopCleanup = nil
+	}
 	if b.DB != nil {
 		err = b.DB.Close()
 		b.DB = nil
@@ -66,28 +242,79 @@ func (b *SQLiteBacking) Close() (err error) {
 		err = b.newSessionStmt.Close()
 		b.newSessionStmt = nil
 	}
+	if b.evictSessionsStmt != nil {
+		err = b.evictSessionsStmt.Close()
+		b.evictSessionsStmt = nil
+	}
 	if b.hasSessionStmt != nil {
 		err = b.hasSessionStmt.Close()
 		b.hasSessionStmt = nil
 	}
+	if b.sessionTTLStmt != nil {
+		err = b.sessionTTLStmt.Close()
+		b.sessionTTLStmt = nil
+	}
+	if b.deleteSessionStmt != nil {
+		err = b.deleteSessionStmt.Close()
+		b.deleteSessionStmt = nil
+	}
 
 	return
 }
 
+// Ping implements the Ping method of the SessionBackingPinger interface.
+func (b *SQLiteBacking) Ping(ctx context.Context) error {
+	if b.DB == nil {
+		return errors.New(errSessionBackingNotOpened)
+	}
+	return b.DB.PingContext(ctx)
+}
+
 // NewSession implements the NewSession method of the SessionBacking interface.
-func (b *SQLiteBacking) NewSession(email, id string) (err error) {
+// The email is stored alongside its canonical form, and the session ID is not
+// stored.
+func (b *SQLiteBacking) NewSession(email, id string) error {
+	return b.NewSessionContext(context.Background(), email, id)
+}
+
+// NewSessionContext implements the NewSessionContext method of the
+// SessionBackingContext interface.
+func (b *SQLiteBacking) NewSessionContext(ctx context.Context, email, id string) (err error) {
 	if b.DB == nil {
 		err = errors.New(errSessionBackingNotOpened)
 		return
 	}
+	if len(CanonicalizeEmail(email)) == 0 {
+		err = errors.New(errNewSessionEmptyEmail)
+		return
+	}
 	if b.newSessionStmt == nil {
-		b.newSessionStmt, err = b.DB.Prepare(newSessionQuery)
+		b.newSessionStmt, err = b.DB.PrepareContext(ctx, newSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.evictSessionsStmt == nil {
+		b.evictSessionsStmt, err = b.DB.PrepareContext(ctx, evictSessionsQuery)
 		if err != nil {
 			return
 		}
 	}
 
-	result, err := b.newSessionStmt.Exec(email, id)
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// Make room for the new session by evicting the oldest sessions.
+	canonical := CanonicalizeEmail(email)
+	if _, err = tx.Stmt(b.evictSessionsStmt).ExecContext(ctx, canonical, sessionsToKeep(b.MaxPerEmail)); err != nil {
+		return
+	}
+
+	result, err := tx.Stmt(b.newSessionStmt).ExecContext(ctx, email, canonical, newSessionDuration(email))
 	if err != nil {
 		return
 	}
@@ -101,24 +328,31 @@ func (b *SQLiteBacking) NewSession(email, id string) (err error) {
 		return
 	}
 
+	err = tx.Commit()
 	return
 }
 
 // HasSession implements the HasSession method of the SessionBacking interface.
-func (b *SQLiteBacking) HasSession(email string) (hasSession bool, err error) {
+func (b *SQLiteBacking) HasSession(email string) (bool, error) {
+	return b.HasSessionContext(context.Background(), email)
+}
+
+// HasSessionContext implements the HasSessionContext method of the
+// SessionBackingContext interface.
+func (b *SQLiteBacking) HasSessionContext(ctx context.Context, email string) (hasSession bool, err error) {
 	if b.DB == nil {
 		err = errors.New(errSessionBackingNotOpened)
 		return
 	}
 	if b.hasSessionStmt == nil {
-		b.hasSessionStmt, err = b.DB.Prepare(hasSessionQuery)
+		b.hasSessionStmt, err = b.DB.PrepareContext(ctx, hasSessionQuery)
 		if err != nil {
 			return
 		}
 	}
 
 	var id int
-	err = b.hasSessionStmt.QueryRow(email).Scan(&id)
+	err = b.hasSessionStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&id)
 	switch err {
 	case nil:
 		hasSession = true
@@ -127,3 +361,86 @@ func (b *SQLiteBacking) HasSession(email string) (hasSession bool, err error) {
 	}
 	return
 }
+
+// SessionTTL implements the SessionTTL method of the SessionBacking interface.
+// The remaining lifetime is that of the longest lived session for the email.
+func (b *SQLiteBacking) SessionTTL(email string) (time.Duration, bool, error) {
+	return b.SessionTTLContext(context.Background(), email)
+}
+
+// SessionTTLContext implements the SessionTTLContext method of the
+// SessionBackingContext interface.
+func (b *SQLiteBacking) SessionTTLContext(ctx context.Context, email string) (ttl time.Duration, hasSession bool, err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.sessionTTLStmt == nil {
+		b.sessionTTLStmt, err = b.DB.PrepareContext(ctx, sessionTTLQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	var remaining sql.NullInt64
+	if err = b.sessionTTLStmt.QueryRowContext(ctx, CanonicalizeEmail(email)).Scan(&remaining); err != nil {
+		return
+	}
+	if remaining.Valid && remaining.Int64 > 0 {
+		ttl = time.Duration(remaining.Int64) * time.Second
+		hasSession = true
+	}
+	return
+}
+
+// DeleteSession implements the DeleteSession method of the SessionBacking
+// interface. Deleting a session that does not exist is not an error.
+func (b *SQLiteBacking) DeleteSession(email string) error {
+	return b.DeleteSessionContext(context.Background(), email)
+}
+
+// DeleteSessionContext implements the DeleteSessionContext method of the
+// SessionBackingContext interface.
+func (b *SQLiteBacking) DeleteSessionContext(ctx context.Context, email string) (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+	if b.deleteSessionStmt == nil {
+		b.deleteSessionStmt, err = b.DB.PrepareContext(ctx, deleteSessionQuery)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = b.deleteSessionStmt.ExecContext(ctx, CanonicalizeEmail(email))
+	return
+}
+
+// Cleanup deletes all expired sessions.
+func (b *SQLiteBacking) Cleanup() (err error) {
+	if b.DB == nil {
+		err = errors.New(errSessionBackingNotOpened)
+		return
+	}
+
+	_, err = b.DB.Exec(cleanupSessionsQuery)
+	return
+}
+
+// cleanupSQLiteSessions deletes expired sessions from db every interval, until
+// stop is closed.
+func cleanupSQLiteSessions(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := db.Exec(cleanupSessionsQuery); err != nil {
+				log.Printf("persona: failed to clean up expired sessions: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestSQLiteBacking opens an SQLite backing in a new temporary directory.
+func openTestSQLiteBacking(t *testing.T, maxPerEmail int) *SQLiteBacking {
+	t.Helper()
+	b := &SQLiteBacking{MaxPerEmail: maxPerEmail}
+	if err := b.Open(filepath.Join(t.TempDir(), "sessions.db")); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// sessionEmails returns the emails of the sessions for the canonical email,
+// from oldest to newest.
+func sessionEmails(t *testing.T, db *sql.DB, canonical string) (emails []string) {
+	t.Helper()
+	rows, err := db.Query(`SELECT email FROM sessions WHERE email_canonical=? ORDER BY id`, canonical)
+	if err != nil {
+		t.Fatalf("querying sessions: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			t.Fatalf("scanning sessions: %v", err)
+		}
+		emails = append(emails, email)
+	}
+	return
+}
+
+func TestSQLiteBackingOpen(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "sessions.db")
+
+	// A fresh database has its schema created.
+	b := &SQLiteBacking{}
+	if err := b.Open(location); err != nil {
+		t.Fatalf("Open of a fresh database: %v", err)
+	}
+	if err := b.NewSession("user@example.com", ""); err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// An existing database keeps its sessions.
+	b = &SQLiteBacking{}
+	if err := b.Open(location); err != nil {
+		t.Fatalf("Open of an existing database: %v", err)
+	}
+	defer b.Close()
+	if has, err := b.HasSession("user@example.com"); err != nil || !has {
+		t.Errorf("HasSession after reopening = %v, %v; want true, nil", has, err)
+	}
+}
+
+func TestSQLiteBackingOpenReadOnly(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "sessions.db")
+	b := &SQLiteBacking{}
+	if err := b.Open(location); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	b.Close()
+
+	b = &SQLiteBacking{}
+	if err := b.Open("file:" + location + "?mode=ro"); err == nil {
+		b.Close()
+		t.Fatal("Open of a read-only database succeeded")
+	}
+	if b.DB != nil {
+		t.Error("DB is set after a failed Open")
+	}
+}
+
+func TestValidateSessionKeepsFailedBackingUnset(t *testing.T) {
+	defer func(backing SessionBacking) { sessionBacking = backing }(sessionBacking)
+	sessionBacking = nil
+
+	var config Configuration
+	config.Session.Url = "/session"
+	config.Session.Store = "sqlite"
+	config.Session.Backing = "file:" + filepath.Join(t.TempDir(), "missing", "sessions.db") + "?mode=ro"
+	s := newSettings()
+	if err := validateSession(&config, s); err == nil {
+		t.Fatal("validateSession with an unusable backing succeeded")
+	}
+	if s.sessionBacking != nil {
+		t.Error("the staged backing is set after a failed Open")
+	}
+
+	config.Session.Backing = filepath.Join(t.TempDir(), "sessions.db")
+	if err := validateSession(&config, s); err != nil {
+		t.Fatalf("validateSession: %v", err)
+	}
+	if s.sessionBacking == nil {
+		t.Fatal("the staged backing is not set after a successful Open")
+	}
+	if sessionBacking != nil {
+		t.Error("sessionBacking is set before the settings are published")
+	}
+	s.sessionBacking.Close()
+}
+
+func TestValidateSessionConnPoolLimits(t *testing.T) {
+	defer func(backing SessionBacking) { sessionBacking = backing }(sessionBacking)
+	sessionBacking = nil
+
+	var config Configuration
+	config.Session.Url = "/session"
+	config.Session.Store = "sqlite"
+	config.Session.Backing = filepath.Join(t.TempDir(), "sessions.db")
+	config.Session.MaxOpenConns = 3
+	s := newSettings()
+	if err := validateSession(&config, s); err != nil {
+		t.Fatalf("validateSession: %v", err)
+	}
+	defer s.sessionBacking.Close()
+	backing, ok := s.sessionBacking.(*SQLiteBacking)
+	if !ok {
+		t.Fatalf("staged backing is %T, want *SQLiteBacking", s.sessionBacking)
+	}
+	if limit := backing.DB.Stats().MaxOpenConnections; limit != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", limit)
+	}
+
+	// Without a configured limit, the database/sql default of no limit is
+	// kept.
+	unlimited := openTestSQLiteBacking(t, 0)
+	if limit := unlimited.DB.Stats().MaxOpenConnections; limit != 0 {
+		t.Errorf("MaxOpenConnections without a limit = %d, want 0", limit)
+	}
+}
+
+func TestSQLiteBackingMaxPerEmail(t *testing.T) {
+	b := openTestSQLiteBacking(t, 3)
+
+	// Sessions are distinguished by the case of the email, which is not part
+	// of its canonical form.
+	logins := []string{"a@example.com", "A@example.com", "a@EXAMPLE.com", "A@EXAMPLE.COM", "a@Example.com"}
+	for i, email := range logins {
+		if err := b.NewSession(email, ""); err != nil {
+			t.Fatalf("NewSession %d: %v", i+1, err)
+		}
+		want := logins[:i+1]
+		if len(want) > b.MaxPerEmail {
+			want = want[len(want)-b.MaxPerEmail:]
+		}
+		got := sessionEmails(t, b.DB, "a@example.com")
+		if len(got) != len(want) {
+			t.Fatalf("after %d sessions, have %v, want %v", i+1, got, want)
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Fatalf("after %d sessions, have %v, want %v", i+1, got, want)
+			}
+		}
+	}
+
+	if has, err := b.HasSession("a@example.com"); err != nil || !has {
+		t.Errorf("HasSession = %v, %v; want true, nil", has, err)
+	}
+	if ttl, has, err := b.SessionTTL("a@example.com"); err != nil || !has || ttl <= 0 {
+		t.Errorf("SessionTTL = %v, %v, %v; want a positive TTL", ttl, has, err)
+	}
+	if err := b.DeleteSession("a@example.com"); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if got := sessionEmails(t, b.DB, "a@example.com"); len(got) != 0 {
+		t.Errorf("sessions after DeleteSession = %v, want none", got)
+	}
+}
+
+func TestSQLiteBackingMigratesUniqueEmail(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sql.Open("sqlite3", location)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			email           TEXT    NOT NULL,
+			email_canonical TEXT    NOT NULL UNIQUE,
+			duration        INTEGER NOT NULL,
+			created_at      INTEGER NOT NULL             DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO sessions (email, email_canonical, duration)
+		VALUES ('user@example.com', 'user@example.com', 3600);
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("creating single session table: %v", err)
+	}
+
+	b := &SQLiteBacking{MaxPerEmail: 2}
+	if err := b.Open(location); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+	if has, err := b.HasSession("user@example.com"); err != nil || !has {
+		t.Errorf("HasSession of migrated session = %v, %v; want true, nil", has, err)
+	}
+	if err := b.NewSession("User@example.com", ""); err != nil {
+		t.Fatalf("NewSession after migration: %v", err)
+	}
+	if got := sessionEmails(t, b.DB, "user@example.com"); len(got) != 2 {
+		t.Errorf("sessions after migration = %v, want 2", got)
+	}
+
+	var index string
+	err = b.DB.QueryRow(`SELECT name FROM sqlite_master WHERE type='index' AND name='sessions_email_canonical_created_at'`).Scan(&index)
+	if err != nil {
+		t.Errorf("index missing after migration: %v", err)
+	}
+}
+
+func TestSQLiteBackingSingleSessionPerEmail(t *testing.T) {
+	b := openTestSQLiteBacking(t, 0)
+
+	for _, email := range []string{"a@example.com", "A@example.com"} {
+		if err := b.NewSession(email, ""); err != nil {
+			t.Fatalf("NewSession(%q): %v", email, err)
+		}
+	}
+	got := sessionEmails(t, b.DB, "a@example.com")
+	if len(got) != 1 || got[0] != "A@example.com" {
+		t.Errorf("sessions = %v, want only the latest session", got)
+	}
+}
+
+func TestSQLiteBackingNullCreatedAt(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sql.Open("sqlite3", location)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			email           TEXT    NOT NULL,
+			email_canonical TEXT    NOT NULL UNIQUE,
+			duration        INTEGER,
+			created_at      INTEGER
+		);
+		INSERT INTO sessions (email, email_canonical, duration, created_at)
+		VALUES ('null@example.com', 'null@example.com', 3600, NULL),
+			('garbage@example.com', 'garbage@example.com', 3600, 'not a time');
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("creating legacy session table: %v", err)
+	}
+
+	b := &SQLiteBacking{}
+	if err := b.Open(location); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+	for _, email := range []string{"null@example.com", "garbage@example.com"} {
+		if has, err := b.HasSession(email); err != nil || has {
+			t.Errorf("HasSession(%q) = %v, %v; want false, nil", email, has, err)
+		}
+		if err := b.NewSession(email, ""); err != nil {
+			t.Errorf("NewSession(%q): %v", email, err)
+		}
+		if has, err := b.HasSession(email); err != nil || !has {
+			t.Errorf("HasSession(%q) after NewSession = %v, %v; want true, nil", email, has, err)
+		}
+	}
+}
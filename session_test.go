@@ -0,0 +1,163 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testBackings returns an opened backing of each type that can be tested
+// without a database server.
+func testBackings(t *testing.T) map[string]SessionBacking {
+	t.Helper()
+	memory := &MemoryBacking{}
+	if err := memory.Open(""); err != nil {
+		t.Fatalf("MemoryBacking.Open: %v", err)
+	}
+	t.Cleanup(func() { memory.Close() })
+	return map[string]SessionBacking{
+		"memory": memory,
+		"sqlite": openTestSQLiteBacking(t, 0),
+	}
+}
+
+func TestNewSessionUsesConfiguredMaxDuration(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.sessionMaxDuration = 2 * SessionMaxDuration })
+
+	for name, backing := range testBackings(t) {
+		if err := backing.NewSession("user@example.com", ""); err != nil {
+			t.Fatalf("%s: NewSession: %v", name, err)
+		}
+		ttl, has, err := backing.SessionTTL("user@example.com")
+		if err != nil || !has {
+			t.Fatalf("%s: SessionTTL = %v, %v, %v", name, ttl, has, err)
+		}
+		if ttl <= SessionMaxDuration*time.Second {
+			t.Errorf("%s: session TTL %v is capped at the default maximum", name, ttl)
+		}
+	}
+}
+
+func TestNewSessionDuration(t *testing.T) {
+	defer func() { SessionDurationFor = nil }()
+
+	tests := []struct {
+		duration int
+		want     int
+	}{
+		{3600, 3600},
+		{0, SessionMaxDuration},
+		{-1, SessionMaxDuration},
+		{SessionMaxDuration + 1, SessionMaxDuration},
+	}
+	for _, test := range tests {
+		duration := test.duration
+		SessionDurationFor = func(string) int { return duration }
+		if got := newSessionDuration("user@example.com"); got != test.want {
+			t.Errorf("newSessionDuration with hook returning %d = %d, want %d", test.duration, got, test.want)
+		}
+	}
+}
+
+func TestSessionBackingLifecycle(t *testing.T) {
+	for name, backing := range testBackings(t) {
+		if has, err := backing.HasSession("user@example.com"); err != nil || has {
+			t.Errorf("%s: HasSession before NewSession = %v, %v; want false, nil", name, has, err)
+		}
+		if err := backing.NewSession("User@Example.com", ""); err != nil {
+			t.Fatalf("%s: NewSession: %v", name, err)
+		}
+		if has, err := backing.HasSession("user@example.com"); err != nil || !has {
+			t.Errorf("%s: HasSession of the canonical email = %v, %v; want true, nil", name, has, err)
+		}
+		ttl, has, err := backing.SessionTTL("USER@example.com")
+		if err != nil || !has || ttl <= 0 || ttl > SessionMaxDuration*time.Second {
+			t.Errorf("%s: SessionTTL = %v, %v, %v; want a TTL of at most the maximum", name, ttl, has, err)
+		}
+		if err := backing.DeleteSession("user@EXAMPLE.com"); err != nil {
+			t.Fatalf("%s: DeleteSession: %v", name, err)
+		}
+		if has, err := backing.HasSession("user@example.com"); err != nil || has {
+			t.Errorf("%s: HasSession after DeleteSession = %v, %v; want false, nil", name, has, err)
+		}
+		if err := backing.DeleteSession("user@example.com"); err != nil {
+			t.Errorf("%s: DeleteSession of a missing session: %v", name, err)
+		}
+	}
+}
+
+func TestSessionBackingRejectsEmptyEmail(t *testing.T) {
+	for name, backing := range testBackings(t) {
+		if err := backing.NewSession("", ""); err == nil {
+			t.Errorf("%s: NewSession with an empty email succeeded", name)
+		}
+	}
+}
+
+func TestSessionBackingUsesSessionDurationFor(t *testing.T) {
+	defer func() { SessionDurationFor = nil }()
+	SessionDurationFor = func(string) int { return 60 }
+
+	for name, backing := range testBackings(t) {
+		if err := backing.NewSession("user@example.com", ""); err != nil {
+			t.Fatalf("%s: NewSession: %v", name, err)
+		}
+		ttl, has, err := backing.SessionTTL("user@example.com")
+		if err != nil || !has || ttl > 60*time.Second {
+			t.Errorf("%s: SessionTTL = %v, %v, %v; want at most 60s", name, ttl, has, err)
+		}
+	}
+}
+
+func TestMemoryBackingNotOpened(t *testing.T) {
+	b := &MemoryBacking{}
+	if err := b.NewSession("user@example.com", ""); err == nil {
+		t.Error("NewSession before Open succeeded")
+	}
+	if _, err := b.HasSession("user@example.com"); err == nil {
+		t.Error("HasSession before Open succeeded")
+	}
+	if err := b.Ping(context.Background()); err == nil {
+		t.Error("Ping before Open succeeded")
+	}
+	if err := b.Open("soon"); err == nil {
+		t.Error("Open with an invalid janitor interval succeeded")
+	}
+}
+
+func TestSessionsToKeep(t *testing.T) {
+	tests := map[int]int{-1: 0, 0: 0, 1: 0, 2: 1, 5: 4}
+	for maxPerEmail, want := range tests {
+		if got := sessionsToKeep(maxPerEmail); got != want {
+			t.Errorf("sessionsToKeep(%d) = %d, want %d", maxPerEmail, got, want)
+		}
+	}
+}
+
+func TestCanonicalizeEmail(t *testing.T) {
+	tests := map[string]string{
+		"user@example.com":     "user@example.com",
+		" User@Example.COM ":   "user@example.com",
+		"User+Tag@Example.com": "user+tag@example.com",
+		"\"a@b\"@Example.com":  "\"a@b\"@example.com",
+		"no-at-sign":           "no-at-sign",
+	}
+	for email, want := range tests {
+		if got := CanonicalizeEmail(email); got != want {
+			t.Errorf("CanonicalizeEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+
+	for name, backing := range testBackings(t) {
+		if err := backing.NewSession("User@Example.com", ""); err != nil {
+			t.Fatalf("%s: NewSession: %v", name, err)
+		}
+		if has, err := backing.HasSession("user@example.COM"); err != nil || !has {
+			t.Errorf("%s: HasSession with different case = %v, %v; want true", name, has, err)
+		}
+	}
+}
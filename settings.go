@@ -0,0 +1,286 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// settings is the state, derived from a Configuration, that requests read.
+// ValidateConfig builds a new settings from scratch, without affecting the
+// requests that are being served, and publishes it only once the whole
+// configuration is valid. A published settings is never modified, so it can be
+// read without locking, and a request that holds on to one sees a consistent
+// configuration for as long as it runs.
+type settings struct {
+	// problemJsonErrors controls whether errors are written as RFC 7807
+	// problem documents instead of plain text.
+	problemJsonErrors bool
+
+	// strictContentType controls whether request bodies must be sent with an
+	// explicit Content-Type, rather than being assumed to be JSON.
+	strictContentType bool
+
+	// wwwAuthenticate is the challenge sent in the WWW-Authenticate header of
+	// StatusUnauthorized (401) responses. If empty, the header is not sent.
+	wwwAuthenticate string
+
+	// rootRedirect is the URL that requests for the root are redirected to.
+	// If empty, the root responds with an empty page.
+	rootRedirect string
+
+	// compressionDisabled controls whether compress leaves handlers
+	// unwrapped.
+	compressionDisabled bool
+
+	// compressionOptions is the options that compress wraps handlers with.
+	compressionOptions CompressOptions
+
+	// compressionLevels is CompressionLevels combined with the configured
+	// compression levels.
+	compressionLevels map[string]int
+
+	// compressionEncodings is the list of content encodings offered to
+	// clients, in order of preference. Every entry must be in
+	// SupportedEncodings.
+	compressionEncodings []string
+
+	// auditEmailKey is the key used to hash the email addresses recorded in
+	// audit logs. If empty, email addresses are recorded in plain text.
+	auditEmailKey []byte
+
+	// trustedProxies is a list of the networks that trusted authenticating
+	// proxies connect from.
+	trustedProxies []*net.IPNet
+
+	// authenticatedUserHeader is the header that trusted proxies use to
+	// report the authenticated user.
+	authenticatedUserHeader string
+
+	// privateKey is the key that certificates are signed with.
+	privateKey *PrivateKey
+
+	// rsaSignaturePSS controls whether RSA keys sign with RSASSA-PSS, rather
+	// than PKCS #1 v1.5. PSS signatures are advertised with a PS algorithm
+	// identifier in place of RS.
+	rsaSignaturePSS bool
+
+	// Limits on the retired keys that continue to be published. A retired
+	// key is always published for at least as long as a certificate it
+	// signed could be valid, regardless of these limits.
+	maxRetiredKeys   int
+	retiredKeyMaxAge time.Duration
+
+	// authenticationTemplate and provisioningTemplate render the
+	// authentication and provisioning pages. They are nil when the page is
+	// disabled.
+	authenticationTemplate *template.Template
+	provisioningTemplate   *template.Template
+
+	// authenticationUrl and provisioningUrl are the URLs of the
+	// authentication and provisioning pages, which are passed to their
+	// templates as URL once the settings are published.
+	authenticationUrl string
+	provisioningUrl   string
+
+	// createSessionSecret is the shared secret that callers of CreateSession
+	// must present as a bearer token. If empty, CreateSession refuses all
+	// requests.
+	createSessionSecret string
+
+	// logoutSecret is the shared secret that callers of Logout may present
+	// as a bearer token. If empty, only requests from a trusted proxy on
+	// behalf of the same user are accepted.
+	logoutSecret string
+
+	// sessionMaxDuration is the maximum duration, in seconds, that sessions
+	// and issued ID certificates can be valid for.
+	sessionMaxDuration int
+
+	// sessionBacking is the session backing that was opened for the
+	// configuration, as none was in use when it was loaded. It replaces the
+	// session backing in use once the settings are published.
+	sessionBacking SessionBacking
+
+	// defaultIssuer is the issuer of certificates that are not issued for a
+	// tenant.
+	defaultIssuer string
+
+	// trustedCallerSecret is the shared secret that identifies callers that
+	// are trusted to override the certificate issuer.
+	trustedCallerSecret string
+
+	// allowedIssuers is a list of the issuers that trusted callers may use.
+	allowedIssuers map[string]bool
+
+	// allowedClientKeyAlgorithms is a list of the algorithms that client
+	// public keys may use. If empty, all algorithms are allowed.
+	allowedClientKeyAlgorithms map[string]bool
+
+	// allowedDomains is a list of the normalized email domains that
+	// certificates may be issued for. If empty, all domains are allowed.
+	allowedDomains map[string]bool
+
+	// clampToSession controls whether certificates expire no later than the
+	// session that authorizes them.
+	clampToSession bool
+
+	// allowOmitPublicKey controls whether clients may request that the
+	// public key is omitted from their certificates.
+	allowOmitPublicKey bool
+
+	// maxClientKeyBytes is the maximum size, in bytes, of the JSON encoded
+	// client public key that is embedded in issued certificates.
+	maxClientKeyBytes int
+
+	// minClientKeySizeRSA is the minimum size, in bits, of RSA client public
+	// keys.
+	minClientKeySizeRSA int
+
+	// extensionHeaders holds the extension header parameters that are
+	// included in the header of all issued ID certificates.
+	extensionHeaders map[string]interface{}
+
+	// criticalHeaders is a list of the extension header parameters that are
+	// marked as critical in all issued ID certificates.
+	criticalHeaders []string
+
+	// jwkSetUrl is the JWK Set URL included as the jku header parameter of
+	// all issued ID certificates. If empty, the parameter is omitted.
+	jwkSetUrl string
+
+	// timestampGranularity is the granularity that the issued-at and
+	// expiration times of issued ID certificates are rounded down to. If
+	// zero, they are not rounded.
+	timestampGranularity time.Duration
+
+	// idCertIatFuzz is the time to fuzz the issued-at time for all issued ID
+	// certificates. Negative values account for verifiers whose clocks are
+	// behind.
+	idCertIatFuzz time.Duration
+
+	// rateLimitEnabled is whether certificate requests are rate limited.
+	rateLimitEnabled bool
+
+	// rateLimitOptions are the options used to rate limit certificate
+	// requests.
+	rateLimitOptions RateLimitOptions
+
+	// requireNonce controls whether certificate requests must echo a nonce
+	// that was issued by the nonce endpoint.
+	requireNonce bool
+
+	// nonceKey is the secret that nonces are signed with. It is kept apart
+	// from the private key, so that anonymous clients can not have the
+	// private key sign data of their choosing, and so that nonces can never
+	// pass for certificates.
+	nonceKey hmacKey
+
+	// tenants is a server name-to-tenant mapping of the configured tenants.
+	tenants map[string]*tenant
+}
+
+// newSettings returns the settings that are in effect before a configuration
+// has been loaded.
+func newSettings() *settings {
+	return &settings{
+		compressionLevels:          CompressionLevels,
+		compressionEncodings:       defaultCompressionEncodings,
+		authenticatedUserHeader:    DefaultAuthenticatedUserHeader,
+		sessionMaxDuration:         SessionMaxDuration,
+		allowedIssuers:             map[string]bool{},
+		allowedClientKeyAlgorithms: map[string]bool{},
+		allowedDomains:             map[string]bool{},
+		maxClientKeyBytes:          DefaultMaxClientKeyBytes,
+		idCertIatFuzz:              idCertIatFuzzDuration * time.Second,
+		tenants:                    map[string]*tenant{},
+	}
+}
+
+// currentSettings holds the *settings that new requests use.
+var currentSettings atomic.Value
+
+// settingsMutex serializes the changes to currentSettings, so that changes
+// made by copying the current settings are not lost.
+var settingsMutex sync.Mutex
+
+func init() {
+	currentSettings.Store(newSettings())
+}
+
+// loadSettings returns the settings that are currently published.
+func loadSettings() *settings {
+	return currentSettings.Load().(*settings)
+}
+
+// publishSettings publishes the given settings, which were staged from a
+// configuration, and then applies the parts of them that are kept outside of
+// the settings: the template URL parameters, and any newly opened session
+// backing, which replaces and closes the one in use. The caller must hold
+// settingsMutex.
+func publishSettings(s *settings) {
+	currentSettings.Store(s)
+	if len(s.authenticationUrl) > 0 {
+		SetAuthenticationTemplateParam("URL", s.authenticationUrl)
+	}
+	if len(s.provisioningUrl) > 0 {
+		SetProvisioningTemplateParam("URL", s.provisioningUrl)
+	}
+	if s.sessionBacking != nil && s.sessionBacking != sessionBacking {
+		previous := sessionBacking
+		sessionBacking = s.sessionBacking
+		if previous != nil {
+			previous.Close()
+		}
+	}
+}
+
+// discardSettings closes the session backing that was opened for the given
+// staged settings, if any, when they are not going to be published.
+func discardSettings(s *settings) {
+	if s.sessionBacking != nil {
+		s.sessionBacking.Close()
+	}
+}
+
+// updateSettings publishes a copy of the current settings, as changed by
+// update. If update returns an error, nothing is published.
+func updateSettings(update func(s *settings) error) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	s := *loadSettings()
+	if err := update(&s); err != nil {
+		return err
+	}
+	currentSettings.Store(&s)
+	return nil
+}
+
+// settingsKey is the context key under which whenReady stores the settings
+// that a request was started with.
+type settingsKey struct{}
+
+// withSettings returns a copy of the request that carries the current
+// settings, so that it is served with them even if they are replaced while it
+// runs.
+func withSettings(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), settingsKey{}, loadSettings()))
+}
+
+// settingsFor returns the settings that the request was started with, or the
+// current settings if it was not started by whenReady.
+func settingsFor(r *http.Request) *settings {
+	if s, ok := r.Context().Value(settingsKey{}).(*settings); ok {
+		return s
+	}
+	return loadSettings()
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withSettingsUpdate publishes a copy of the current settings, as changed by
+// update, and restores the previous settings when the test finishes.
+func withSettingsUpdate(t *testing.T, update func(s *settings)) {
+	t.Helper()
+	previous := loadSettings()
+	updateSettings(func(s *settings) error {
+		update(s)
+		return nil
+	})
+	t.Cleanup(func() { currentSettings.Store(previous) })
+}
+
+func TestSettingsForKeepsSnapshot(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.rootRedirect = "/before" })
+	r := withSettings(httptest.NewRequest("GET", "/", nil))
+
+	withSettingsUpdate(t, func(s *settings) { s.rootRedirect = "/after" })
+	if redirect := settingsFor(r).rootRedirect; redirect != "/before" {
+		t.Errorf("request settings changed to %q, want %q", redirect, "/before")
+	}
+	if redirect := settingsFor(httptest.NewRequest("GET", "/", nil)).rootRedirect; redirect != "/after" {
+		t.Errorf("new request settings = %q, want %q", redirect, "/after")
+	}
+}
+
+func TestValidateConfigKeepsSettingsWhenInvalid(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.rootRedirect = "/current" })
+	current := loadSettings()
+
+	var config Configuration
+	config.HTTP.Root.Redirect = "/invalid"
+	config.Delegation.Delegate = true
+	config.Delegation.Host = "not a host"
+	if err := ValidateConfig(&config); err == nil {
+		t.Fatal("invalid configuration was accepted")
+	}
+	if loadSettings() != current {
+		t.Error("an invalid configuration replaced the current settings")
+	}
+}
+
+func TestReloadConfigFailingAfterSessionKeepsState(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) {})
+	current := loadSettings()
+	defer func(backing SessionBacking) { sessionBacking = backing }(sessionBacking)
+	defer SetAuthenticationTemplateParam("URL", AuthenticationTemplateParams["URL"])
+	defer SetProvisioningTemplateParam("URL", ProvisioningTemplateParams["URL"])
+	SetAuthenticationTemplateParam("URL", "/auth")
+	SetProvisioningTemplateParam("URL", "/prov")
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0600); err != nil {
+		t.Fatalf("writing the key: %v", err)
+	}
+	var config Configuration
+	config.PrivateKey.Type = "HMAC"
+	config.PrivateKey.File = keyFile
+	config.Authentication.Url = "/new-auth"
+	config.Authentication.Disabled = true
+	config.Provisioning.Url = "/new-prov"
+	config.Provisioning.Disabled = true
+	config.Session.Url = "/session"
+	config.Session.Store = "memory"
+	// The session is staged before the certificate URL is found invalid.
+	config.CertificateUrl = "not a path"
+	configJson, _ := json.Marshal(config)
+	configFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configFile, configJson, 0600); err != nil {
+		t.Fatalf("writing the configuration: %v", err)
+	}
+
+	old := &MemoryBacking{}
+	if err := old.Open(""); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, backing := range []SessionBacking{old, nil} {
+		sessionBacking = backing
+		want := fmt.Sprintf(errInvalidCertificateUrl, config.CertificateUrl)
+		if err := ReloadConfig(configFile); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("ReloadConfig = %v, want %q", err, want)
+		}
+		if sessionBacking != backing {
+			t.Errorf("sessionBacking = %v, want %v", sessionBacking, backing)
+		}
+		if loadSettings() != current {
+			t.Error("a failed reload replaced the current settings")
+		}
+		templateParamsMutex.RLock()
+		authUrl, provUrl := AuthenticationTemplateParams["URL"], ProvisioningTemplateParams["URL"]
+		templateParamsMutex.RUnlock()
+		if authUrl != "/auth" || provUrl != "/prov" {
+			t.Errorf("template URLs = %v and %v, want /auth and /prov", authUrl, provUrl)
+		}
+	}
+	if err := old.NewSession("user@example.com", ""); err != nil {
+		t.Errorf("the previous backing is no longer usable: %v", err)
+	}
+}
+
+func TestSettingsWhileUpdating(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) {})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r := withSettings(httptest.NewRequest("GET", "/", nil))
+			if s := settingsFor(r); s.sessionMaxDuration < SessionMaxDuration {
+				t.Errorf("session max duration = %d", s.sessionMaxDuration)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		updateSettings(func(s *settings) error {
+			s.sessionMaxDuration = SessionMaxDuration + i
+			return nil
+		})
+	}
+	wg.Wait()
+}
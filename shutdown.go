@@ -0,0 +1,76 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"context"
+	"net/http"
+)
+
+// Error messages.
+const (
+	errShuttingDown = "the IdP is shutting down."
+)
+
+// beginRequest records the start of a request that uses the provider's
+// session backing. It returns false, without recording anything, once the
+// provider has begun shutting down.
+func (p *Provider) beginRequest() bool {
+	p.shutdownMutex.Lock()
+	defer p.shutdownMutex.Unlock()
+	if p.shuttingDown {
+		return false
+	}
+	p.inFlight.Add(1)
+	return true
+}
+
+// endRequest records the end of a request started with beginRequest.
+func (p *Provider) endRequest() {
+	p.inFlight.Done()
+}
+
+// rejectShuttingDown responds with StatusServiceUnavailable (503) if the
+// provider has begun shutting down, and returns whether it did so. Otherwise,
+// the request is recorded as in flight, and endRequest must be called once it
+// completes.
+func (p *Provider) rejectShuttingDown(w http.ResponseWriter) bool {
+	if p.beginRequest() {
+		return false
+	}
+	httpError(w, errShuttingDown, http.StatusServiceUnavailable)
+	return true
+}
+
+// Shutdown gracefully shuts down the provider. Requests that use the session
+// backing are refused from then on, and once the ones already in flight have
+// completed, the session backing is closed. If ctx is done before then, its
+// error is returned and the session backing is left open.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	p.shutdownMutex.Lock()
+	p.shuttingDown = true
+	p.shutdownMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if p.SessionBacking != nil {
+		return p.SessionBacking.Close()
+	}
+	return CloseSessionBacking()
+}
+
+// Shutdown gracefully shuts down the default provider.
+func Shutdown(ctx context.Context) error {
+	return DefaultProvider.Shutdown(ctx)
+}
@@ -5,17 +5,28 @@
 package persona
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
 )
 
 // SupportDocumentURL is the URL to the BrowserID support document.
 const SupportDocumentURL = "/.well-known/browserid"
 
-// SupportDocument is a BrowserID support document.
+// SupportDocument is a BrowserID support document. The session, certificate,
+// and JWKS URLs are only included in the extended form of the document. The
+// public key is omitted when certificates are signed with an HMAC key.
 type SupportDocument struct {
-	PublicKey      interface{} `json:"public-key"`
-	Authentication string      `json:"authentication"`
-	Provisioning   string      `json:"provisioning"`
+	PublicKey      PublicKeyDoc `json:"public-key,omitempty"`
+	Authentication string       `json:"authentication"`
+	Provisioning   string       `json:"provisioning"`
+	Session        string       `json:"session,omitempty"`
+	Certificate    string       `json:"certificate,omitempty"`
+	JwksUri        string       `json:"jwks_uri,omitempty"`
 }
 
 // DelegatedSupportDocument is a BrowserID support document that delegates
@@ -24,11 +35,88 @@ type DelegatedSupportDocument struct {
 	Authority string `json:"authority"`
 }
 
-var supportDocJson []byte
+// JSONWebKeySet is a JWK Set containing the published public keys.
+type JSONWebKeySet struct {
+	Keys []json.RawMessage `json:"keys"`
+}
+
+// SupportDocumentCacheControl is the Cache-Control header sent with the
+// support document. Caches may store the document, but must revalidate it
+// using its ETag, so that key rotations are picked up without delay.
+const SupportDocumentCacheControl = "public, no-cache"
+
+// servedDocument is a JSON encoded document, along with its ETag.
+type servedDocument struct {
+	json []byte
+	etag string
+}
+
+// newServedDocument returns the given JSON encoded document, with a weak ETag
+// derived from the SHA-256 hash of its contents. The ETag is weak because the
+// document may be served compressed, and a strong ETag would have to differ
+// between the compressed and uncompressed representations.
+func newServedDocument(doc []byte) *servedDocument {
+	sum := sha256.Sum256(doc)
+	return &servedDocument{
+		json: doc,
+		etag: `W/"` + hex.EncodeToString(sum[:]) + `"`,
+	}
+}
+
+// currentSupportDocument returns the support document that is currently being
+// served by the provider, and its ETag.
+func (p *Provider) currentSupportDocument() (doc []byte, etag string) {
+	served, _ := p.supportDocJson.Load().(*servedDocument)
+	if served == nil {
+		return
+	}
+	return served.json, served.etag
+}
 
 // GenerateSupportDocument reads the given configuration and returns a support
-// document based on that configuration.
+// document based on that configuration, which the default provider serves.
 func GenerateSupportDocument(config *Configuration) (doc []byte, err error) {
+	return DefaultProvider.GenerateSupportDocument(config)
+}
+
+// BuildSupportDocument returns a support document based on the given
+// configuration and the private key of the default provider, without serving
+// it.
+func BuildSupportDocument(config *Configuration) (doc []byte, err error) {
+	return DefaultProvider.BuildSupportDocument(config)
+}
+
+// SetSupportDocument makes the given support document the one that the
+// default provider serves.
+func SetSupportDocument(doc []byte) {
+	DefaultProvider.SetSupportDocument(doc)
+}
+
+// GenerateSupportDocument reads the given configuration and returns a support
+// document based on that configuration, which the provider serves. If the
+// document can not be generated, the previous document continues to be
+// served.
+func (p *Provider) GenerateSupportDocument(config *Configuration) (doc []byte, err error) {
+	if doc, err = p.BuildSupportDocument(config); err != nil {
+		log.Println("persona: keeping the previous support document:", err)
+		return
+	}
+	p.SetSupportDocument(doc)
+
+	return
+}
+
+// BuildSupportDocument returns a support document based on the given
+// configuration and the provider's private key, without serving it. This
+// allows a candidate document to be inspected, such as with
+// DiffSupportDocuments, before SetSupportDocument makes it live.
+func (p *Provider) BuildSupportDocument(config *Configuration) (doc []byte, err error) {
+	return p.buildSupportDocument(config, p.signingKey(loadSettings()))
+}
+
+// buildSupportDocument returns a support document based on the given
+// configuration and private key.
+func (p *Provider) buildSupportDocument(config *Configuration, key *PrivateKey) (doc []byte, err error) {
 	var supportDoc interface{}
 
 	if config.Delegation.Delegate {
@@ -36,24 +124,102 @@ func GenerateSupportDocument(config *Configuration) (doc []byte, err error) {
 			Authority: config.Delegation.Host,
 		}
 	} else {
-		var pubKeySupportDoc interface{}
-		pubKeySupportDoc, err = privateKey.SupportDoc()
-		if err != nil {
+		var pubKeySupportDoc PublicKeyDoc
+		if key == nil {
+			err = fmt.Errorf(errPrivateKeyUndefined)
+		} else {
+			pubKeySupportDoc, err = key.SupportDoc()
+		}
+		if err = diagnose("support-document", err); err != nil {
 			return
 		}
 
-		supportDoc = SupportDocument{
-			PublicKey:      pubKeySupportDoc,
-			Authentication: config.Authentication.Url,
-			Provisioning:   config.Provisioning.Url,
+		supportDoc = supportDocument(config, pubKeySupportDoc)
+	}
+
+	doc, err = json.Marshal(supportDoc)
+	err = diagnose("support-document", err)
+	return
+}
+
+// SetSupportDocument makes the given support document the one that the
+// provider serves, and marks the provider as ready to serve requests.
+func (p *Provider) SetSupportDocument(doc []byte) {
+	p.supportDocJson.Store(newServedDocument(doc))
+	p.SetReady(true)
+}
+
+// supportDocument returns the support document for the given configuration
+// and public key.
+func supportDocument(config *Configuration, pubKey PublicKeyDoc) SupportDocument {
+	document := SupportDocument{
+		PublicKey:      pubKey,
+		Authentication: config.Authentication.Url,
+		Provisioning:   config.Provisioning.Url,
+	}
+	if config.SupportDocument.Extended {
+		document.Session = config.Session.Url
+		document.Certificate = config.CertificateUrl
+		document.JwksUri = config.JwksUrl
+	}
+
+	return document
+}
+
+// GenerateJWKS returns the JWK Set of the default provider.
+func GenerateJWKS() (doc []byte, err error) {
+	return DefaultProvider.GenerateJWKS()
+}
+
+// GenerateJWKS returns a JWK Set containing the provider's public key. For a
+// provider that uses the package-level private key, any retired public keys
+// that are still published are included as well. Keys that can not be
+// represented as a JWK are omitted.
+func (p *Provider) GenerateJWKS() (doc []byte, err error) {
+	jwks := JSONWebKeySet{
+		Keys: []json.RawMessage{},
+	}
+	var keys []PublicKeyDoc
+	if key := p.ownKey(); key == nil {
+		keys = publishedKeys()
+	} else if key.supportDoc != nil {
+		keys = append(keys, key.supportDoc)
+	}
+	for _, key := range keys {
+		jwk, jwkErr := key.MarshalJWK()
+		if jwkErr != nil {
+			continue
 		}
+		jwks.Keys = append(jwks.Keys, jwk)
 	}
 
-	supportDocJson, err = json.Marshal(supportDoc)
-	if err != nil {
+	return json.Marshal(jwks)
+}
+
+// DiffSupportDocuments compares two JSON encoded support documents, and
+// returns the sorted names of the top-level fields whose values differ
+// between them, including fields that are only present in one of them.
+func DiffSupportDocuments(a, b []byte) (changed []string, err error) {
+	var docA, docB map[string]interface{}
+	if err = json.Unmarshal(a, &docA); err != nil {
 		return
 	}
+	if err = json.Unmarshal(b, &docB); err != nil {
+		return
+	}
+
+	changed = []string{}
+	for field, value := range docA {
+		if other, ok := docB[field]; !ok || !reflect.DeepEqual(value, other) {
+			changed = append(changed, field)
+		}
+	}
+	for field := range docB {
+		if _, ok := docA[field]; !ok {
+			changed = append(changed, field)
+		}
+	}
+	sort.Strings(changed)
 
-	doc = supportDocJson
 	return
 }
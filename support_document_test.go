@@ -0,0 +1,115 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSupportDocumentWeakETag(t *testing.T) {
+	p := &Provider{}
+	p.SetSupportDocument([]byte(`{"authentication":"/auth","provisioning":"/prov"}`))
+
+	w := httptest.NewRecorder()
+	p.BrowserID(w, httptest.NewRequest("GET", SupportDocumentURL, nil))
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag = %q, want a weak ETag", etag)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{etag, http.StatusNotModified},
+		{strings.TrimPrefix(etag, "W/"), http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`W/"other"`, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", SupportDocumentURL, nil)
+		r.Header.Set("If-None-Match", test.ifNoneMatch)
+		w := httptest.NewRecorder()
+		p.BrowserID(w, r)
+		if w.Code != test.status {
+			t.Errorf("If-None-Match %q: status = %d, want %d", test.ifNoneMatch, w.Code, test.status)
+		}
+	}
+}
+
+func TestSupportDocumentETagChanges(t *testing.T) {
+	a := newServedDocument([]byte(`{"a":1}`))
+	b := newServedDocument([]byte(`{"a":2}`))
+	if a.etag == b.etag {
+		t.Errorf("different documents have the same ETag %q", a.etag)
+	}
+	if etagMatches(a.etag, b.etag) {
+		t.Errorf("ETag %q matched %q", a.etag, b.etag)
+	}
+}
+
+func TestSupportDocumentExtended(t *testing.T) {
+	var config Configuration
+	config.Authentication.Url = "/auth"
+	config.Provisioning.Url = "/prov"
+	config.Session.Url = "/session"
+	config.CertificateUrl = "/certificate"
+	config.JwksUrl = "/jwks"
+
+	doc := supportDocument(&config, nil)
+	if doc.Session != "" || doc.Certificate != "" || doc.JwksUri != "" {
+		t.Errorf("basic support document = %+v, want no extended URLs", doc)
+	}
+	config.SupportDocument.Extended = true
+	doc = supportDocument(&config, nil)
+	if doc.Session != "/session" || doc.Certificate != "/certificate" || doc.JwksUri != "/jwks" {
+		t.Errorf("extended support document = %+v, want the session, certificate, and JWKS URLs", doc)
+	}
+}
+
+func TestGenerateSupportDocumentKeepsPrevious(t *testing.T) {
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = nil })
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	p := &Provider{}
+	previous := []byte(`{"authentication":"/auth","provisioning":"/prov"}`)
+	p.SetSupportDocument(previous)
+
+	var config Configuration
+	if _, err := p.GenerateSupportDocument(&config); err == nil {
+		t.Fatal("GenerateSupportDocument without a private key succeeded")
+	}
+	if doc, _ := p.currentSupportDocument(); !bytes.Equal(doc, previous) {
+		t.Errorf("support document = %s, want the previous %s", doc, previous)
+	}
+}
+
+func TestDiffSupportDocuments(t *testing.T) {
+	a := []byte(`{"public-key":{"algorithm":"RS","n":"1"},"authentication":"/auth","provisioning":"/prov"}`)
+	b := []byte(`{"public-key":{"algorithm":"RS","n":"2"},"authentication":"/auth","session":"/session"}`)
+	changed, err := DiffSupportDocuments(a, b)
+	if err != nil {
+		t.Fatalf("DiffSupportDocuments: %v", err)
+	}
+	if want := []string{"provisioning", "public-key", "session"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+	if changed, _ := DiffSupportDocuments(a, a); len(changed) != 0 {
+		t.Errorf("identical documents changed %v", changed)
+	}
+	if _, err := DiffSupportDocuments(a, []byte(`{`)); err == nil {
+		t.Error("malformed document was compared")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"html/template"
+	"io/fs"
+	"path"
+)
+
+// SetAuthenticationTemplate uses the supplied template to render the
+// authentication page. A template file given in the configuration takes
+// precedence over it, but if none is given, it is kept when the configuration
+// is loaded.
+func SetAuthenticationTemplate(t *template.Template) {
+	AuthenticationTemplate = t
+}
+
+// SetProvisioningTemplate uses the supplied template to render the
+// provisioning page. A template file given in the configuration takes
+// precedence over it, but if none is given, it is kept when the configuration
+// is loaded.
+func SetProvisioningTemplate(t *template.Template) {
+	ProvisioningTemplate = t
+}
+
+// ParseTemplate parses the given template text, making TemplateFuncs
+// available to it.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Parse(text)
+}
+
+// ParseTemplateFS parses the templates in fsys that match the given patterns,
+// such as those in an embed.FS, making TemplateFuncs available to them. The
+// first matching file is the one that is executed.
+func ParseTemplateFS(fsys fs.FS, patterns ...string) (*template.Template, error) {
+	name := ""
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 0 {
+			name = path.Base(matches[0])
+			break
+		}
+	}
+	return template.New(name).Funcs(TemplateFuncs).ParseFS(fsys, patterns...)
+}
+
+// configuredTemplate returns the template parsed from the given template
+// file. If no file is given, the current template is returned instead, so that
+// templates supplied programmatically are kept.
+func configuredTemplate(file string, current *template.Template) (*template.Template, error) {
+	if len(file) == 0 && current != nil {
+		return current, nil
+	}
+	return parseTemplateFile(file)
+}
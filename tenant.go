@@ -0,0 +1,88 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error messages.
+const (
+	errDuplicateTenant     = "tenant server name '%s' is configured more than once."
+	errInvalidTenantServer = "tenant server name '%s' is invalid."
+)
+
+// tenant is the issuer and private key used when a request arrives over TLS
+// with a particular SNI server name.
+type tenant struct {
+	issuer     string
+	key        *PrivateKey
+	supportDoc *servedDocument
+}
+
+// tenantFor returns the tenant selected by the SNI server name of the request,
+// or nil if the request was not made over TLS, did not use SNI, or used a
+// server name that has no tenant configured.
+func tenantFor(r *http.Request) *tenant {
+	if r.TLS == nil || len(r.TLS.ServerName) == 0 {
+		return nil
+	}
+	return settingsFor(r).tenants[strings.ToLower(r.TLS.ServerName)]
+}
+
+func validateTenants(config *Configuration, s *settings) (err error) {
+	tenants := map[string]*tenant{}
+	for _, tenantConfig := range config.Tenants {
+		serverName := strings.ToLower(tenantConfig.ServerName)
+		if len(serverName) == 0 {
+			err = fmt.Errorf(errInvalidTenantServer, tenantConfig.ServerName)
+			return
+		}
+		if _, exists := tenants[serverName]; exists {
+			err = fmt.Errorf(errDuplicateTenant, tenantConfig.ServerName)
+			return
+		}
+		issuer := tenantConfig.Issuer
+		if len(issuer) == 0 {
+			issuer = serverName
+		}
+		if err = validateIssuer(config, issuer); err != nil {
+			return
+		}
+
+		keyType := strings.ToUpper(tenantConfig.PrivateKey.Type)
+		if _, supported := SupportedPrivateKeyTypes[keyType]; !supported {
+			err = fmt.Errorf(errKeyTypeNotSupported, keyType)
+			return
+		}
+		format := strings.ToLower(tenantConfig.PrivateKey.Format)
+		if len(format) == 0 {
+			format = "auto"
+		}
+		var privKey interface{}
+		if privKey, err = readPrivateKey(keyType, tenantConfig.PrivateKey.File, tenantConfig.PrivateKey.Env, format, tenantConfig.PrivateKey.Passphrase); err != nil {
+			return
+		}
+		t := &tenant{
+			issuer: issuer,
+		}
+		if t.key, err = newPrivateKey(privKey); err != nil {
+			return
+		}
+		t.key.pss = s.rsaSignaturePSS
+		var supportDoc []byte
+		if supportDoc, err = json.Marshal(supportDocument(config, t.key.supportDoc)); err != nil {
+			return
+		}
+		t.supportDoc = newServedDocument(supportDoc)
+		tenants[serverName] = t
+	}
+	s.tenants = tenants
+
+	return
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Error messages.
+const (
+	errCertificateAlgMismatch    = "certificate algorithm '%s' does not match the key algorithm '%s'."
+	errInvalidSignature          = "certificate signature is invalid."
+	errMalformedCertificate      = "certificate is malformed."
+	errUnsupportedCriticalHeader = "critical header parameter '%s' is not supported."
+	errUnsupportedPublicKeyType  = "unsupported public key type."
+)
+
+// VerifyCertificate verifies that the given compact serialized certificate
+// was signed by the private key corresponding to pub. For HMAC signed
+// certificates, pub is the shared secret as a []byte.
+//
+// Certificates that list a header parameter in crit that is not in
+// UnderstoodCriticalHeaders are rejected.
+func VerifyCertificate(cert string, pub crypto.PublicKey) error {
+	segments := strings.Split(cert, ".")
+	if len(segments) != 3 {
+		return errors.New(errMalformedCertificate)
+	}
+	if secret, ok := pub.([]byte); ok {
+		pub = hmacKey(secret)
+	}
+
+	// Validate the header.
+	headerJson, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+	var header map[string]json.RawMessage
+	if err = json.Unmarshal(headerJson, &header); err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+	var alg string
+	if err = json.Unmarshal(header["alg"], &alg); err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+	pss := loadSettings().rsaSignaturePSS
+	if keyAlg := signingAlg(pub, pss); len(keyAlg) == 0 {
+		return errors.New(errUnsupportedPublicKeyType)
+	} else if alg != keyAlg {
+		return fmt.Errorf(errCertificateAlgMismatch, alg, keyAlg)
+	}
+	if err = checkCriticalHeaders(header); err != nil {
+		return err
+	}
+
+	// The payload must be a JSON object.
+	payloadJson, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+	var payload map[string]json.RawMessage
+	if err = json.Unmarshal(payloadJson, &payload); err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+
+	// Verify the signature.
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return errors.New(errMalformedCertificate)
+	}
+	if !verifySignature(pub, []byte(segments[0]+"."+segments[1]), sig, pss) {
+		return errors.New(errInvalidSignature)
+	}
+
+	return nil
+}
+
+// checkCriticalHeaders returns an error if the header lists a critical header
+// parameter that is either not understood or not present.
+func checkCriticalHeaders(header map[string]json.RawMessage) error {
+	rawCrit, ok := header["crit"]
+	if !ok {
+		return nil
+	}
+
+	var crit []string
+	if err := json.Unmarshal(rawCrit, &crit); err != nil || len(crit) == 0 {
+		return errors.New(errMalformedCertificate)
+	}
+	for _, param := range crit {
+		if _, present := header[param]; !present || !UnderstoodCriticalHeaders[param] {
+			return fmt.Errorf(errUnsupportedCriticalHeader, param)
+		}
+	}
+	return nil
+}
+
+// verifySignature returns whether sig is a valid signature of data made with
+// the private key corresponding to pub. RSA signatures are verified as
+// RSASSA-PSS signatures if pss is set.
+func verifySignature(pub crypto.PublicKey, data, sig []byte, pss bool) bool {
+	switch key := pub.(type) {
+	case hmacKey:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+
+	hash := signingHash(pub)
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key := pub.(type) {
+	case *dsa.PublicKey:
+		if size := (key.Q.BitLen() + 7) / 8; len(digest) > size {
+			digest = digest[:size]
+		}
+		r, s, ok := splitSignature(sig)
+		return ok && dsa.Verify(key, digest, r, s)
+	case *ecdsa.PublicKey:
+		// R and S are each zero padded to the size of the curve.
+		if len(sig) != 2*((key.Curve.Params().BitSize+7)/8) {
+			return false
+		}
+		r, s, ok := splitSignature(sig)
+		return ok && ecdsa.Verify(key, digest, r, s)
+	case *rsa.PublicKey:
+		if pss {
+			return rsa.VerifyPSS(key, hash, digest, sig, rsaPSSOptions) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+	}
+	return false
+}
+
+// splitSignature splits a DSA or ECDSA signature into its equal length R and
+// S components.
+func splitSignature(sig []byte) (r, s *big.Int, ok bool) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return
+	}
+	r = new(big.Int).SetBytes(sig[:len(sig)/2])
+	s = new(big.Int).SetBytes(sig[len(sig)/2:])
+	ok = true
+	return
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package persona
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyCertificate(t *testing.T) {
+	keys := testKeys(t)
+	keys["DSA"] = testDSAKey(t)
+	keys["HMAC"] = hmacKey(strings.Repeat("k", 32))
+
+	for keyType, key := range keys {
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: newPrivateKey: %v", keyType, err)
+		}
+		signed, err := signIdentityCertificate(newSettings(), testCertificateRequest(), pk, "example.com")
+		if err != nil {
+			t.Fatalf("%s: signIdentityCertificate: %v", keyType, err)
+		}
+
+		pub := publicKey(key)
+		if keyType == "HMAC" {
+			pub = []byte(key.(hmacKey))
+		}
+		if err := VerifyCertificate(signed.Compact(), pub); err != nil {
+			t.Errorf("%s: certificate did not verify: %v", keyType, err)
+		}
+		if payload := certificatePayload(t, signed); payload["iss"] != "example.com" {
+			t.Errorf("%s: iss = %v, want example.com", keyType, payload["iss"])
+		}
+	}
+}
+
+func TestSignAndVerifyCertificateRSAPSS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	pk, err := newPrivateKey(key)
+	if err != nil {
+		t.Fatalf("newPrivateKey: %v", err)
+	}
+	pk.pss = true
+	withSettingsUpdate(t, func(s *settings) { s.rsaSignaturePSS = true })
+
+	signed, err := signIdentityCertificate(loadSettings(), testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	if header, _ := base64.RawURLEncoding.DecodeString(signed.Protected); !strings.Contains(string(header), `"alg":"PS256"`) {
+		t.Errorf("header %s does not name PS256", header)
+	}
+	if err := VerifyCertificate(signed.Compact(), &key.PublicKey); err != nil {
+		t.Errorf("certificate did not verify: %v", err)
+	}
+}
+
+func TestVerifyCertificateWrongKey(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	_, other := testSigningKey(t)
+	signed, err := signIdentityCertificate(newSettings(), testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	if err := VerifyCertificate(signed.Compact(), other); err == nil || err.Error() != errInvalidSignature {
+		t.Errorf("VerifyCertificate with another key = %v, want %q", err, errInvalidSignature)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	if err := VerifyCertificate(signed.Compact(), &rsaKey.PublicKey); err == nil {
+		t.Error("certificate verified with a key of another algorithm")
+	}
+}
+
+func TestECDSASignatureFixedWidth(t *testing.T) {
+	curves := map[elliptic.Curve]int{
+		elliptic.P256(): 64,
+		elliptic.P384(): 96,
+		elliptic.P521(): 132,
+	}
+	for curve, size := range curves {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		pk, err := newPrivateKey(key)
+		if err != nil {
+			t.Fatalf("newPrivateKey: %v", err)
+		}
+		// Enough signatures that some have an R or S with a leading zero
+		// byte, which must still be padded to the full width.
+		for i := 0; i < 300; i++ {
+			data := []byte{byte(i), byte(i >> 8)}
+			sig, err := pk.SignMessage(data)
+			if err != nil {
+				t.Fatalf("%s: SignMessage: %v", curve.Params().Name, err)
+			}
+			if len(sig) != size {
+				t.Fatalf("%s: signature is %d bytes, want %d", curve.Params().Name, len(sig), size)
+			}
+			if !verifySignature(&key.PublicKey, data, sig, false) {
+				t.Fatalf("%s: signature did not verify", curve.Params().Name)
+			}
+		}
+	}
+}
+
+func TestCertificateTimestampsInMilliseconds(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	s := newSettings()
+	s.idCertIatFuzz = 0
+	req := testCertificateRequest()
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	signed, err := signIdentityCertificate(s, req, pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var cert IdentityCertificate
+	payloadJson, _ := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err := json.Unmarshal(payloadJson, &cert); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if cert.Iat < before || cert.Iat > after {
+		t.Errorf("iat = %d, want between %d and %d", cert.Iat, before, after)
+	}
+	duration := int64(req.Duration) * 1000
+	if cert.Exp-cert.Iat < duration-1000 || cert.Exp-cert.Iat > duration+1000 {
+		t.Errorf("exp - iat = %d ms, want about %d ms", cert.Exp-cert.Iat, duration)
+	}
+}
+
+func TestCertificateTimestampGranularity(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	s := newSettings()
+	s.timestampGranularity = time.Hour
+
+	signed, err := signIdentityCertificate(s, testCertificateRequest(), pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	var cert IdentityCertificate
+	payloadJson, _ := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err := json.Unmarshal(payloadJson, &cert); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	hour := int64(time.Hour / time.Millisecond)
+	if cert.Iat%hour != 0 || cert.Exp%hour != 0 {
+		t.Errorf("iat %d and exp %d are not rounded to the hour", cert.Iat, cert.Exp)
+	}
+}
+
+func TestCertificateHeaderAndPublicKeyOptions(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	s := newSettings()
+	s.jwkSetUrl = "https://example.com/jwks"
+	s.allowOmitPublicKey = true
+	req := testCertificateRequest()
+	req.OmitPublicKey = true
+
+	signed, err := signIdentityCertificate(s, req, pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(signed.Protected)
+	if !strings.Contains(string(header), `"jku":"https://example.com/jwks"`) {
+		t.Errorf("header %s does not carry the jku", header)
+	}
+	if _, ok := certificatePayload(t, signed)["public-key"]; ok {
+		t.Error("the public key was not omitted")
+	}
+
+	// Clients may only omit the public key when the configuration allows it.
+	s.allowOmitPublicKey = false
+	signed, err = signIdentityCertificate(s, req, pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	if _, ok := certificatePayload(t, signed)["public-key"]; !ok {
+		t.Error("the public key was omitted without being allowed")
+	}
+}
+
+func TestCertificateClampedToSession(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	req := testCertificateRequest()
+	req.sessionTTL = time.Minute
+
+	signed, err := signIdentityCertificate(newSettings(), req, pk, "example.com")
+	if err != nil {
+		t.Fatalf("signIdentityCertificate: %v", err)
+	}
+	var cert IdentityCertificate
+	payloadJson, _ := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err := json.Unmarshal(payloadJson, &cert); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if limit := time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond); cert.Exp > limit {
+		t.Errorf("exp %d outlives the session, which ends by %d", cert.Exp, limit)
+	}
+}
+
+func TestSupportedSigningAlgs(t *testing.T) {
+	pk, _ := testSigningKey(t)
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = pk })
+	if algs := SupportedSigningAlgs(); len(algs) != 1 || algs[0] != "ES256" {
+		t.Errorf("SupportedSigningAlgs = %v, want [ES256]", algs)
+	}
+
+	withSettingsUpdate(t, func(s *settings) { s.privateKey = nil })
+	if algs := SupportedSigningAlgs(); algs != nil {
+		t.Errorf("SupportedSigningAlgs without a key = %v, want none", algs)
+	}
+}